@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tools that read the token from the state file can send it in this
+	// header instead of the cookie
+	sessionTokenHeader = "X-Differ-Token"
+	// login urls are opened in the browser right away, an unused one is
+	// more likely to be leaked than forgotten
+	loginTokenTTL = time.Minute
+)
+
+var (
+	// secret of this run. The browser gets it in a cookie, other tools
+	// from the state file
+	sessionToken string
+
+	// loginTokens are in urls we open in the browser. Unlike sessionToken
+	// each can only be used once because urls leak e.g. in arguments of
+	// the process that opens the browser. Maps unused tokens to when they
+	// expire
+	loginTokens = make(map[string]time.Time)
+	loginMu     sync.Mutex
+)
+
+func newToken() string {
+	var d [16]byte
+	_, err := rand.Read(d[:])
+	fataliferr(err)
+	return hex.EncodeToString(d[:])
+}
+
+func initTokens() {
+	sessionToken = newToken()
+}
+
+func tokensEqual(s1, s2 string) bool {
+	return subtle.ConstantTimeCompare([]byte(s1), []byte(s2)) == 1
+}
+
+// sessionCookieName includes the port because cookies are shared by all
+// ports of a host and differ might run for several repositories at once
+func sessionCookieName(r *http.Request) string {
+	_, port, _ := net.SplitHostPort(r.Host)
+	return "differ-session-" + port
+}
+
+// loginURL returns url that logs the browser in and then opens path. Each
+// url has a new login token
+func loginURL(serverURL, path string) string {
+	token := newToken()
+	loginMu.Lock()
+	removeExpiredLoginTokens(time.Now())
+	loginTokens[token] = time.Now().Add(loginTokenTTL)
+	loginMu.Unlock()
+	uri := serverURL + "/login?token=" + token
+	if path != "/" {
+		uri += "&next=" + url.QueryEscape(path)
+	}
+	return uri
+}
+
+// removeExpiredLoginTokens must be called with loginMu locked
+func removeExpiredLoginTokens(now time.Time) {
+	for t, expires := range loginTokens {
+		if now.After(expires) {
+			delete(loginTokens, t)
+		}
+	}
+}
+
+// useLoginToken returns true if token is a login token that wasn't used yet
+// and didn't expire
+func useLoginToken(token string) bool {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+	removeExpiredLoginTokens(time.Now())
+	for t := range loginTokens {
+		if tokensEqual(token, t) {
+			delete(loginTokens, t)
+			return true
+		}
+	}
+	return false
+}
+
+// loginRedirect returns where to go after logging in. Only pages of
+// sessions are allowed, so that login urls can't redirect to other sites
+func loginRedirect(r *http.Request) string {
+	next := r.URL.Query().Get("next")
+	if strings.HasPrefix(next, "/s/") {
+		return next
+	}
+	return "/"
+}
+
+// isValidHost returns true if Host header is one that can point to us. To
+// prevent DNS rebinding attacks, we don't allow host names other than
+// localhost and the one we were told to listen on
+func isValidHost(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	host = strings.ToLower(host)
+	return host == "localhost" || host == strings.ToLower(flgAddr)
+}
+
+// isSameOrigin returns false for requests made by pages from other sites
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// browsers send Origin with POSTs and Sec-Fetch-Site with all
+		// requests, tools like curl send neither
+		site := r.Header.Get("Sec-Fetch-Site")
+		return site == "" || site == "same-origin" || site == "none"
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Scheme == "http" && u.Host == r.Host
+}
+
+func hasSessionToken(r *http.Request) bool {
+	if token := r.Header.Get(sessionTokenHeader); token != "" {
+		return tokensEqual(token, sessionToken)
+	}
+	c, err := r.Cookie(sessionCookieName(r))
+	return err == nil && tokensEqual(c.Value, sessionToken)
+}
+
+// checkRequest validates Host and Origin headers and, if needSession, the
+// session token. It responds with an error if the request is not allowed
+func checkRequest(w http.ResponseWriter, r *http.Request, needSession bool) bool {
+	if !isValidHost(r) {
+		LogErrorf("rejected request for '%s' with Host '%s'\n", r.URL.Path, r.Host)
+		servePlainText(w, r, 403, "Invalid Host header")
+		return false
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && !isSameOrigin(r) {
+		LogErrorf("rejected cross-origin %s of '%s' from '%s'\n", r.Method, r.URL.Path, r.Header.Get("Origin"))
+		servePlainText(w, r, 403, "Cross-origin requests are not allowed")
+		return false
+	}
+	if needSession && !hasSessionToken(r) {
+		servePlainText(w, r, 403, "Missing or invalid session token. Open the url printed by differ")
+		return false
+	}
+	return true
+}
+
+// withSession wraps a handler so that it's only called for requests from
+// the browser we opened or tools that know the token
+func withSession(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if checkRequest(w, r, true) {
+			h(w, r)
+		}
+	}
+}
+
+// /login?token=${token}&next=${path} sets the session cookie and redirects
+// to the ui. It accepts a one-time login token or the session token
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	LogVerbosef("handleLogin\n")
+	if !checkRequest(w, r, false) {
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if !tokensEqual(token, sessionToken) && !useLoginToken(token) {
+		servePlainText(w, r, 403, "Invalid, expired or already used login token")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName(r),
+		Value:    sessionToken,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, loginRedirect(r), http.StatusFound)
+}
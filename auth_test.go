@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginTokens(t *testing.T) {
+	tokenOf := func(uri string) string {
+		return strings.TrimPrefix(uri, "http://127.0.0.1:5555/login?token=")
+	}
+	token := tokenOf(loginURL("http://127.0.0.1:5555", "/"))
+	if useLoginToken("invalid") {
+		t.Errorf("invalid token was accepted")
+	}
+	if !useLoginToken(token) {
+		t.Errorf("token was rejected")
+	}
+	if useLoginToken(token) {
+		t.Errorf("token was accepted twice")
+	}
+
+	expired := tokenOf(loginURL("http://127.0.0.1:5555", "/"))
+	loginMu.Lock()
+	loginTokens[expired] = time.Now().Add(-time.Second)
+	loginMu.Unlock()
+	if useLoginToken(expired) {
+		t.Errorf("expired token was accepted")
+	}
+	loginMu.Lock()
+	_, ok := loginTokens[expired]
+	loginMu.Unlock()
+	if ok {
+		t.Errorf("expired token wasn't removed")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatInterval = 15 * time.Second
+	// browsers throttle timers in background tabs to once a minute, so we
+	// wait longer than that before we consider a page closed
+	clientTimeout = 2 * time.Minute
+	// after the last page is closed we wait a bit, so that reloading a page
+	// doesn't stop the server
+	shutdownGracePeriod = 10 * time.Second
+	maxClientIDLen      = 64
+)
+
+var (
+	// set with -persist flag: don't exit when all pages are closed
+	flgPersist bool
+
+	// each open page is a client that sends heartbeats. Maps client id to
+	// when we last heard from it
+	clients = make(map[string]time.Time)
+	// maps client id to id of the session its page shows, "" when not
+	// running as a daemon
+	clientSessions = make(map[string]string)
+	// maps id of a session to when its last page was closed, zero if it has
+	// pages. Sessions are only added when their first page is opened, so
+	// that we don't close them before that
+	noClientsSince = make(map[string]time.Time)
+	clientsMu      sync.Mutex
+)
+
+// touchClient remembers that we heard from a client. Returns false for ids
+// we didn't give to a page with newClient, which are ignored
+func touchClient(id string) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	sessionID, ok := clientSessions[id]
+	if !ok {
+		return false
+	}
+	clients[id] = time.Now()
+	noClientsSince[sessionID] = time.Time{}
+	return true
+}
+
+func removeClient(id string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	delete(clients, id)
+}
+
+// newClient registers a page of a session we're serving and returns its id
+func newClient(sessionID string) string {
+	id := newToken()
+	clientsMu.Lock()
+	clientSessions[id] = sessionID
+	clientsMu.Unlock()
+	touchClient(id)
+	return id
+}
+
+// forgetSessionClients forgets clients of a session that is closed
+func forgetSessionClients(sessionID string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for id, sid := range clientSessions {
+		if sid == sessionID {
+			delete(clientSessions, id)
+			delete(clients, id)
+		}
+	}
+	delete(noClientsSince, sessionID)
+}
+
+// idleSessions forgets clients that stopped sending heartbeats and returns
+// ids of sessions that had no clients for shutdownGracePeriod
+func idleSessions(now time.Time) []string {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	hasClients := make(map[string]bool)
+	for id, lastSeen := range clients {
+		if now.Sub(lastSeen) > clientTimeout {
+			LogVerbosef("client '%s' timed out\n", id)
+			delete(clients, id)
+			continue
+		}
+		hasClients[clientSessions[id]] = true
+	}
+	var res []string
+	for sessionID, since := range noClientsSince {
+		if hasClients[sessionID] {
+			noClientsSince[sessionID] = time.Time{}
+			continue
+		}
+		if since.IsZero() {
+			noClientsSince[sessionID] = now
+			since = now
+		}
+		if now.Sub(since) >= shutdownGracePeriod {
+			res = append(res, sessionID)
+		}
+	}
+	return res
+}
+
+// watchClients calls onIdle for sessions whose pages were all closed, until
+// it returns true. Without the daemon there's a single session with id ""
+func watchClients(onIdle func(sessionID string) bool) {
+	for now := range time.Tick(time.Second) {
+		for _, sessionID := range idleSessions(now) {
+			if onIdle(sessionID) {
+				return
+			}
+		}
+	}
+}
+
+func clientFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.FormValue("client")
+	if id == "" || len(id) > maxClientIDLen {
+		servePlainText(w, r, 400, "missing or invalid client argument")
+		return "", false
+	}
+	return id, true
+}
+
+// /heartbeat?client=${id}, sent periodically by open pages
+func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	id, ok := clientFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if !touchClient(id) {
+		servePlainText(w, r, 404, "unknown client '%s'", id)
+		return
+	}
+	servePlainText(w, r, 200, "ok")
+}
+
+// /bye?client=${id}, sent with navigator.sendBeacon() when a page is closed
+func handleBye(w http.ResponseWriter, r *http.Request) {
+	id, ok := clientFromRequest(w, r)
+	if !ok {
+		return
+	}
+	LogVerbosef("client '%s' is gone\n", id)
+	removeClient(id)
+	servePlainText(w, r, 200, "ok")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTouchClient(t *testing.T) {
+	id := newClient("session")
+	defer forgetSessionClients("session")
+
+	if touchClient("unknown") {
+		t.Errorf("touchClient() of an unknown client returned true")
+	}
+	clientsMu.Lock()
+	_, inClients := clients["unknown"]
+	_, inSessions := clientSessions["unknown"]
+	clientsMu.Unlock()
+	if inClients || inSessions {
+		t.Errorf("heartbeat of an unknown client added it")
+	}
+
+	// a client that timed out comes back, e.g. a page in a background tab
+	idleSessions(time.Now().Add(clientTimeout + time.Second))
+	if !touchClient(id) {
+		t.Errorf("touchClient() of a registered client returned false")
+	}
+	clientsMu.Lock()
+	_, ok := clients[id]
+	clientsMu.Unlock()
+	if !ok {
+		t.Errorf("client wasn't refreshed")
+	}
+}
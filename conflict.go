@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// ConflictResponse describes response for /conflict/:idx. Missing stages
+// (e.g. a file deleted on one side) are null. Large and binary conflicts
+// are read-only, their contents are replaced with a message and they have
+// to be resolved with git
+type ConflictResponse struct {
+	Path     string  `json:"path"`
+	Base     *string `json:"base"`
+	Ours     *string `json:"ours"`
+	Theirs   *string `json:"theirs"`
+	Merged   *string `json:"merged"`
+	Resolved bool    `json:"resolved"`
+	ReadOnly bool    `json:"read_only"`
+}
+
+func getStageContent(dir, rev, path string) []byte {
+	d, err := gitGetFileContent(dir, rev, path)
+	if err != nil {
+		LogVerbosef("no stage '%s' for '%s'\n", rev, path)
+		return nil
+	}
+	return d
+}
+
+// loadConflictContents gets base, ours and theirs stages of an unmerged
+// file from the index and the merged file from the working tree. We show
+// ours vs. the working tree as a regular diff
+func loadConflictContents(fc *fileContents, dir, path string) {
+	fc.base = getStageContent(dir, revStageBase, path)
+	fc.ours = getStageContent(dir, revStageOurs, path)
+	fc.theirs = getStageContent(dir, revStageTheirs, path)
+	fc.before = fc.ours
+	d, err := ioutil.ReadFile(filepath.Join(dir, path))
+	if err == nil {
+		fc.after = d
+	}
+}
+
+func bytesToStrPtr(d []byte) *string {
+	if d == nil {
+		return nil
+	}
+	s := string(d)
+	return &s
+}
+
+// isReadOnlyConflict returns true if any version of a conflicted file is
+// too large or binary to be edited in the browser
+func isReadOnlyConflict(fc *fileContents) bool {
+	for _, d := range [][]byte{fc.base, fc.ours, fc.theirs, fc.after} {
+		if isTooLargeToDiff(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// newConflictResponse creates ConflictResponse out of full (not capped)
+// contents of a conflicted file
+func newConflictResponse(tr *ThickResponse, fc *fileContents) *ConflictResponse {
+	res := &ConflictResponse{
+		Path:     *tr.BeforePath,
+		Resolved: tr.IsResolved,
+		ReadOnly: isReadOnlyConflict(fc),
+	}
+	get := func(d []byte) *string {
+		if d != nil && res.ReadOnly {
+			d = capFileSize(d)
+		}
+		return bytesToStrPtr(d)
+	}
+	res.Base = get(fc.base)
+	res.Ours = get(fc.ours)
+	res.Theirs = get(fc.theirs)
+	res.Merged = get(fc.after)
+	return res
+}
+
+// loadConflictOrFail reads full contents of a conflicted file. Contents
+// cached for showing a diff are capped so we can't use them for resolving.
+// Returns false if there was an error or the change is not a conflict, in
+// which case a response has been sent
+func loadConflictOrFail(w http.ResponseWriter, r *http.Request, s *Session, gc *Change) (ThickResponse, *fileContents, bool) {
+	s.mu.Lock()
+	tr := gc.ThickResponse
+	key := gc.GitChange
+	s.mu.Unlock()
+	if !tr.IsConflict {
+		http.NotFound(w, r)
+		return tr, nil, false
+	}
+	fc, err := s.source.readContents(&key)
+	if err != nil {
+		LogErrorf("readContents() of '%s' failed with '%s'\n", key.GetPath(), err)
+		servePlainText(w, r, 500, "failed to read '%s': %s", key.GetPath(), err)
+		return tr, nil, false
+	}
+	return tr, fc, true
+}
+
+// resolveConflict writes the resolved content of a file in repository in
+// dir and marks it as resolved with git add. nil content means the
+// resolution is to delete the file
+func resolveConflict(dir, path string, content []byte) error {
+	fullPath := filepath.Join(dir, path)
+	if content == nil {
+		err := os.Remove(fullPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		_, err = runCmdInDir(dir, gitPath, "rm", "--quiet", "--", path)
+		return err
+	}
+	mode := os.FileMode(0644)
+	if st, err := os.Stat(fullPath); err == nil {
+		mode = st.Mode()
+	}
+	if err := ioutil.WriteFile(fullPath, content, mode); err != nil {
+		return err
+	}
+	_, err := runCmdInDir(dir, gitPath, "add", "--", path)
+	return err
+}
+
+// resolution is either one of the sides, as "side" argument (base, ours or
+// theirs), or the full content of the file, as "content" argument
+func getResolution(r *http.Request, fc *fileContents) ([]byte, error) {
+	side := r.FormValue("side")
+	switch side {
+	case "base":
+		return fc.base, nil
+	case "ours":
+		return fc.ours, nil
+	case "theirs":
+		return fc.theirs, nil
+	case "":
+		if _, ok := r.Form["content"]; !ok {
+			return nil, errors.New("missing 'side' or 'content' argument")
+		}
+		return []byte(r.FormValue("content")), nil
+	}
+	return nil, errors.New("invalid side '" + side + "'")
+}
+
+// /conflict/:idx
+func handleConflict(w http.ResponseWriter, r *http.Request, s *Session) {
+	LogVerbosef("handleConflict uri='%s'\n", r.URL.Path)
+	gc := getChangeFromURI(w, r, s, "/conflict/")
+	if gc == nil {
+		return
+	}
+	tr, fc, ok := loadConflictOrFail(w, r, s, gc)
+	if !ok {
+		return
+	}
+	httpOkWithJSON(w, r, newConflictResponse(&tr, fc))
+}
+
+// POST /resolve/:idx
+func handleResolve(w http.ResponseWriter, r *http.Request, s *Session) {
+	LogVerbosef("handleResolve uri='%s'\n", r.URL.Path)
+	if r.Method != "POST" {
+		servePlainText(w, r, http.StatusMethodNotAllowed, "must be POST")
+		return
+	}
+	gc := getChangeFromURI(w, r, s, "/resolve/")
+	if gc == nil {
+		return
+	}
+	tr, fc, ok := loadConflictOrFail(w, r, s, gc)
+	if !ok {
+		return
+	}
+	path := *tr.BeforePath
+	if isReadOnlyConflict(fc) {
+		servePlainText(w, r, 400, "'%s' is too large or binary, resolve it with git", path)
+		return
+	}
+	r.ParseForm()
+	content, err := getResolution(r, fc)
+	if err != nil {
+		servePlainText(w, r, 400, "%s", err)
+		return
+	}
+	if err = resolveConflict(s.spec.GitDir, path, content); err != nil {
+		LogErrorf("resolveConflict('%s') failed with '%s'\n", path, err)
+		servePlainText(w, r, 500, "failed to resolve '%s': %s", path, err)
+		return
+	}
+	resolved := *fc
+	resolved.after = content
+	cached := resolved
+	cached.before = capFileSize(cached.before)
+	cached.after = capFileSize(cached.after)
+	s.contentsCache.add(gc.GitChange, &cached)
+	s.mu.Lock()
+	gc.IsResolved = true
+	gc.infoLoaded = false
+	tr = gc.ThickResponse
+	s.mu.Unlock()
+	httpOkWithJSON(w, r, newConflictResponse(&tr, &resolved))
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// how many changes after the one being viewed we load in the background
+	prefetchCount = 3
+)
+
+var (
+	// memory budget (in MB) for contents of files kept in memory, per
+	// session
+	contentsCacheMB = 256
+)
+
+// fileContents are contents of both sides of a change. They're only read
+// when needed and kept in contentsCache of the session
+type fileContents struct {
+	before []byte
+	after  []byte
+	// stages of a file with merge conflicts, nil if missing
+	base   []byte
+	ours   []byte
+	theirs []byte
+}
+
+func (fc *fileContents) size() int {
+	return len(fc.before) + len(fc.after) + len(fc.base) + len(fc.ours) + len(fc.theirs)
+}
+
+// changeSource describes where changes come from (git or 2 directories)
+type changeSource struct {
+	// newThickResponse returns information about a change that doesn't
+	// require reading its contents
+	newThickResponse func(c *GitChange) ThickResponse
+	readContents     func(c *GitChange) (*fileContents, error)
+}
+
+var (
+	dirSource = &changeSource{
+		newThickResponse: ThickResponseFromDirDiffs,
+		readContents:     readDirContents,
+	}
+)
+
+// newGitSource returns changeSource for changes in repository in dir, ""
+// for the current directory
+func newGitSource(dir string) *changeSource {
+	return &changeSource{
+		newThickResponse: ThickResponseFromGitChange,
+		readContents: func(c *GitChange) (*fileContents, error) {
+			return readGitContents(dir, c)
+		},
+	}
+}
+
+// readGitContents reads both sides of a change from git
+func readGitContents(dir string, c *GitChange) (*fileContents, error) {
+	var res fileContents
+	var err error
+	// remembers the first error so that we don't have to check every call
+	get := func(rev, path string) []byte {
+		if err != nil {
+			return nil
+		}
+		var d []byte
+		d, err = gitGetFileContent(dir, rev, path)
+		return d
+	}
+	switch c.Type {
+	case Modified:
+		res.before = get(c.RevBefore, c.PathBefore)
+		res.after = get(c.RevAfter, c.PathBefore)
+	case Added:
+		res.after = get(c.RevAfter, c.PathAfter)
+	case Deleted:
+		res.before = get(c.RevBefore, c.PathBefore)
+	case Renamed, Copied:
+		res.before = get(c.RevBefore, c.PathBefore)
+		res.after = get(c.RevAfter, c.PathAfter)
+	case NotCheckedIn:
+		res.after = get(revWorkTree, c.PathAfter)
+	case Unmerged:
+		loadConflictContents(&res, dir, c.PathBefore)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// readDirContents reads both sides of a change between 2 directories
+func readDirContents(c *GitChange) (*fileContents, error) {
+	var res fileContents
+	var err error
+	// remembers the first error so that we don't have to check every call
+	read := func(path string) []byte {
+		if err != nil {
+			return nil
+		}
+		var d []byte
+		d, err = ioutil.ReadFile(path)
+		return d
+	}
+	switch c.Type {
+	case Modified, Renamed, Copied:
+		res.before = read(c.PathBefore)
+		res.after = read(c.PathAfter)
+	case Added, NotCheckedIn:
+		res.after = read(c.PathAfter)
+	case Deleted:
+		res.before = read(c.PathBefore)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+type lruEntry struct {
+	key GitChange
+	fc  *fileContents
+}
+
+// contentsLRU keeps contents of recently used changes, up to maxBytes
+type contentsLRU struct {
+	mu       sync.Mutex
+	maxBytes int
+	nBytes   int
+	// of *lruEntry, most recently used first
+	order   *list.List
+	entries map[GitChange]*list.Element
+}
+
+func newContentsLRU(maxBytes int) *contentsLRU {
+	return &contentsLRU{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[GitChange]*list.Element),
+	}
+}
+
+func (c *contentsLRU) get(key GitChange) *fileContents {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el := c.entries[key]
+	if el == nil {
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).fc
+}
+
+// must be called with c.mu locked
+func (c *contentsLRU) removeElementLocked(el *list.Element) {
+	e := el.Value.(*lruEntry)
+	c.order.Remove(el)
+	delete(c.entries, e.key)
+	c.nBytes -= e.fc.size()
+}
+
+// add caches fc, evicting least recently used contents if over budget.
+// Contents bigger than the whole budget are not cached
+func (c *contentsLRU) add(key GitChange, fc *fileContents) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el := c.entries[key]; el != nil {
+		c.removeElementLocked(el)
+	}
+	size := fc.size()
+	if size > c.maxBytes {
+		return
+	}
+	for c.nBytes+size > c.maxBytes {
+		c.removeElementLocked(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, fc})
+	c.nBytes += size
+}
+
+// removeIf removes contents of changes for which fn returns true
+func (c *contentsLRU) removeIf(fn func(key GitChange) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if fn(key) {
+			c.removeElementLocked(el)
+		}
+	}
+}
+
+// readContents reads contents of a change. Large and binary files are
+// replaced with a message, except for images which we show as images
+func (s *Session) readContents(c *GitChange, isImage bool) (*fileContents, error) {
+	fc, err := s.source.readContents(c)
+	if err != nil {
+		return nil, err
+	}
+	if !isImage {
+		fc.before = capFileSize(fc.before)
+		fc.after = capFileSize(fc.after)
+	}
+	return fc, nil
+}
+
+// loadContents returns contents of a change, reading them if not cached,
+// and its ThickResponse. The first time contents are read, we also fill
+// parts of ThickResponse that depend on them
+func (s *Session) loadContents(gc *Change) (ThickResponse, *fileContents, error) {
+	s.mu.Lock()
+	key := gc.GitChange
+	isImage := gc.IsImage
+	s.mu.Unlock()
+	fc := s.contentsCache.get(key)
+	if fc == nil {
+		var err error
+		LogVerbosef("reading contents of '%s'\n", key.GetPath())
+		fc, err = s.readContents(&key, isImage)
+		if err != nil {
+			return ThickResponse{}, nil, err
+		}
+		s.contentsCache.add(key, fc)
+	}
+
+	s.mu.Lock()
+	infoLoaded := gc.infoLoaded
+	s.mu.Unlock()
+	if !infoLoaded {
+		info := newContentsInfo(isImage, key.GetPath(), fc)
+		s.mu.Lock()
+		gc.contentsInfo = info
+		gc.infoLoaded = true
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return gc.ThickResponse, fc, nil
+}
+
+// loadImagesInfo fills contentsInfo of image changes that are not yet
+// shown, so that the list of files can tell which images have the same
+// pixels before they're opened, and sends them to the browser as "images"
+// event. It runs in the background after changes are built. Contents are
+// not cached to not evict contents of files being viewed
+func (s *Session) loadImagesInfo() {
+	s.mu.Lock()
+	generation := s.generation
+	changes := s.changes
+	s.mu.Unlock()
+	var loaded []*ThickResponse
+	for _, gc := range changes {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		s.mu.Lock()
+		key := gc.GitChange
+		needed := gc.IsImage && !gc.infoLoaded
+		s.mu.Unlock()
+		if !needed {
+			continue
+		}
+		fc, err := s.readContents(&key, true)
+		if err != nil {
+			LogErrorf("readContents() of '%s' failed with '%s'\n", key.GetPath(), err)
+			continue
+		}
+		info := newContentsInfo(true, key.GetPath(), fc)
+		s.mu.Lock()
+		if !gc.infoLoaded {
+			gc.contentsInfo = info
+			gc.infoLoaded = true
+		}
+		tr := gc.ThickResponse
+		s.mu.Unlock()
+		loaded = append(loaded, &tr)
+	}
+	if len(loaded) == 0 {
+		return
+	}
+	d, err := json.Marshal(&ChangesEvent{Generation: generation, Pairs: loaded})
+	if err != nil {
+		LogErrorf("json.Marshal() failed with '%s'\n", err)
+		return
+	}
+	LogVerbosef("compared %d images, generation %d\n", len(loaded), generation)
+	s.broadcastEvent("images", d)
+}
+
+// prefetchContents asks the prefetcher to load contents of changes starting
+// at idx. A previous request that didn't start yet is dropped
+func (s *Session) prefetchContents(idx int) {
+	for {
+		select {
+		case s.prefetchRequests <- idx:
+			return
+		default:
+		}
+		select {
+		case <-s.prefetchRequests:
+		default:
+		}
+	}
+}
+
+// prefetcher loads contents of changes in the background so that they're
+// ready when the user moves to the next file
+func (s *Session) prefetcher() {
+	for {
+		var idx int
+		select {
+		case idx = <-s.prefetchRequests:
+		case <-s.done:
+			return
+		}
+		for i := idx; i < idx+prefetchCount; i++ {
+			gc := s.getChangeByIdx(i)
+			if gc == nil {
+				break
+			}
+			if _, _, err := s.loadContents(gc); err != nil {
+				LogErrorf("loadContents() of '%s' failed with '%s'\n", gc.GetPath(), err)
+			}
+		}
+	}
+}
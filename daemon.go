@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// set with -daemon flag
+	flgDaemon bool
+
+	// url of the daemon's http server
+	daemonURL string
+
+	// sessions registered with the daemon, by id
+	sessions = make(map[string]*daemonSession)
+	// maps key of a spec to id of its session, so that showing the same
+	// changes again re-uses the session
+	sessionsBySpec = make(map[string]string)
+	lastSessionID  int
+	sessionsMu     sync.Mutex
+	// registrations are handled one at a time, so that the same changes
+	// don't end up in 2 sessions
+	registerMu sync.Mutex
+)
+
+// sessionFlags are flags that change how changes are found or shown. The
+// daemon applies its own values to all sessions, so differ only uses the
+// daemon if it has the same values
+var sessionFlags = []string{
+	"exclude", "include", "gitignore", "M", "C", "find-copies-harder", "fast",
+	"w", "b", "ignore-blank-lines", "ignore-eol", "U", "diff-algorithm",
+	"pdiff-tolerance", "moves",
+}
+
+// sessionFlagValues returns values of sessionFlags
+func sessionFlagValues() map[string]string {
+	res := make(map[string]string)
+	for _, name := range sessionFlags {
+		res[name] = flag.Lookup(name).Value.String()
+	}
+	return res
+}
+
+// differentSessionFlags returns names of sessionFlags whose values in flags
+// differ from ours
+func differentSessionFlags(flags map[string]string) []string {
+	var res []string
+	for name, v := range sessionFlagValues() {
+		if flags[name] != v {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// daemonSession is a session of the daemon and handler of its urls
+type daemonSession struct {
+	*Session
+	mux http.Handler
+}
+
+// daemonResponse is sent back to differ that registered a session
+type daemonResponse struct {
+	// login url of the page of the session
+	URL        string `json:"url,omitempty"`
+	NumChanges int    `json:"num_changes"`
+	Error      string `json:"error,omitempty"`
+	// sessionFlags that differ between the daemon and differ, which then
+	// shows changes itself
+	DifferentFlags []string `json:"different_flags,omitempty"`
+}
+
+// sessionInfo is a session in the list of sessions of the daemon
+type sessionInfo struct {
+	ID         int
+	Title      string
+	URL        string
+	NumChanges int
+}
+
+// daemonSocketPath returns path of unix socket on which the daemon accepts
+// registrations: ${user cache dir}/differ/daemon.sock
+func daemonSocketPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "differ", "daemon.sock"), nil
+}
+
+// listenDaemonSocket listens on the daemon's socket. Only the user can
+// connect to it, so other users can't make us read their files
+func listenDaemonSocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another daemon is listening on '%s'", path)
+	}
+	// left over by a daemon that didn't exit cleanly
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// specKey identifies changes described by spec
+func specKey(spec *sessionSpec) string {
+	d, _ := json.Marshal(spec)
+	h := sha1.Sum(d)
+	return hex.EncodeToString(h[:])
+}
+
+func getDaemonSession(id string) *daemonSession {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return sessions[id]
+}
+
+// registerSession returns a session showing changes described by spec,
+// creating it if there isn't one yet. Sessions without changes are not kept
+func registerSession(spec *sessionSpec) daemonResponse {
+	if isGitSession(spec.Kind) && gitPath == "" {
+		return daemonResponse{Error: "git executable not found by the daemon"}
+	}
+	if flags := differentSessionFlags(spec.Flags); len(flags) > 0 {
+		return daemonResponse{DifferentFlags: flags}
+	}
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	key := specKey(spec)
+	sessionsMu.Lock()
+	ds := sessions[sessionsBySpec[key]]
+	sessionsMu.Unlock()
+	if ds == nil {
+		s, err := newSession(spec)
+		if err != nil {
+			return daemonResponse{Error: err.Error()}
+		}
+		if len(s.getChanges()) == 0 {
+			return daemonResponse{}
+		}
+		if flgWatch {
+			s.startWatching()
+		}
+		sessionsMu.Lock()
+		lastSessionID++
+		s.ID = strconv.Itoa(lastSessionID)
+		s.urlPrefix = "/s/" + s.ID
+		ds = &daemonSession{Session: s, mux: newSessionMux(s)}
+		sessions[s.ID] = ds
+		sessionsBySpec[key] = s.ID
+		sessionsMu.Unlock()
+		LogVerbosef("registered session %s: %s\n", s.ID, spec.title())
+	}
+	return daemonResponse{
+		URL:        loginURL(daemonURL, ds.urlPrefix+"/"),
+		NumChanges: len(ds.getChanges()),
+	}
+}
+
+// unregisterSession closes a session whose pages were all closed. Showing
+// the same changes again creates a new session
+func unregisterSession(id string) {
+	forgetSessionClients(id)
+	registerMu.Lock()
+	defer registerMu.Unlock()
+	sessionsMu.Lock()
+	ds := sessions[id]
+	if ds != nil {
+		delete(sessions, id)
+		delete(sessionsBySpec, specKey(ds.spec))
+	}
+	sessionsMu.Unlock()
+	if ds == nil {
+		return
+	}
+	ds.close()
+	LogVerbosef("unregistered session %s: %s\n", id, ds.spec.title())
+}
+
+// handleRegistration reads sessionSpec from differ that wants us to show
+// its changes and responds with daemonResponse
+func handleRegistration(conn net.Conn) {
+	defer conn.Close()
+	var spec sessionSpec
+	var res daemonResponse
+	if err := json.NewDecoder(conn).Decode(&spec); err != nil {
+		res.Error = fmt.Sprintf("invalid registration: %s", err)
+	} else {
+		res = registerSession(&spec)
+	}
+	if err := json.NewEncoder(conn).Encode(res); err != nil {
+		LogErrorf("sending registration response failed with '%s'\n", err)
+	}
+}
+
+func acceptRegistrations(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// the listener is closed when we exit
+			LogVerbosef("l.Accept() failed with '%s'\n", err)
+			return
+		}
+		go handleRegistration(conn)
+	}
+}
+
+// showInDaemon sends spec to differ -daemon, if it's running, and opens the
+// page of the session in the browser. Returns false if there's no daemon
+// or it was started with different sessionFlags
+func showInDaemon(spec *sessionSpec) bool {
+	path, err := daemonSocketPath()
+	if err != nil {
+		return false
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	LogVerbosef("showing changes in the daemon listening on '%s'\n", path)
+	err = spec.makeAbs()
+	fataliferr(err)
+	spec.Flags = sessionFlagValues()
+	var res daemonResponse
+	err = json.NewEncoder(conn).Encode(spec)
+	if err == nil {
+		err = json.NewDecoder(conn).Decode(&res)
+	}
+	if err != nil {
+		LogErrorf("registering with the daemon failed with '%s'\n", err)
+		os.Exit(1)
+	}
+	if len(res.DifferentFlags) > 0 {
+		fmt.Printf("Not using the running daemon, it has different -%s\n", strings.Join(res.DifferentFlags, ", -"))
+		return false
+	}
+	if res.Error != "" {
+		LogErrorf("getting list of changes failed with '%s'\n", res.Error)
+		os.Exit(1)
+	}
+	if res.NumChanges == 0 {
+		fmt.Printf("There are no changes!\n")
+		return true
+	}
+	if err := openDefaultBrowser(res.URL); err != nil {
+		fmt.Printf("Open %s in the browser\n", res.URL)
+	}
+	return true
+}
+
+// /s/:id/... are urls of a session, the same as urls of differ showing a
+// single session
+func handleSessionRequest(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/s/")
+	id := rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		id = rest[:i]
+	}
+	ds := getDaemonSession(id)
+	if ds == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if rest == id {
+		// the ui of a session is at /s/:id/
+		http.Redirect(w, r, ds.urlPrefix+"/", http.StatusMovedPermanently)
+		return
+	}
+	http.StripPrefix(ds.urlPrefix, ds.mux).ServeHTTP(w, r)
+}
+
+// / of the daemon lists sessions
+func handleSessionsIndex(w http.ResponseWriter, r *http.Request) {
+	LogVerbosef("%s '%s'\n", r.Method, r.URL.Path)
+	if r.URL.Path != "/" {
+		serveFile(w, r, r.URL.Path[1:])
+		return
+	}
+	var v struct {
+		Sessions []*sessionInfo
+	}
+	sessionsMu.Lock()
+	for _, ds := range sessions {
+		id, _ := strconv.Atoi(ds.ID)
+		v.Sessions = append(v.Sessions, &sessionInfo{
+			ID:         id,
+			Title:      ds.spec.title(),
+			URL:        ds.urlPrefix + "/",
+			NumChanges: len(ds.getChanges()),
+		})
+	}
+	sessionsMu.Unlock()
+	sort.Slice(v.Sessions, func(i, j int) bool {
+		return v.Sessions[i].ID < v.Sessions[j].ID
+	})
+	execTemplate(w, tmplSessions, v)
+}
+
+func registerDaemonHandlers() {
+	registerCommonHandlers()
+	http.HandleFunc("/s/", withSession(handleSessionRequest))
+	http.HandleFunc("/", withSession(handleSessionsIndex))
+}
+
+// runDaemon implements -daemon: shows changes of differ processes that
+// register with it over a unix socket, each as a session at /s/:id, until
+// ctrl-c or /kill. Sessions are closed when their pages are closed, unless
+// -persist. Options like -w or -U of the daemon apply to all sessions, so
+// differ with other values doesn't register
+func runDaemon() {
+	path, err := daemonSocketPath()
+	fataliferr(err)
+	sock, err := listenDaemonSocket(path)
+	if err != nil {
+		LogErrorf("listenDaemonSocket() failed with '%s'\n", err)
+		os.Exit(1)
+	}
+	// git is only needed for sessions of git repositories
+	if gitPath, err = exec.LookPath("git"); err != nil {
+		LogErrorf("Only comparing directories and patches, git not found: '%s'\n", err)
+	}
+	initDirDiff()
+	registerDaemonHandlers()
+	l, uri := listenHTTP()
+	daemonURL = uri
+	if !flgPersist {
+		go watchClients(func(sessionID string) bool {
+			unregisterSession(sessionID)
+			return false
+		})
+	}
+	go acceptRegistrations(sock)
+	fmt.Printf("Open %s in the browser to see all sessions\n", loginURL(uri, "/"))
+	serveHTTP(l)
+	// also removes the socket file
+	sock.Close()
+}
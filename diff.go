@@ -0,0 +1,663 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DiffAlgorithmMyers     = "myers"
+	DiffAlgorithmPatience  = "patience"
+	DiffAlgorithmHistogram = "histogram"
+
+	OpEqual   = "equal"
+	OpReplace = "replace"
+	OpDelete  = "delete"
+	OpInsert  = "insert"
+
+	// like git, histogram diff falls back to myers for lines that repeat
+	// more often than that
+	histogramMaxChainLength = 64
+)
+
+var (
+	// default diff algorithm and number of context lines for /diff/:idx
+	diffAlgorithm = DiffAlgorithmMyers
+	diffContext   = 3
+)
+
+// DiffOp is an opcode like in Python's difflib: lines [BeforeStart, BeforeEnd)
+// of before are Op ("equal", "replace", "delete", "insert") lines
+// [AfterStart, AfterEnd) of after. Line numbers are 0-based
+type DiffOp struct {
+	Op          string `json:"op"`
+	BeforeStart int    `json:"before_start"`
+	BeforeEnd   int    `json:"before_end"`
+	AfterStart  int    `json:"after_start"`
+	AfterEnd    int    `json:"after_end"`
+}
+
+// DiffLine is a single line of a hunk. Op is "equal", "delete" or "insert".
+// Line numbers are 1-based and 0 for the missing side
+type DiffLine struct {
+	Op         string `json:"op"`
+	BeforeLine int    `json:"before_line"`
+	AfterLine  int    `json:"after_line"`
+	Text       string `json:"text"`
+	// changed words and characters, only set for lines of replaced line
+	// pairs (n-th deleted line is paired with n-th inserted line)
+	WordSpans []DiffSpan `json:"word_spans,omitempty"`
+	CharSpans []DiffSpan `json:"char_spans,omitempty"`
+	// only set for deleted or inserted lines of moved blocks
+	MovedTo   *MoveLocation `json:"moved_to,omitempty"`
+	MovedFrom *MoveLocation `json:"moved_from,omitempty"`
+}
+
+// DiffHunk is a group of changes with surrounding context lines. Start and
+// count are like in unified diff @@ -BeforeStart,BeforeCount +AfterStart,AfterCount @@
+type DiffHunk struct {
+	BeforeStart int         `json:"before_start"`
+	BeforeCount int         `json:"before_count"`
+	AfterStart  int         `json:"after_start"`
+	AfterCount  int         `json:"after_count"`
+	Ops         []DiffOp    `json:"opcodes"`
+	Lines       []*DiffLine `json:"lines"`
+}
+
+// DiffResponse describes response for /diff/:idx
+type DiffResponse struct {
+	Algorithm string `json:"algorithm"`
+	Context   int    `json:"context"`
+	whitespaceOptions
+	BeforeLines int         `json:"before_lines"`
+	AfterLines  int         `json:"after_lines"`
+	Hunks       []*DiffHunk `json:"hunks"`
+	// blocks moved from or to this file
+	Moves []*MovedBlock `json:"moves,omitempty"`
+	// true if moves are still being found, they can be fetched from /moves
+	MovesPending bool `json:"moves_pending,omitempty"`
+}
+
+func isValidDiffAlgorithm(s string) bool {
+	switch s {
+	case DiffAlgorithmMyers, DiffAlgorithmPatience, DiffAlgorithmHistogram:
+		return true
+	}
+	return false
+}
+
+// splitLines splits d into lines without line endings
+func splitLines(d []byte) []string {
+	if len(d) == 0 {
+		return nil
+	}
+	s := strings.TrimSuffix(string(d), "\n")
+	return strings.Split(s, "\n")
+}
+
+// internLines returns ids of lines of before and after such that equal
+// lines have equal ids, which makes comparing lines cheap. If normalize is
+// given, lines are equal if their normalized versions are equal
+func internLines(before, after []string, normalize func(string) string) ([]int, []int) {
+	ids := make(map[string]int)
+	intern := func(lines []string) []int {
+		res := make([]int, len(lines))
+		for i, l := range lines {
+			if normalize != nil {
+				l = normalize(l)
+			}
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			res[i] = id
+		}
+		return res
+	}
+	return intern(before), intern(after)
+}
+
+// diffMatch is a block of n equal lines at a[A:] and b[B:]
+type diffMatch struct {
+	A, B, N int
+}
+
+// matcher finds matching lines of a and b. aOff and bOff are positions of
+// a and b in the whole files, which is what we add to res
+type matcher func(a, b []int, aOff, bOff int, res *[]diffMatch)
+
+// trimCommon adds common prefix and suffix of a and b to res and returns
+// what remains in between
+func trimCommon(a, b []int, aOff, bOff int, res *[]diffMatch) ([]int, []int, int, int) {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	if n > 0 {
+		*res = append(*res, diffMatch{aOff, bOff, n})
+	}
+	a, b = a[n:], b[n:]
+	aOff, bOff = aOff+n, bOff+n
+	n = 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	if n > 0 {
+		*res = append(*res, diffMatch{aOff + len(a) - n, bOff + len(b) - n, n})
+	}
+	return a[:len(a)-n], b[:len(b)-n], aOff, bOff
+}
+
+// myersMatches implements linear space variant of Myers' O(ND) algorithm
+// See http://www.xmailserver.org/diff2.pdf
+func myersMatches(a, b []int, aOff, bOff int, res *[]diffMatch) {
+	a, b, aOff, bOff = trimCommon(a, b, aOff, bOff, res)
+	if len(a) == 0 || len(b) == 0 {
+		return
+	}
+	x, y := myersMiddleSnake(a, b)
+	if x <= 0 && y <= 0 || x == len(a) && y == len(b) {
+		// nothing in common
+		return
+	}
+	myersMatches(a[:x], b[:y], aOff, bOff, res)
+	myersMatches(a[x:], b[y:], aOff+x, bOff+y, res)
+}
+
+// myersMiddleSnake finds a point on the shortest edit path by searching
+// from both ends at the same time. Returns -1, -1 if a and b have nothing
+// in common
+func myersMiddleSnake(a, b []int) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	vOff := maxD + 1
+	vLen := 2*maxD + 3
+	// furthest x reached on diagonal k (k = x - y) going forward (vf) and
+	// backward (vb, measured from the ends)
+	vf := make([]int, vLen)
+	vb := make([]int, vLen)
+	for i := range vf {
+		vf[i] = -1
+		vb[i] = -1
+	}
+	vf[vOff+1] = 0
+	vb[vOff+1] = 0
+	delta := n - m
+	// if delta is odd, paths overlap when going forward, else going backward
+	front := delta%2 != 0
+	// trim diagonals that went past the edges
+	kfStart, kfEnd, kbStart, kbEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + kfStart; k <= d-kfEnd; k += 2 {
+			kOff := vOff + k
+			var x int
+			if k == -d || (k != d && vf[kOff-1] < vf[kOff+1]) {
+				x = vf[kOff+1]
+			} else {
+				x = vf[kOff-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[kOff] = x
+			if x > n {
+				kfEnd += 2
+			} else if y > m {
+				kfStart += 2
+			} else if front {
+				kbOff := vOff + delta - k
+				if kbOff >= 0 && kbOff < vLen && vb[kbOff] != -1 {
+					if x >= n-vb[kbOff] {
+						return x, y
+					}
+				}
+			}
+		}
+		for k := -d + kbStart; k <= d-kbEnd; k += 2 {
+			kOff := vOff + k
+			var x int
+			if k == -d || (k != d && vb[kOff-1] < vb[kOff+1]) {
+				x = vb[kOff+1]
+			} else {
+				x = vb[kOff-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			vb[kOff] = x
+			if x > n {
+				kbEnd += 2
+			} else if y > m {
+				kbStart += 2
+			} else if !front {
+				kfOff := vOff + delta - k
+				if kfOff >= 0 && kfOff < vLen && vf[kfOff] != -1 {
+					xf := vf[kfOff]
+					yf := xf - (kfOff - vOff)
+					if xf >= n-x {
+						return xf, yf
+					}
+				}
+			}
+		}
+	}
+	return -1, -1
+}
+
+// patienceMatches implements patience diff: lines that occur exactly once
+// in both a and b are matched as anchors (in the longest increasing order)
+// and regions between anchors are diffed recursively
+// See https://bramcohen.livejournal.com/73318.html
+func patienceMatches(a, b []int, aOff, bOff int, res *[]diffMatch) {
+	a, b, aOff, bOff = trimCommon(a, b, aOff, bOff, res)
+	if len(a) == 0 || len(b) == 0 {
+		return
+	}
+	type occurrence struct {
+		countA, countB int
+		posA, posB     int
+	}
+	occurrences := make(map[int]*occurrence)
+	for i, id := range a {
+		o := occurrences[id]
+		if o == nil {
+			o = &occurrence{}
+			occurrences[id] = o
+		}
+		o.countA++
+		o.posA = i
+	}
+	for i, id := range b {
+		if o := occurrences[id]; o != nil {
+			o.countB++
+			o.posB = i
+		}
+	}
+	// unique lines in the order of a
+	var uniqueA, uniqueB []int
+	for i, id := range a {
+		o := occurrences[id]
+		if o.countA == 1 && o.countB == 1 {
+			uniqueA = append(uniqueA, i)
+			uniqueB = append(uniqueB, o.posB)
+		}
+	}
+	if len(uniqueA) == 0 {
+		myersMatches(a, b, aOff, bOff, res)
+		return
+	}
+
+	anchors := longestIncreasing(uniqueB)
+	prevA, prevB := 0, 0
+	for _, i := range anchors {
+		ia, ib := uniqueA[i], uniqueB[i]
+		patienceMatches(a[prevA:ia], b[prevB:ib], aOff+prevA, bOff+prevB, res)
+		*res = append(*res, diffMatch{aOff + ia, bOff + ib, 1})
+		prevA, prevB = ia+1, ib+1
+	}
+	patienceMatches(a[prevA:], b[prevB:], aOff+prevA, bOff+prevB, res)
+}
+
+// longestIncreasing returns indexes of the longest increasing subsequence
+// of values, using patience sorting
+func longestIncreasing(values []int) []int {
+	// tails[i] is index of the smallest value ending an increasing
+	// subsequence of length i+1
+	var tails []int
+	prev := make([]int, len(values))
+	for i, v := range values {
+		n := sort.Search(len(tails), func(j int) bool {
+			return values[tails[j]] >= v
+		})
+		if n > 0 {
+			prev[i] = tails[n-1]
+		} else {
+			prev[i] = -1
+		}
+		if n == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[n] = i
+		}
+	}
+	res := make([]int, len(tails))
+	i := tails[len(tails)-1]
+	for n := len(res) - 1; n >= 0; n-- {
+		res[n] = i
+		i = prev[i]
+	}
+	return res
+}
+
+// histogramMatches implements histogram diff, like git: the longest run of
+// equal lines that contains the least frequent line in a is matched and
+// regions before and after it are diffed recursively
+func histogramMatches(a, b []int, aOff, bOff int, res *[]diffMatch) {
+	a, b, aOff, bOff = trimCommon(a, b, aOff, bOff, res)
+	if len(a) == 0 || len(b) == 0 {
+		return
+	}
+	positions := make(map[int][]int)
+	for i, id := range a {
+		positions[id] = append(positions[id], i)
+	}
+
+	bestA, bestB, bestN := 0, 0, 0
+	bestCount := histogramMaxChainLength + 1
+	for j := 0; j < len(b); {
+		nextJ := j + 1
+		occurrences := positions[b[j]]
+		if len(occurrences) == 0 || len(occurrences) > bestCount {
+			j = nextJ
+			continue
+		}
+		for _, i := range occurrences {
+			// extend the match in both directions
+			s, t := i, j
+			for s > 0 && t > 0 && a[s-1] == b[t-1] {
+				s--
+				t--
+			}
+			e, f := i+1, j+1
+			for e < len(a) && f < len(b) && a[e] == b[f] {
+				e++
+				f++
+			}
+			// the least frequent line within the match
+			count := len(occurrences)
+			for k := s; k < e; k++ {
+				if c := len(positions[a[k]]); c < count {
+					count = c
+				}
+			}
+			if count < bestCount || (count == bestCount && e-s > bestN) {
+				bestA, bestB, bestN = s, t, e-s
+				bestCount = count
+			}
+			if f > nextJ {
+				nextJ = f
+			}
+		}
+		j = nextJ
+	}
+	if bestN == 0 {
+		if bestCount > histogramMaxChainLength {
+			// either nothing in common or only very frequent lines
+			myersMatches(a, b, aOff, bOff, res)
+		}
+		return
+	}
+	histogramMatches(a[:bestA], b[:bestB], aOff, bOff, res)
+	*res = append(*res, diffMatch{aOff + bestA, bOff + bestB, bestN})
+	histogramMatches(a[bestA+bestN:], b[bestB+bestN:], aOff+bestA+bestN, bOff+bestB+bestN, res)
+}
+
+func matcherForAlgorithm(algorithm string) matcher {
+	switch algorithm {
+	case DiffAlgorithmPatience:
+		return patienceMatches
+	case DiffAlgorithmHistogram:
+		return histogramMatches
+	}
+	return myersMatches
+}
+
+// matchesToOps converts matching blocks to opcodes that cover all lines
+func matchesToOps(matches []diffMatch, nA, nB int) []DiffOp {
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].A < matches[j].A
+	})
+	// sentinel so that we emit changes after the last match
+	matches = append(matches, diffMatch{nA, nB, 0})
+	var res []DiffOp
+	i, j := 0, 0
+	for _, m := range matches {
+		op := ""
+		if i < m.A && j < m.B {
+			op = OpReplace
+		} else if i < m.A {
+			op = OpDelete
+		} else if j < m.B {
+			op = OpInsert
+		}
+		if op != "" {
+			res = append(res, DiffOp{op, i, m.A, j, m.B})
+		}
+		if m.N > 0 {
+			// merge adjacent matches
+			if n := len(res); n > 0 && res[n-1].Op == OpEqual && res[n-1].BeforeEnd == m.A {
+				res[n-1].BeforeEnd += m.N
+				res[n-1].AfterEnd += m.N
+			} else {
+				res = append(res, DiffOp{OpEqual, m.A, m.A + m.N, m.B, m.B + m.N})
+			}
+		}
+		i, j = m.A+m.N, m.B+m.N
+	}
+	return res
+}
+
+// diffLines returns opcodes that turn lines before into lines after
+func diffLines(before, after []string, algorithm string, normalize func(string) string) []DiffOp {
+	a, b := internLines(before, after, normalize)
+	var matches []diffMatch
+	matcherForAlgorithm(algorithm)(a, b, 0, 0, &matches)
+	return matchesToOps(matches, len(a), len(b))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// groupOps splits ops into groups of changes with up to context lines
+// around them, like get_grouped_opcodes() in Python's difflib. Negative
+// context means a single group with all lines
+func groupOps(ops []DiffOp, context int) [][]DiffOp {
+	hasChanges := false
+	for _, op := range ops {
+		if op.Op != OpEqual {
+			hasChanges = true
+		}
+	}
+	if !hasChanges {
+		return nil
+	}
+	if context < 0 {
+		return [][]DiffOp{ops}
+	}
+	ops = append([]DiffOp(nil), ops...)
+	if first := &ops[0]; first.Op == OpEqual {
+		first.BeforeStart = maxInt(first.BeforeStart, first.BeforeEnd-context)
+		first.AfterStart = maxInt(first.AfterStart, first.AfterEnd-context)
+	}
+	if last := &ops[len(ops)-1]; last.Op == OpEqual {
+		last.BeforeEnd = minInt(last.BeforeEnd, last.BeforeStart+context)
+		last.AfterEnd = minInt(last.AfterEnd, last.AfterStart+context)
+	}
+	var res [][]DiffOp
+	var group []DiffOp
+	for _, op := range ops {
+		// a long run of equal lines ends a group
+		if op.Op == OpEqual && op.BeforeEnd-op.BeforeStart > 2*context {
+			group = append(group, DiffOp{OpEqual, op.BeforeStart, minInt(op.BeforeEnd, op.BeforeStart+context), op.AfterStart, minInt(op.AfterEnd, op.AfterStart+context)})
+			res = append(res, group)
+			group = nil
+			op.BeforeStart = maxInt(op.BeforeStart, op.BeforeEnd-context)
+			op.AfterStart = maxInt(op.AfterStart, op.AfterEnd-context)
+		}
+		group = append(group, op)
+	}
+	if len(group) > 0 && !(len(group) == 1 && group[0].Op == OpEqual) {
+		res = append(res, group)
+	}
+	return res
+}
+
+// unifiedRange returns start of a range as shown in unified diff, which is
+// 1-based except for empty ranges which point at the line before
+func unifiedRange(start, end int) (int, int) {
+	n := end - start
+	if n == 0 {
+		return start, 0
+	}
+	return start + 1, n
+}
+
+func newDiffHunk(ops []DiffOp, before, after []string) *DiffHunk {
+	first, last := ops[0], ops[len(ops)-1]
+	h := &DiffHunk{Ops: ops}
+	h.BeforeStart, h.BeforeCount = unifiedRange(first.BeforeStart, last.BeforeEnd)
+	h.AfterStart, h.AfterCount = unifiedRange(first.AfterStart, last.AfterEnd)
+	for _, op := range ops {
+		if op.Op == OpEqual {
+			for i := 0; i < op.BeforeEnd-op.BeforeStart; i++ {
+				l := &DiffLine{Op: OpEqual, BeforeLine: op.BeforeStart + i + 1, AfterLine: op.AfterStart + i + 1, Text: before[op.BeforeStart+i]}
+				h.Lines = append(h.Lines, l)
+			}
+			continue
+		}
+		var deleted []*DiffLine
+		for i := op.BeforeStart; i < op.BeforeEnd; i++ {
+			deleted = append(deleted, &DiffLine{Op: OpDelete, BeforeLine: i + 1, Text: before[i]})
+		}
+		h.Lines = append(h.Lines, deleted...)
+		for i := op.AfterStart; i < op.AfterEnd; i++ {
+			l := &DiffLine{Op: OpInsert, AfterLine: i + 1, Text: after[i]}
+			if n := i - op.AfterStart; n < len(deleted) {
+				addIntraLineSpans(deleted[n], l)
+			}
+			h.Lines = append(h.Lines, l)
+		}
+	}
+	return h
+}
+
+// sideBySideRow is a row of a side-by-side diff. Op is "equal", "delete",
+// "insert" or "replace" if a deleted line is shown next to an inserted one,
+// or "skip" for lines omitted between hunks (Before and After are nil)
+type sideBySideRow struct {
+	Op     string
+	Before *DiffLine
+	After  *DiffLine
+}
+
+// sideBySideRows lays out lines of hunks side by side. Like in the web ui,
+// deleted and inserted lines next to each other are shown in the same rows
+func sideBySideRows(hunks []*DiffHunk) []*sideBySideRow {
+	var res []*sideBySideRow
+	var deleted, inserted []*DiffLine
+	flush := func() {
+		for i := 0; i < len(deleted) || i < len(inserted); i++ {
+			row := &sideBySideRow{}
+			if i < len(deleted) {
+				row.Op, row.Before = OpDelete, deleted[i]
+			}
+			if i < len(inserted) {
+				row.Op, row.After = OpInsert, inserted[i]
+			}
+			if row.Before != nil && row.After != nil {
+				row.Op = OpReplace
+			}
+			res = append(res, row)
+		}
+		deleted, inserted = nil, nil
+	}
+	for i, h := range hunks {
+		if i > 0 || h.BeforeStart > 1 || h.AfterStart > 1 {
+			res = append(res, &sideBySideRow{Op: "skip"})
+		}
+		for _, l := range h.Lines {
+			switch l.Op {
+			case OpDelete:
+				if len(inserted) > 0 {
+					flush()
+				}
+				deleted = append(deleted, l)
+			case OpInsert:
+				inserted = append(inserted, l)
+			default:
+				flush()
+				res = append(res, &sideBySideRow{Op: OpEqual, Before: l, After: l})
+			}
+		}
+		flush()
+	}
+	return res
+}
+
+// diffOptions tell how to compute a diff
+type diffOptions struct {
+	Algorithm string
+	// number of lines around changes, negative for all lines
+	Context int
+	whitespaceOptions
+}
+
+// computeDiff diffs contents of 2 files and groups changes into hunks
+func computeDiff(before, after []byte, opts diffOptions) *DiffResponse {
+	linesBefore := splitLines(before)
+	linesAfter := splitLines(after)
+	keysBefore := opts.lineKeys(before, linesBefore)
+	keysAfter := opts.lineKeys(after, linesAfter)
+	ops := diffLines(keysBefore, keysAfter, opts.Algorithm, nil)
+	res := &DiffResponse{
+		Algorithm:         opts.Algorithm,
+		Context:           opts.Context,
+		whitespaceOptions: opts.whitespaceOptions,
+		BeforeLines:       len(linesBefore),
+		AfterLines:        len(linesAfter),
+		Hunks:             []*DiffHunk{},
+	}
+	for _, group := range groupOps(ops, opts.Context) {
+		if opts.IgnoreBlankLines && isBlankOnlyGroup(group, linesBefore, linesAfter) {
+			continue
+		}
+		res.Hunks = append(res.Hunks, newDiffHunk(group, linesBefore, linesAfter))
+	}
+	return res
+}
+
+// diffOptionsFromRequest returns diff options from optional "algorithm",
+// "context" and whitespace arguments, with defaults set by flags
+func diffOptionsFromRequest(r *http.Request) (diffOptions, error) {
+	opts := diffOptions{
+		Algorithm: r.FormValue("algorithm"),
+		Context:   diffContext,
+	}
+	if opts.Algorithm == "" {
+		opts.Algorithm = diffAlgorithm
+	}
+	if !isValidDiffAlgorithm(opts.Algorithm) {
+		return opts, fmt.Errorf("invalid algorithm '%s'", opts.Algorithm)
+	}
+	context := r.FormValue("context")
+	if context == "all" {
+		opts.Context = -1
+	} else if context != "" {
+		var err error
+		if opts.Context, err = strconv.Atoi(context); err != nil || opts.Context < 0 {
+			return opts, fmt.Errorf("invalid context '%s'", context)
+		}
+	}
+	var err error
+	opts.whitespaceOptions, err = whitespaceOptionsFromRequest(r)
+	return opts, err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// frobnitz is the well-known example of a moved function where patience
+// and histogram diffs are more readable than Myers
+var (
+	frobnitzBefore = []string{
+		"#include <stdio.h>",
+		"",
+		"int fib(int n)",
+		"{",
+		"    if (n > 2)",
+		"    {",
+		"        return fib(n - 1) + fib(n - 2);",
+		"    }",
+		"    return 1;",
+		"}",
+		"",
+		"// Frobs foo heartily",
+		"int frobnitz(int foo)",
+		"{",
+		"    int i;",
+		"    for(i = 0; i < 10; i++)",
+		"    {",
+		`        printf("Your answer is: ");`,
+		`        printf("%d\n", foo);`,
+		"    }",
+		"}",
+	}
+	frobnitzAfter = []string{
+		"#include <stdio.h>",
+		"",
+		"// Frobs foo heartily",
+		"int frobnitz(int foo)",
+		"{",
+		"    int i;",
+		"    for(i = 0; i < 10; i++)",
+		"    {",
+		`        printf("%d\n", foo);`,
+		"    }",
+		"}",
+		"",
+		"int fib(int n)",
+		"{",
+		"    if (n > 2)",
+		"    {",
+		"        return fib(n - 1) + fib(n - 2);",
+		"    }",
+		"    return 1;",
+		"}",
+	}
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name          string
+		algorithm     string
+		before, after []string
+		exp           []DiffOp
+	}{
+		{"empty", DiffAlgorithmMyers, nil, nil, nil},
+		{"added", DiffAlgorithmMyers, nil, strings.Fields("a b"), []DiffOp{{OpInsert, 0, 0, 0, 2}}},
+		{"deleted", DiffAlgorithmPatience, strings.Fields("a b"), nil, []DiffOp{{OpDelete, 0, 2, 0, 0}}},
+		{"equal", DiffAlgorithmHistogram, strings.Fields("a b"), strings.Fields("a b"), []DiffOp{{OpEqual, 0, 2, 0, 2}}},
+		{
+			"replaced", DiffAlgorithmMyers, strings.Fields("a b c d e f"), strings.Fields("a x c d y f"),
+			[]DiffOp{{OpEqual, 0, 1, 0, 1}, {OpReplace, 1, 2, 1, 2}, {OpEqual, 2, 4, 2, 4}, {OpReplace, 4, 5, 4, 5}, {OpEqual, 5, 6, 5, 6}},
+		},
+		{
+			// the example from Myers' paper, 5 edits
+			"myers", DiffAlgorithmMyers, strings.Fields("a b c a b b a"), strings.Fields("c b a b a c"),
+			[]DiffOp{{OpReplace, 0, 1, 0, 1}, {OpEqual, 1, 2, 1, 2}, {OpDelete, 2, 3, 2, 2}, {OpEqual, 3, 5, 2, 4}, {OpDelete, 5, 6, 4, 4}, {OpEqual, 6, 7, 4, 5}, {OpInsert, 7, 7, 5, 6}},
+		},
+		{
+			// no line is unique in both so it's the same as Myers
+			"patience without unique lines", DiffAlgorithmPatience, strings.Fields("a b c a b b a"), strings.Fields("c b a b a c"),
+			[]DiffOp{{OpReplace, 0, 1, 0, 1}, {OpEqual, 1, 2, 1, 2}, {OpDelete, 2, 3, 2, 2}, {OpEqual, 3, 5, 2, 4}, {OpDelete, 5, 6, 4, 4}, {OpEqual, 6, 7, 4, 5}, {OpInsert, 7, 7, 5, 6}},
+		},
+		{
+			// same as git diff --histogram, which matches the rarest line c
+			"histogram", DiffAlgorithmHistogram, strings.Fields("a b c a b b a"), strings.Fields("c b a b a c"),
+			[]DiffOp{{OpDelete, 0, 2, 0, 0}, {OpEqual, 2, 3, 0, 1}, {OpDelete, 3, 5, 1, 1}, {OpEqual, 5, 7, 1, 3}, {OpInsert, 7, 7, 3, 6}},
+		},
+		{
+			"patience", DiffAlgorithmPatience, frobnitzBefore, frobnitzAfter,
+			[]DiffOp{{OpEqual, 0, 2, 0, 2}, {OpDelete, 2, 11, 2, 2}, {OpEqual, 11, 17, 2, 8}, {OpDelete, 17, 18, 8, 8}, {OpEqual, 18, 20, 8, 10}, {OpInsert, 20, 20, 10, 19}, {OpEqual, 20, 21, 19, 20}},
+		},
+		{
+			"histogram moved function", DiffAlgorithmHistogram, frobnitzBefore, frobnitzAfter,
+			[]DiffOp{{OpEqual, 0, 2, 0, 2}, {OpInsert, 2, 2, 2, 12}, {OpEqual, 2, 9, 12, 19}, {OpDelete, 9, 20, 19, 19}, {OpEqual, 20, 21, 19, 20}},
+		},
+	}
+	for _, test := range tests {
+		got := diffLines(test.before, test.after, test.algorithm, nil)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: got\n%v\nexpected\n%v", test.name, got, test.exp)
+		}
+	}
+}
+
+// checkOps returns an error if ops don't turn before into after
+func checkOps(ops []DiffOp, before, after []string) error {
+	i, j := 0, 0
+	var res []string
+	for _, op := range ops {
+		if op.BeforeStart != i || op.AfterStart != j {
+			return fmt.Errorf("%v doesn't start at %d, %d", op, i, j)
+		}
+		if op.Op == OpEqual && !reflect.DeepEqual(before[op.BeforeStart:op.BeforeEnd], after[op.AfterStart:op.AfterEnd]) {
+			return fmt.Errorf("%v isn't equal", op)
+		}
+		res = append(res, after[op.AfterStart:op.AfterEnd]...)
+		i, j = op.BeforeEnd, op.AfterEnd
+	}
+	if i != len(before) || j != len(after) {
+		return fmt.Errorf("ops end at %d, %d", i, j)
+	}
+	if strings.Join(res, "\n") != strings.Join(after, "\n") {
+		return fmt.Errorf("ops don't produce after")
+	}
+	return nil
+}
+
+func TestDiffLinesRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		var res []string
+		for n := rnd.Intn(30); n > 0; n-- {
+			res = append(res, string(rune('a'+rnd.Intn(5))))
+		}
+		return res
+	}
+	for i := 0; i < 300; i++ {
+		before, after := randomLines(), randomLines()
+		for _, algorithm := range []string{DiffAlgorithmMyers, DiffAlgorithmPatience, DiffAlgorithmHistogram} {
+			ops := diffLines(before, after, algorithm, nil)
+			if err := checkOps(ops, before, after); err != nil {
+				t.Fatalf("%s of %q and %q: %s\n%v", algorithm, before, after, err, ops)
+			}
+		}
+	}
+}
+
+func TestComputeDiffContext(t *testing.T) {
+	// lines l1 to l30 with l5 replaced, l20 deleted and a line inserted
+	// after l25
+	var before, after []string
+	for i := 1; i <= 30; i++ {
+		l := fmt.Sprintf("l%d", i)
+		before = append(before, l)
+		switch i {
+		case 5:
+			after = append(after, "x5")
+		case 20:
+		case 25:
+			after = append(after, l, "y")
+		default:
+			after = append(after, l)
+		}
+	}
+	tests := []struct {
+		context int
+		// unified diff ranges of hunks
+		exp []string
+	}{
+		{0, []string{"-5,1 +5,1", "-20,1 +19,0", "-25,0 +25,1"}},
+		{3, []string{"-2,7 +2,7", "-17,12 +17,12"}},
+		{10, []string{"-1,30 +1,30"}},
+		{-1, []string{"-1,30 +1,30"}},
+	}
+	for _, algorithm := range []string{DiffAlgorithmMyers, DiffAlgorithmPatience, DiffAlgorithmHistogram} {
+		for _, test := range tests {
+			opts := diffOptions{Algorithm: algorithm, Context: test.context}
+			res := computeDiff([]byte(strings.Join(before, "\n")+"\n"), []byte(strings.Join(after, "\n")+"\n"), opts)
+			var got []string
+			for _, h := range res.Hunks {
+				got = append(got, fmt.Sprintf("-%d,%d +%d,%d", h.BeforeStart, h.BeforeCount, h.AfterStart, h.AfterCount))
+			}
+			if !reflect.DeepEqual(got, test.exp) {
+				t.Errorf("%s, context %d: got %v, expected %v", algorithm, test.context, got, test.exp)
+			}
+		}
+	}
+
+	res := computeDiff([]byte(strings.Join(before, "\n")), []byte(strings.Join(after, "\n")), diffOptions{Algorithm: DiffAlgorithmMyers, Context: -1})
+	if n := len(res.Hunks[0].Lines); n != 32 {
+		t.Errorf("all lines: got %d lines, expected 32", n)
+	}
+	if res.BeforeLines != 30 || res.AfterLines != 30 {
+		t.Errorf("got %d, %d lines, expected 30, 30", res.BeforeLines, res.AfterLines)
+	}
+}
+
+func TestComputeDiffIntraLine(t *testing.T) {
+	res := computeDiff([]byte("a\nfoo(1, 2)\nb\n"), []byte("a\nfoo(1, 3)\nb\n"), diffOptions{Algorithm: DiffAlgorithmMyers, Context: 1})
+	if len(res.Hunks) != 1 {
+		t.Fatalf("got %d hunks", len(res.Hunks))
+	}
+	lines := res.Hunks[0].Lines
+	if len(lines) != 4 || lines[1].Op != OpDelete || lines[2].Op != OpInsert {
+		t.Fatalf("unexpected lines %v", lines)
+	}
+	if exp := []DiffSpan{{OpDelete, 7, 8}}; !reflect.DeepEqual(lines[1].WordSpans, exp) {
+		t.Errorf("got %v, expected %v", lines[1].WordSpans, exp)
+	}
+	if exp := []DiffSpan{{OpInsert, 7, 8}}; !reflect.DeepEqual(lines[2].WordSpans, exp) {
+		t.Errorf("got %v, expected %v", lines[2].WordSpans, exp)
+	}
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
 )
 
 func dirExists(path string) bool {
@@ -16,36 +20,95 @@ func dirExists(path string) bool {
 	return st.IsDir()
 }
 
+var (
+	// number of goroutines that walk and compare directories
+	dirDiffWorkers = runtime.NumCPU()
+	// if true, files with the same size and modification time are
+	// considered equal without reading them
+	fastDirCompare = false
+	// compared directories, only set when comparing directories
+	dirRootBefore string
+	dirRootAfter  string
+)
+
 // FileInfo describes a file
 type FileInfo struct {
-	Path string
-	Size int64
+	Path    string
+	Size    int64
+	ModTime time.Time
 }
 
-func getFilesRecur(dir string) ([]FileInfo, error) {
-	var res []FileInfo
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.Mode().IsRegular() {
-			return nil
+// dirWalker collects files in a directory, reading sub-directories in
+// parallel. sem limits the number of goroutines
+type dirWalker struct {
+	root   string
+	filter *dirFilter
+	sem    chan struct{}
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	files []FileInfo
+	err   error
+}
+
+func (w *dirWalker) walk(relDir string) {
+	fis, err := ioutil.ReadDir(filepath.Join(w.root, relDir))
+	if err != nil {
+		w.mu.Lock()
+		if w.err == nil {
+			w.err = err
 		}
-		if strings.HasPrefix(path, dir) {
-			path = path[len(dir):]
-			if strings.HasPrefix(path, "/") {
-				path = path[1:]
+		w.mu.Unlock()
+		return
+	}
+	var files []FileInfo
+	for _, fi := range fis {
+		relPath := filepath.Join(relDir, fi.Name())
+		if fi.IsDir() {
+			if w.filter.SkipDir(relPath) {
+				LogVerbosef("skipping directory '%s'\n", relPath)
+				continue
+			}
+			w.wg.Add(1)
+			select {
+			case w.sem <- struct{}{}:
+				go func() {
+					w.walk(relPath)
+					<-w.sem
+					w.wg.Done()
+				}()
+			default:
+				// all workers are busy
+				w.walk(relPath)
+				w.wg.Done()
 			}
+			continue
 		}
-		fi := FileInfo{
-			Path: path,
-			Size: info.Size(),
+		if !fi.Mode().IsRegular() || w.filter.SkipFile(relPath) {
+			continue
 		}
-		res = append(res, fi)
-		return nil
-	})
+		files = append(files, FileInfo{
+			Path:    relPath,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+	w.mu.Lock()
+	w.files = append(w.files, files...)
+	w.mu.Unlock()
+}
 
-	return res, err
+// getFilesRecur returns files in dir, skipping those excluded by filter
+func getFilesRecur(dir string, filter *dirFilter, sem chan struct{}) ([]FileInfo, error) {
+	w := &dirWalker{
+		root:   dir,
+		filter: filter,
+		sem:    sem,
+	}
+	filter.SkipDir("")
+	w.walk("")
+	w.wg.Wait()
+	return w.files, w.err
 }
 
 // returnn true if files are equal
@@ -86,53 +149,111 @@ func filesEqual(path1, path2 string) (bool, error) {
 	}
 }
 
-func fileInfosToMap(fileInfos []FileInfo) map[string]int64 {
-	res := make(map[string]int64)
+func fileInfosToMap(fileInfos []FileInfo) map[string]FileInfo {
+	res := make(map[string]FileInfo)
 	for _, fi := range fileInfos {
-		res[fi.Path] = fi.Size
+		res[fi.Path] = fi
+	}
+	return res
+}
+
+// sameContent returns true if files with the same size have the same content
+func sameContent(pathBefore, pathAfter string, fiBefore, fiAfter FileInfo) (bool, error) {
+	if fastDirCompare && fiBefore.ModTime.Equal(fiAfter.ModTime) {
+		return true, nil
+	}
+	if hashCache == nil {
+		return filesEqual(pathBefore, pathAfter)
+	}
+	hashBefore, err := hashCache.fileHash(pathBefore, fiBefore)
+	if err != nil {
+		return false, err
+	}
+	hashAfter, err := hashCache.fileHash(pathAfter, fiAfter)
+	if err != nil {
+		return false, err
+	}
+	return hashBefore == hashAfter, nil
+}
+
+// changedFiles returns paths of files with the same size in both directories
+// whose content differs. Files are compared by dirDiffWorkers goroutines
+func changedFiles(rootBefore, rootAfter string, filesBefore, filesAfter map[string]FileInfo, paths []string) (map[string]bool, error) {
+	res := make(map[string]bool)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+	for i := 0; i < dirDiffWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				fullPathBefore := filepath.Join(rootBefore, path)
+				fullPathAfter := filepath.Join(rootAfter, path)
+				same, err := sameContent(fullPathBefore, fullPathAfter, filesBefore[path], filesAfter[path])
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if !same {
+					res[path] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, path := range paths {
+		jobs <- path
 	}
+	close(jobs)
+	wg.Wait()
+	return res, firstErr
+}
+
+func sortedPaths(files map[string]FileInfo) []string {
+	var res []string
+	for path := range files {
+		res = append(res, path)
+	}
+	sort.Strings(res)
 	return res
 }
 
-func calcDirDiffs(rootBefore, rootAfter string, filesBefore, filesAfter map[string]int64) ([]*GitChange, error) {
+func calcDirDiffs(rootBefore, rootAfter string, filesBefore, filesAfter map[string]FileInfo) ([]*GitChange, error) {
+	var sameSize []string
+	for path, fiBefore := range filesBefore {
+		if fiAfter, exists := filesAfter[path]; exists && fiBefore.Size == fiAfter.Size {
+			sameSize = append(sameSize, path)
+		}
+	}
+	changed, err := changedFiles(rootBefore, rootAfter, filesBefore, filesAfter, sameSize)
+	if err != nil {
+		return nil, err
+	}
+
 	var res []*GitChange
-	for pathBefore, sizeBefore := range filesBefore {
+	for _, pathBefore := range sortedPaths(filesBefore) {
 		fullPathBefore := filepath.Join(rootBefore, pathBefore)
 		fullPathAfter := filepath.Join(rootAfter, pathBefore)
 		var e GitChange
-		sizeAfter, exists := filesAfter[pathBefore]
+		fiAfter, exists := filesAfter[pathBefore]
 		if !exists {
 			e.PathBefore = fullPathBefore
 			e.Type = Deleted
 			res = append(res, &e)
-		} else {
-			if sizeBefore != sizeAfter {
-				e.PathBefore = fullPathBefore
-				e.PathAfter = fullPathAfter
-				e.Type = Modified
-				res = append(res, &e)
-			} else {
-				areEqual, err := filesEqual(fullPathBefore, fullPathAfter)
-				if err != nil {
-					return nil, err
-				}
-				if !areEqual {
-					e.PathBefore = fullPathBefore
-					e.PathAfter = fullPathAfter
-					res = append(res, &e)
-				}
-			}
+		} else if filesBefore[pathBefore].Size != fiAfter.Size || changed[pathBefore] {
+			e.PathBefore = fullPathBefore
+			e.PathAfter = fullPathAfter
+			e.Type = Modified
+			res = append(res, &e)
 		}
 	}
 
-	var pathsAfter []string
-	for pathAfter := range filesAfter {
-		if _, exists := filesBefore[pathAfter]; !exists {
-			pathsAfter = append(pathsAfter, pathAfter)
+	for _, pathAfter := range sortedPaths(filesAfter) {
+		if _, exists := filesBefore[pathAfter]; exists {
+			continue
 		}
-	}
-
-	for _, pathAfter := range pathsAfter {
 		fullPathAfter := filepath.Join(rootAfter, pathAfter)
 		e := GitChange{
 			PathBefore: "",
@@ -146,17 +267,42 @@ func calcDirDiffs(rootBefore, rootAfter string, filesBefore, filesAfter map[stri
 }
 
 func dirDiff(pathBefore, pathAfter string) ([]*GitChange, error) {
-	filesBefore, err := getFilesRecur(pathBefore)
-	if err != nil {
-		return nil, err
+	filter := newDirFilter(pathBefore, pathAfter)
+	sem := make(chan struct{}, dirDiffWorkers)
+	var filesBefore, filesAfter []FileInfo
+	var errBefore, errAfter error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		filesBefore, errBefore = getFilesRecur(pathBefore, filter, sem)
+		wg.Done()
+	}()
+	filesAfter, errAfter = getFilesRecur(pathAfter, filter, sem)
+	wg.Wait()
+	if errBefore != nil {
+		return nil, errBefore
 	}
-	filesAfter, err := getFilesRecur(pathAfter)
-	if err != nil {
-		return nil, err
+	if errAfter != nil {
+		return nil, errAfter
 	}
 
 	filesBeforeMap := fileInfosToMap(filesBefore)
 	filesAfterMap := fileInfosToMap(filesAfter)
 
-	return calcDirDiffs(pathBefore, pathAfter, filesBeforeMap, filesAfterMap)
+	changes, err := calcDirDiffs(pathBefore, pathAfter, filesBeforeMap, filesAfterMap)
+	if err != nil {
+		return nil, err
+	}
+	changes, err = detectRenames(changes, pathBefore, pathAfter, filesBeforeMap, filesAfterMap)
+	// after detecting renames, which also hashes files
+	if hashCache != nil {
+		filesInRoots := map[string]map[string]FileInfo{
+			pathBefore: filesBeforeMap,
+			pathAfter:  filesAfterMap,
+		}
+		if err := hashCache.save(filesInRoots); err != nil {
+			LogErrorf("hashCache.save() failed with '%s'\n", err)
+		}
+	}
+	return changes, err
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// set with -export flag: html file to write a report to
+	flgExport string
+
+	cssURLRx = regexp.MustCompile(`url\(\s*['"]?(/static/[^'")]+)['"]?\s*\)`)
+)
+
+// exportRow is a row of a side-by-side diff in an exported report. Op is
+// "equal", "delete", "insert", "replace" or "skip" for omitted lines
+type exportRow struct {
+	Op         string
+	BeforeLine int
+	AfterLine  int
+	Before     template.HTML
+	After      template.HTML
+	HasBefore  bool
+	HasAfter   bool
+}
+
+// exportFile is a change in an exported report
+type exportFile struct {
+	Index      int
+	NameBefore string
+	NameAfter  string
+	Type       string
+	// shown instead of a diff, e.g. if files are identical
+	Message     string
+	IsImage     bool
+	ImageBefore template.URL
+	ImageAfter  template.URL
+	Rows        []*exportRow
+}
+
+type exportModel struct {
+	Created time.Time
+	CSS     template.CSS
+	Files   []*exportFile
+}
+
+func dataURI(path string, d []byte) template.URL {
+	mime := MimeTypeByExtensionExt(path)
+	return template.URL("data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(d))
+}
+
+// inlineCSSURLs replaces urls of our resources in css with data uris, so
+// that css doesn't need the server
+func inlineCSSURLs(css []byte) []byte {
+	return cssURLRx.ReplaceAllFunc(css, func(m []byte) []byte {
+		path := string(cssURLRx.FindSubmatch(m)[1])
+		d, err := readResource("www" + path)
+		if err != nil {
+			LogErrorf("not inlining '%s' in css: %s\n", path, err)
+			return m
+		}
+		return []byte("url(" + string(dataURI(path, d)) + ")")
+	})
+}
+
+// highlightSpans returns html of a line where changed parts are wrapped in
+// <span class="${class}">
+func highlightSpans(s string, spans []DiffSpan, class string) template.HTML {
+	var buf bytes.Buffer
+	pos := 0 // in runes
+	for _, span := range spans {
+		for pos < span.Start && len(s) > 0 {
+			_, n := utf8.DecodeRuneInString(s)
+			buf.WriteString(template.HTMLEscapeString(s[:n]))
+			s = s[n:]
+			pos++
+		}
+		var changed string
+		for pos < span.End && len(s) > 0 {
+			_, n := utf8.DecodeRuneInString(s)
+			changed += s[:n]
+			s = s[n:]
+			pos++
+		}
+		buf.WriteString(`<span class="` + class + `">` + template.HTMLEscapeString(changed) + `</span>`)
+	}
+	buf.WriteString(template.HTMLEscapeString(s))
+	return template.HTML(buf.String())
+}
+
+// exportRows returns html of side-by-side rows of hunks
+func exportRows(hunks []*DiffHunk) []*exportRow {
+	var res []*exportRow
+	for _, r := range sideBySideRows(hunks) {
+		row := &exportRow{Op: r.Op}
+		if l := r.Before; l != nil {
+			row.BeforeLine, row.HasBefore = l.BeforeLine, true
+			if r.Op == OpEqual {
+				row.Before = template.HTML(template.HTMLEscapeString(l.Text))
+			} else {
+				row.Before = highlightSpans(l.Text, l.WordSpans, "char-delete")
+			}
+		}
+		if l := r.After; l != nil {
+			row.AfterLine, row.HasAfter = l.AfterLine, true
+			if r.Op == OpEqual {
+				row.After = template.HTML(template.HTMLEscapeString(l.Text))
+			} else {
+				row.After = highlightSpans(l.Text, l.WordSpans, "char-insert")
+			}
+		}
+		res = append(res, row)
+	}
+	return res
+}
+
+func newExportFile(s *Session, gc *Change) (*exportFile, error) {
+	tr, fc, err := s.loadContents(gc)
+	if err != nil {
+		return nil, err
+	}
+	res := &exportFile{Index: tr.Index, Type: tr.Type}
+	res.NameBefore, res.NameAfter = s.changeNames(&gc.GitChange)
+	switch {
+	case tr.NoChanges:
+		res.Message = "File content is identical"
+	case tr.IsImage:
+		res.IsImage = true
+		if tr.BeforePath != nil {
+			res.ImageBefore = dataURI(*tr.BeforePath, fc.before)
+		}
+		if tr.AfterPath != nil {
+			res.ImageAfter = dataURI(*tr.AfterPath, fc.after)
+		}
+	default:
+		opts := diffOptions{Algorithm: diffAlgorithm, Context: diffContext, whitespaceOptions: defaultWhitespaceOptions}
+		diff := computeDiff(fc.before, fc.after, opts)
+		if len(diff.Hunks) == 0 {
+			res.Message = "No changed lines, only ignored whitespace or the newline at end of file differ"
+		}
+		res.Rows = exportRows(diff.Hunks)
+	}
+	return res, nil
+}
+
+// writeExport writes all changes to a single html file that can be viewed
+// without the server: css and images are inlined
+func writeExport(s *Session, path string) error {
+	changes := s.getChanges()
+
+	model := exportModel{Created: time.Now()}
+	css, err := readResource("www/static/dist/main.css")
+	if err != nil {
+		// only happens in dev mode if css wasn't built
+		LogErrorf("exporting without main.css: %s\n", err)
+	}
+	model.CSS = template.CSS(inlineCSSURLs(css))
+	for _, gc := range changes {
+		f, err := newExportFile(s, gc)
+		if err != nil {
+			return err
+		}
+		model.Files = append(model.Files, f)
+	}
+
+	var buf bytes.Buffer
+	if err := getTemplates().ExecuteTemplate(&buf, tmplExport, model); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// exportAndExit implements -export
+func exportAndExit(s *Session) {
+	err := writeExport(s, flgExport)
+	fataliferr(err)
+	fmt.Printf("Wrote %d changes to %s\n", len(s.getChanges()), flgExport)
+	os.Exit(0)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -13,18 +14,50 @@ const (
 	Deleted
 	Renamed
 	NotCheckedIn
+	Copied
+	Unmerged
 )
 
 var (
 	// must match enums above
-	gitTypeNames = []string{"Modified", "Added", "Deleted", "Renamed", "NotCheckedIn"}
+	gitTypeNames = []string{"Modified", "Added", "Deleted", "Renamed", "NotCheckedIn", "Copied", "Unmerged"}
 )
 
+const (
+	// revision denoting the file in the working tree, as opposed to a commit
+	revWorkTree = ""
+	// revision denoting the file staged in the index
+	revIndex = ":"
+	revHead  = "HEAD"
+	// revisions denoting stages of an unmerged file in the index
+	revStageBase   = ":1"
+	revStageOurs   = ":2"
+	revStageTheirs = ":3"
+)
+
+const (
+	// staged changes are index vs. HEAD
+	viewStaged = "staged"
+	// unstaged changes are working tree vs. index
+	viewUnstaged = "unstaged"
+)
+
+// file mode git uses when a file doesn't exist on one side of a change
+const gitModeNone = "000000"
+
 // FileChange describes
 type GitChange struct {
 	PathBefore string
-	PathAfter  string // only for Renamed
+	PathAfter  string // only for Renamed and Copied
 	Type       int    // Modified, Added etc.
+	// git file modes like "100644", if known
+	ModeBefore string
+	ModeAfter  string
+	// revisions from which we get content of PathBefore and PathAfter
+	RevBefore string
+	RevAfter  string
+	// viewStaged or viewUnstaged for changes in the working tree
+	View string
 }
 
 // GetPath() returns first valid path
@@ -49,7 +82,7 @@ func gitTypeToString(n int) string {
 
 func catGitHeadToFileMust(dst, gitPath string) {
 	LogVerbosef("catGitHeadToFileMust: %s => %s\n", gitPath, dst)
-	d := gitGetFileContentHeadMust(gitPath)
+	d := gitGetFileContentMust("", revHead, gitPath)
 	f, err := os.Create(dst)
 	fataliferr(err)
 	defer f.Close()
@@ -57,58 +90,262 @@ func catGitHeadToFileMust(dst, gitPath string) {
 	fataliferr(err)
 }
 
-func parseGitStatusLineMust(s string) *GitChange {
-	c := &GitChange{}
-	parts := strings.SplitN(s, " ", 2)
-	fatalif(len(parts) != 2, "invalid line: '%s'\n", s)
-	switch parts[0] {
-	case "M":
-		c.Type = Modified
-	case "A":
-		c.Type = Added
-	case "D":
-		c.Type = Deleted
-	case "??":
-		c.Type = NotCheckedIn
-	case "R":
-		c.Type = Renamed
-		// www/static/js/file_diff.js -> js/file_diff.js
-		parts = strings.SplitN(parts[1], " -> ", 2)
-		fatalif(len(parts) != 2, "invalid line: '%s'\n", s)
-		c.PathBefore = strings.TrimSpace(parts[0])
-		c.PathAfter = strings.TrimSpace(parts[1])
-		return c
+// for a given status code in git status output, returns change type and true
+// or false if the code means there is no change
+func gitStatusCodeToType(code byte) (int, bool) {
+	switch code {
+	case 'M', 'T':
+		return Modified, true
+	case 'A':
+		return Added, true
+	case 'D':
+		return Deleted, true
+	case 'R':
+		return Renamed, true
+	case 'C':
+		return Copied, true
+	}
+	return 0, false
+}
+
+func newGitChange(typ int, pathBefore, pathAfter string) *GitChange {
+	c := &GitChange{
+		Type: typ,
+	}
+	switch typ {
+	case Added, NotCheckedIn:
+		c.PathAfter = pathAfter
+	case Renamed, Copied:
+		c.PathBefore = pathBefore
+		c.PathAfter = pathAfter
 	default:
-		fatalif(true, "invalid line: '%s'\n", s)
+		c.PathBefore = pathAfter
 	}
-	c.PathBefore = strings.TrimSpace(parts[1])
 	return c
 }
 
-func parseGitStatusMust(out []byte, includeNotCheckedIn bool) []*GitChange {
+func newGitStatusChange(typ int, pathBefore, pathAfter, revBefore, revAfter, modeBefore, modeAfter, view string) *GitChange {
+	c := newGitChange(typ, pathBefore, pathAfter)
+	c.RevBefore = revBefore
+	c.RevAfter = revAfter
+	c.ModeBefore = modeBefore
+	c.ModeAfter = modeAfter
+	c.View = view
+	return c
+}
+
+// splitNul splits output of git commands run with -z
+func splitNul(d []byte) []string {
+	s := strings.TrimSuffix(string(d), "\x00")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\x00")
+}
+
+// parseGitStatusEntry parses a single entry of git status --porcelain=v2 -z
+// output. Entries for renames and copies are followed by the original path,
+// which is why we get all the records and return how many were consumed.
+// See https://git-scm.com/docs/git-status#_porcelain_format_version_2
+// Ordinary changes are:
+// 1 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <path>
+// Renames and copies are:
+// 2 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <X><score> <path><NUL><origPath>
+// Unmerged files are:
+// u <XY> <sub> <m1> <m2> <m3> <mW> <h1> <h2> <h3> <path>
+// Untracked and ignored files are:
+// ? <path>
+// ! <path>
+// XY is the status of index vs. HEAD and working tree vs. index, so a single
+// entry describes up to 2 changes: staged and unstaged.
+func parseGitStatusEntry(records []string) ([]*GitChange, int, error) {
+	rec := records[0]
+	if len(rec) < 2 {
+		return nil, 1, fmt.Errorf("invalid git status entry: %q", rec)
+	}
+	switch rec[0] {
+	case '#', '!':
+		// header or ignored file
+		return nil, 1, nil
+	case '?':
+		c := newGitStatusChange(NotCheckedIn, "", rec[2:], revHead, revWorkTree, gitModeNone, "", viewUnstaged)
+		return []*GitChange{c}, 1, nil
+	case 'u':
+		parts := strings.SplitN(rec, " ", 11)
+		if len(parts) != 11 {
+			return nil, 1, fmt.Errorf("invalid git status entry: %q", rec)
+		}
+		c := newGitStatusChange(Unmerged, "", parts[10], revIndex, revWorkTree, parts[4], parts[6], viewUnstaged)
+		return []*GitChange{c}, 1, nil
+	case '1', '2':
+		// handled below
+	default:
+		return nil, 1, fmt.Errorf("unknown git status entry: %q", rec)
+	}
+
+	n := 1
+	nFields := 9
+	if rec[0] == '2' {
+		n = 2
+		nFields = 10
+	}
+	parts := strings.SplitN(rec, " ", nFields)
+	if len(parts) != nFields || len(parts[1]) != 2 {
+		return nil, 1, fmt.Errorf("invalid git status entry: %q", rec)
+	}
+	if n > len(records) {
+		return nil, 1, fmt.Errorf("missing original path in git status entry: %q", rec)
+	}
+	x, y := parts[1][0], parts[1][1]
+	modeHead, modeIndex, modeWorkTree := parts[3], parts[4], parts[5]
+	path := parts[nFields-1]
+	pathBefore := path
+	if n == 2 {
+		pathBefore = records[1]
+	}
+
+	var res []*GitChange
+	if typ, ok := gitStatusCodeToType(x); ok {
+		res = append(res, newGitStatusChange(typ, pathBefore, path, revHead, revIndex, modeHead, modeIndex, viewStaged))
+	}
+	if typ, ok := gitStatusCodeToType(y); ok {
+		res = append(res, newGitStatusChange(typ, path, path, revIndex, revWorkTree, modeIndex, modeWorkTree, viewUnstaged))
+	}
+	return res, n, nil
+}
+
+func parseGitStatus(out []byte) ([]*GitChange, error) {
 	var res []*GitChange
-	lines := toTrimmedLines(out)
-	for _, l := range lines {
-		c := parseGitStatusLineMust(l)
-		if !includeNotCheckedIn && c.Type == NotCheckedIn {
-			continue
+	records := splitNul(out)
+	for len(records) > 0 {
+		changes, n, err := parseGitStatusEntry(records)
+		if err != nil {
+			return nil, err
 		}
+		res = append(res, changes...)
+		records = records[n:]
+	}
+	return res, nil
+}
+
+// gitStatus returns staged and unstaged changes in the working tree of
+// repository in dir ("" for the current directory). view is viewStaged,
+// viewUnstaged or "" for both
+func gitStatus(dir, view string) ([]*GitChange, error) {
+	// --no-optional-locks stops git status from updating the index, which
+	// would trigger our watcher
+	out, err := runCmdInDir(dir, gitPath, "--no-optional-locks", "status", "--porcelain=v2", "-z", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	changes, err := parseGitStatus(out)
+	if err != nil {
+		return nil, err
+	}
+	var res []*GitChange
+	for _, c := range changes {
+		if view == "" || c.View == view {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// parseGitDiffRaw parses output of git diff --raw -z, which is a list of:
+// :<mode before> <mode after> <sha1 before> <sha1 after> <status><NUL><path>
+// where renames and copies have 2 paths: <NUL><path before><NUL><path after>
+// See https://git-scm.com/docs/git-diff#_raw_output_format
+func parseGitDiffRaw(out []byte) ([]*GitChange, error) {
+	var res []*GitChange
+	records := splitNul(out)
+	for len(records) > 0 {
+		rec := records[0]
+		parts := strings.Split(rec, " ")
+		if len(parts) != 5 || !strings.HasPrefix(rec, ":") || len(parts[4]) == 0 || len(records) < 2 {
+			return nil, fmt.Errorf("invalid git diff entry: %q", rec)
+		}
+		modeBefore, modeAfter := parts[0][1:], parts[1]
+		status := parts[4][0]
+		pathBefore := records[1]
+		path := pathBefore
+		n := 2
+		if status == 'R' || status == 'C' {
+			if len(records) < 3 {
+				return nil, fmt.Errorf("missing path in git diff entry: %q", rec)
+			}
+			path = records[2]
+			n = 3
+		}
+		records = records[n:]
+
+		var c *GitChange
+		switch status {
+		case 'U':
+			// unmerged paths show up when comparing with the working tree
+			// in the middle of a merge, we show them as modified
+			c = newGitChange(Modified, pathBefore, path)
+		default:
+			typ, ok := gitStatusCodeToType(status)
+			if !ok {
+				return nil, fmt.Errorf("unknown status in git diff entry: %q", rec)
+			}
+			c = newGitChange(typ, pathBefore, path)
+		}
+		c.ModeBefore = modeBefore
+		c.ModeAfter = modeAfter
 		res = append(res, c)
 	}
-	return res
+	return res, nil
 }
 
-func gitStatusMust() []*GitChange {
-	out, err := runCmd(gitPath, "status", "--porcelain")
-	fataliferr(err)
-	return parseGitStatusMust(out, true)
+// gitDiff returns changes between revBefore and revAfter in repository in
+// dir ("" for the current directory). If revAfter is revWorkTree or
+// revIndex, compares with the working tree or the index
+func gitDiff(dir, revBefore, revAfter string) ([]*GitChange, error) {
+	args := []string{"diff", "--raw", "-z", "-M", revBefore}
+	if revAfter == revIndex {
+		args = []string{"diff", "--raw", "-z", "-M", "--cached", revBefore}
+	} else if revAfter != revWorkTree {
+		args = append(args, revAfter)
+	}
+	out, err := runCmdInDir(dir, gitPath, args...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := parseGitDiffRaw(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range res {
+		c.RevBefore = revBefore
+		c.RevAfter = revAfter
+	}
+	return res, nil
+}
+
+func gitMergeBaseMust(rev1, rev2 string) string {
+	out, err := runCmd(gitPath, "merge-base", rev1, rev2)
+	fatalif(err != nil, "git merge-base %s %s failed with '%s'\n", rev1, rev2, err)
+	return strings.TrimSpace(string(out))
+}
+
+// gitGetFileContent returns content of path at a given revision, from
+// the index if rev is revIndex or from the working tree if rev is revWorkTree
+func gitGetFileContent(dir, rev, path string) ([]byte, error) {
+	if rev == revWorkTree {
+		return ioutil.ReadFile(filepath.Join(dir, path))
+	}
+	loc := rev + ":" + path
+	if rev == revIndex {
+		loc = ":" + path
+	}
+	return runCmdInDir(dir, gitPath, "show", loc)
 }
 
-func gitGetFileContentHeadMust(path string) []byte {
-	loc := "HEAD:" + path
-	out, err := runCmd(gitPath, "show", loc)
+func gitGetFileContentMust(dir, rev, path string) []byte {
+	d, err := gitGetFileContent(dir, rev, path)
 	fataliferr(err)
-	return out
+	return d
 }
 
 func hasGitDirMust(dir string) bool {
@@ -144,3 +381,20 @@ func cdToGitRoot() {
 func detectGitExeMust() {
 	gitPath = detectExeMust("git")
 }
+
+// gitIgnoredDirs returns directories ignored by git, e.g. node_modules,
+// relative to the root of the repository
+func gitIgnoredDirs(dir string) map[string]bool {
+	res := make(map[string]bool)
+	out, err := runCmdInDir(dir, gitPath, "ls-files", "--others", "--ignored", "--exclude-standard", "--directory", "-z")
+	if err != nil {
+		LogErrorf("git ls-files failed with '%s'\n", err)
+		return res
+	}
+	for _, path := range splitNul(out) {
+		if strings.HasSuffix(path, "/") {
+			res[strings.TrimSuffix(path, "/")] = true
+		}
+	}
+	return res
+}
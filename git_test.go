@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testHash1 = "d5507555ed64e2276ff1d5d91a87c3c45a978c6f"
+	testHash2 = "d905d9da82c97264ab6f4920e20242e088850ce9"
+	testHash3 = "26c3e90f4961282082d2df97eeb46d59ff0869ce"
+)
+
+// statusEntry returns a record of git status --porcelain=v2 -z output
+// for an ordinary change
+func statusEntry(xy, sub, mH, mI, mW, path string) string {
+	return strings.Join([]string{"1", xy, sub, mH, mI, mW, testHash1, testHash2, path}, " ") + "\x00"
+}
+
+// unmergedEntry returns a record of git status --porcelain=v2 -z output
+// for a file with merge conflicts
+func unmergedEntry(xy, path string) string {
+	return strings.Join([]string{"u", xy, "N...", "100644", "100644", "100644", "100644", testHash1, testHash2, testHash3, path}, " ") + "\x00"
+}
+
+func staged(typ int, pathBefore, pathAfter, modeBefore, modeAfter string) *GitChange {
+	return newGitStatusChange(typ, pathBefore, pathAfter, revHead, revIndex, modeBefore, modeAfter, viewStaged)
+}
+
+func unstaged(typ int, path, modeBefore, modeAfter string) *GitChange {
+	return newGitStatusChange(typ, path, path, revIndex, revWorkTree, modeBefore, modeAfter, viewUnstaged)
+}
+
+func conflict(path string) *GitChange {
+	return newGitStatusChange(Unmerged, "", path, revIndex, revWorkTree, "100644", "100644", viewUnstaged)
+}
+
+func untracked(path string) *GitChange {
+	return newGitStatusChange(NotCheckedIn, "", path, revHead, revWorkTree, gitModeNone, "", viewUnstaged)
+}
+
+func TestParseGitStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		exp  []*GitChange
+	}{
+		{"empty", "", nil},
+		{
+			"headers and ignored files are skipped",
+			"# branch.oid " + testHash1 + "\x00# branch.head master\x00! build/out.o\x00",
+			nil,
+		},
+		{
+			"modified in the working tree",
+			statusEntry(".M", "N...", "100644", "100644", "100644", "mod.txt"),
+			[]*GitChange{unstaged(Modified, "mod.txt", "100644", "100644")},
+		},
+		{
+			"staged and unstaged",
+			statusEntry("MM", "N...", "100644", "100644", "100644", "mod.txt"),
+			[]*GitChange{
+				staged(Modified, "mod.txt", "mod.txt", "100644", "100644"),
+				unstaged(Modified, "mod.txt", "100644", "100644"),
+			},
+		},
+		{
+			"added then deleted in the working tree",
+			statusEntry("AD", "N...", gitModeNone, "100644", gitModeNone, "new.txt"),
+			[]*GitChange{
+				staged(Added, "new.txt", "new.txt", gitModeNone, "100644"),
+				unstaged(Deleted, "new.txt", "100644", gitModeNone),
+			},
+		},
+		{
+			"staged deletion",
+			statusEntry("D.", "N...", "100644", gitModeNone, gitModeNone, "gone.txt"),
+			[]*GitChange{staged(Deleted, "gone.txt", "gone.txt", "100644", gitModeNone)},
+		},
+		{
+			"symlink replaced with a file",
+			statusEntry(".T", "N...", "120000", "120000", "100644", "link"),
+			[]*GitChange{unstaged(Modified, "link", "120000", "100644")},
+		},
+		{
+			"submodule with new commits",
+			statusEntry(".M", "SC..", "160000", "160000", "160000", "vendor/lib"),
+			[]*GitChange{unstaged(Modified, "vendor/lib", "160000", "160000")},
+		},
+		{
+			"staged rename",
+			"2 R. N... 100644 100644 100644 " + testHash3 + " " + testHash3 + " R100 renamed.txt\x00old.txt\x00",
+			[]*GitChange{staged(Renamed, "old.txt", "renamed.txt", "100644", "100644")},
+		},
+		{
+			"staged copy modified in the working tree",
+			"2 CM N... 100644 100644 100644 " + testHash1 + " " + testHash2 + " C75 copy.txt\x00orig.txt\x00",
+			[]*GitChange{
+				staged(Copied, "orig.txt", "copy.txt", "100644", "100644"),
+				unstaged(Modified, "copy.txt", "100644", "100644"),
+			},
+		},
+		{
+			"conflicts",
+			unmergedEntry("UU", "both.txt") + unmergedEntry("AA", "added.txt") + unmergedEntry("DU", "deleted by us.txt") + unmergedEntry("UD", "deleted by them.txt"),
+			[]*GitChange{conflict("both.txt"), conflict("added.txt"), conflict("deleted by us.txt"), conflict("deleted by them.txt")},
+		},
+		{
+			"untracked",
+			"? untracked.txt\x00? dir/other.txt\x00",
+			[]*GitChange{untracked("untracked.txt"), untracked("dir/other.txt")},
+		},
+		{
+			"unusual paths",
+			statusEntry(".M", "N...", "100644", "100644", "100644", "with space.txt") +
+				statusEntry(".M", "N...", "100644", "100644", "100644", `q"uote.txt`) +
+				statusEntry(".M", "N...", "100644", "100644", "100644", "new\nline.txt") +
+				statusEntry(".M", "N...", "100644", "100644", "100644", "héllo 世界.txt") +
+				"2 R. N... 100644 100644 100644 " + testHash3 + " " + testHash3 + " R100 to dir/b c.txt\x00from dir/a b.txt\x00" +
+				"? untracked file\n.txt\x00",
+			[]*GitChange{
+				unstaged(Modified, "with space.txt", "100644", "100644"),
+				unstaged(Modified, `q"uote.txt`, "100644", "100644"),
+				unstaged(Modified, "new\nline.txt", "100644", "100644"),
+				unstaged(Modified, "héllo 世界.txt", "100644", "100644"),
+				staged(Renamed, "from dir/a b.txt", "to dir/b c.txt", "100644", "100644"),
+				untracked("untracked file\n.txt"),
+			},
+		},
+		{
+			// git status --porcelain=v2 -z --untracked-files=all with
+			// status.renames=copies during a merge with conflicts
+			"real output",
+			"2 C. N... 100644 100644 100644 1c99002b20b3c0e11a95c8423601a38fff9b3675 1c99002b20b3c0e11a95c8423601a38fff9b3675 C100 copy of orig.txt\x00orig.txt\x00" +
+				"1 .M N... 100644 100644 100644 8ba3a16384aacc37d01564b28401755ce8053f51 8ba3a16384aacc37d01564b28401755ce8053f51 new\nline.txt\x00" +
+				"2 R. N... 100644 100644 100644 26e04c7192afec03c83183fa8ae605496f15d88d 26e04c7192afec03c83183fa8ae605496f15d88d R100 new name.txt\x00old name.txt\x00" +
+				"1 M. N... 100644 100644 100644 1c99002b20b3c0e11a95c8423601a38fff9b3675 6006ca457910cc24631dcfba8dcbf98b15c9c68d orig.txt\x00" +
+				"1 .M SCM. 160000 160000 160000 f5b23db6e64d6cff1729959c074ea8f0a770e357 f5b23db6e64d6cff1729959c074ea8f0a770e357 sub\x00" +
+				"1 .M N... 100644 100644 100644 28ce6a8b26aa170e1de65536fe8abe1832bd3242 28ce6a8b26aa170e1de65536fe8abe1832bd3242 with space.txt\x00" +
+				"u UU N... 100644 100644 100644 100644 61780798228d17af2d34fce4cfbdf35556832472 351be5bf6e17c59ea560546d69654115ecb2fd8d e45c9c2666d44e0327c1f9c239a74c508336053e both.txt\x00" +
+				"u UD N... 100644 100644 000000 100644 01058d844a98d293a3b03a8615a34700e4ed2be3 5ea2ed416fbd4a4cbe227b75fe255dd7fa6bd4d6 0000000000000000000000000000000000000000 gone.txt\x00" +
+				"? untracked\nfile.txt\x00",
+			[]*GitChange{
+				staged(Copied, "orig.txt", "copy of orig.txt", "100644", "100644"),
+				unstaged(Modified, "new\nline.txt", "100644", "100644"),
+				staged(Renamed, "old name.txt", "new name.txt", "100644", "100644"),
+				staged(Modified, "orig.txt", "orig.txt", "100644", "100644"),
+				unstaged(Modified, "sub", "160000", "160000"),
+				unstaged(Modified, "with space.txt", "100644", "100644"),
+				conflict("both.txt"),
+				conflict("gone.txt"),
+				untracked("untracked\nfile.txt"),
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseGitStatus([]byte(test.out))
+		if err != nil {
+			t.Errorf("%s: unexpected error '%s'", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, dumpChanges(got), dumpChanges(test.exp))
+		}
+	}
+}
+
+func TestParseGitStatusInvalid(t *testing.T) {
+	tests := []string{
+		"1",
+		"x foo.txt\x00",
+		"1 .M N... 100644 100644 100644 " + testHash1 + "\x00",
+		"1 M N... 100644 100644 100644 " + testHash1 + " " + testHash2 + " foo.txt\x00",
+		"2 R. N... 100644 100644 100644 " + testHash3 + " " + testHash3 + " R100 renamed.txt\x00",
+		"2 R. N... 100644 100644 100644 " + testHash3 + " " + testHash3 + " renamed.txt\x00old.txt\x00",
+		"u UU N... 100644 100644 100644 100644 " + testHash1 + " " + testHash2 + " both.txt\x00",
+		"?\x00",
+		"? ok.txt\x00!",
+		statusEntry(".M", "N...", "100644", "100644", "100644", "ok.txt") + "1 .M N...",
+	}
+	for _, out := range tests {
+		if got, err := parseGitStatus([]byte(out)); err == nil {
+			t.Errorf("%q: expected an error, got\n%s", out, dumpChanges(got))
+		}
+	}
+}
+
+// rawEntry returns a record of git diff --raw -z output
+func rawEntry(modeBefore, modeAfter, status string, paths ...string) string {
+	s := strings.Join([]string{":" + modeBefore, modeAfter, testHash1[:7], testHash2[:7], status}, " ")
+	for _, p := range paths {
+		s += "\x00" + p
+	}
+	return s + "\x00"
+}
+
+func rawChange(typ int, pathBefore, pathAfter, modeBefore, modeAfter string) *GitChange {
+	c := newGitChange(typ, pathBefore, pathAfter)
+	c.ModeBefore = modeBefore
+	c.ModeAfter = modeAfter
+	return c
+}
+
+func TestParseGitDiffRaw(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		exp  []*GitChange
+	}{
+		{"empty", "", nil},
+		{
+			"modified, added and deleted",
+			rawEntry("100644", "100644", "M", "mod.txt") + rawEntry(gitModeNone, "100755", "A", "new.sh") + rawEntry("100644", gitModeNone, "D", "gone.txt"),
+			[]*GitChange{
+				rawChange(Modified, "mod.txt", "mod.txt", "100644", "100644"),
+				rawChange(Added, "new.sh", "new.sh", gitModeNone, "100755"),
+				rawChange(Deleted, "gone.txt", "gone.txt", "100644", gitModeNone),
+			},
+		},
+		{
+			"type change and submodule",
+			rawEntry("120000", "100644", "T", "link") + rawEntry("160000", "160000", "M", "vendor/lib"),
+			[]*GitChange{
+				rawChange(Modified, "link", "link", "120000", "100644"),
+				rawChange(Modified, "vendor/lib", "vendor/lib", "160000", "160000"),
+			},
+		},
+		{
+			"renames and copies with scores",
+			rawEntry("100644", "100644", "R100", "old.txt", "renamed.txt") + rawEntry("100644", "100644", "C075", "orig.txt", "copy.txt") + rawEntry("100644", "100644", "R062", "a.txt", "b.txt"),
+			[]*GitChange{
+				rawChange(Renamed, "old.txt", "renamed.txt", "100644", "100644"),
+				rawChange(Copied, "orig.txt", "copy.txt", "100644", "100644"),
+				rawChange(Renamed, "a.txt", "b.txt", "100644", "100644"),
+			},
+		},
+		{
+			"unmerged",
+			rawEntry(gitModeNone, gitModeNone, "U", "both.txt"),
+			[]*GitChange{rawChange(Modified, "both.txt", "both.txt", gitModeNone, gitModeNone)},
+		},
+		{
+			"unusual paths",
+			rawEntry("100644", "100644", "M", "with space.txt") + rawEntry("100644", "100644", "M", `q"uote.txt`) +
+				rawEntry("100644", "100644", "M", "new\nline.txt") + rawEntry("100644", "100644", "R100", "héllo.txt", "世界 dir/héllo.txt"),
+			[]*GitChange{
+				rawChange(Modified, "with space.txt", "with space.txt", "100644", "100644"),
+				rawChange(Modified, `q"uote.txt`, `q"uote.txt`, "100644", "100644"),
+				rawChange(Modified, "new\nline.txt", "new\nline.txt", "100644", "100644"),
+				rawChange(Renamed, "héllo.txt", "世界 dir/héllo.txt", "100644", "100644"),
+			},
+		},
+		{
+			// git diff --raw -z -M -C HEAD in the repository of the real
+			// output of git status above
+			"real output",
+			":100644 100644 351be5b 0000000 M\x00both.txt\x00" +
+				":100644 100644 1c99002 1c99002 C100\x00orig.txt\x00copy of orig.txt\x00" +
+				":100644 100644 8ba3a16 0000000 M\x00new\nline.txt\x00" +
+				":100644 100644 26e04c7 26e04c7 R100\x00old name.txt\x00new name.txt\x00" +
+				":100644 100644 1c99002 6006ca4 M\x00orig.txt\x00" +
+				":160000 160000 f5b23db 0000000 M\x00sub\x00" +
+				":100644 100644 28ce6a8 0000000 M\x00with space.txt\x00",
+			[]*GitChange{
+				rawChange(Modified, "both.txt", "both.txt", "100644", "100644"),
+				rawChange(Copied, "orig.txt", "copy of orig.txt", "100644", "100644"),
+				rawChange(Modified, "new\nline.txt", "new\nline.txt", "100644", "100644"),
+				rawChange(Renamed, "old name.txt", "new name.txt", "100644", "100644"),
+				rawChange(Modified, "orig.txt", "orig.txt", "100644", "100644"),
+				rawChange(Modified, "sub", "sub", "160000", "160000"),
+				rawChange(Modified, "with space.txt", "with space.txt", "100644", "100644"),
+			},
+		},
+		{
+			// git diff --raw -z -M -C --cached HEAD in the same repository,
+			// which lists unmerged files
+			"real output of the index",
+			":100644 000000 351be5b 0000000 U\x00both.txt\x00" +
+				":100644 100644 1c99002 1c99002 C100\x00orig.txt\x00copy of orig.txt\x00" +
+				":100644 000000 5ea2ed4 0000000 U\x00gone.txt\x00" +
+				":100644 100644 26e04c7 26e04c7 R100\x00old name.txt\x00new name.txt\x00" +
+				":100644 100644 1c99002 6006ca4 M\x00orig.txt\x00",
+			[]*GitChange{
+				rawChange(Modified, "both.txt", "both.txt", "100644", gitModeNone),
+				rawChange(Copied, "orig.txt", "copy of orig.txt", "100644", "100644"),
+				rawChange(Modified, "gone.txt", "gone.txt", "100644", gitModeNone),
+				rawChange(Renamed, "old name.txt", "new name.txt", "100644", "100644"),
+				rawChange(Modified, "orig.txt", "orig.txt", "100644", "100644"),
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseGitDiffRaw([]byte(test.out))
+		if err != nil {
+			t.Errorf("%s: unexpected error '%s'", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, dumpChanges(got), dumpChanges(test.exp))
+		}
+	}
+}
+
+func TestParseGitDiffRawInvalid(t *testing.T) {
+	tests := []string{
+		":100644 100644 d905d9d 8615e4d M\x00",
+		":100644 100644 d905d9d 8615e4d\x00mod.txt\x00",
+		"100644 100644 d905d9d 8615e4d M\x00mod.txt\x00",
+		":100644 100644 d905d9d 8615e4d \x00mod.txt\x00",
+		":100644 100644 d905d9d 8615e4d X\x00mod.txt\x00",
+		":100644 100644 d905d9d 8615e4d R100\x00old.txt\x00",
+		":100644 100644 d905d9d 8615e4d C100\x00old.txt",
+		rawEntry("100644", "100644", "M", "ok.txt") + ":100644",
+	}
+	for _, out := range tests {
+		if got, err := parseGitDiffRaw([]byte(out)); err == nil {
+			t.Errorf("%q: expected an error, got\n%s", out, dumpChanges(got))
+		}
+	}
+}
+
+func dumpChanges(changes []*GitChange) string {
+	var lines []string
+	for _, c := range changes {
+		lines = append(lines, fmt.Sprintf("  %s %q %q %s %s %q %q %s", gitTypeToString(c.Type), c.PathBefore, c.PathAfter, c.ModeBefore, c.ModeAfter, c.RevBefore, c.RevAfter, c.View))
+	}
+	return strings.Join(lines, "\n")
+}
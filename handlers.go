@@ -8,23 +8,18 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/kjk/log"
-	"github.com/kjk/u"
 )
 
 var (
-	httpAddr      = "127.0.0.1:6111"
-	mu            sync.Mutex
-	globalChanges []*Change
-
 	// loaded only once at startup. maps a file path of the resource
 	// to its data
 	resourcesFromZip map[string][]byte
@@ -35,10 +30,12 @@ const (
 )
 
 const (
-	TypeAdd    = "add"
-	TypeDelete = "delete"
-	TypeMove   = "move"
-	TypeChange = "change"
+	TypeAdd      = "add"
+	TypeDelete   = "delete"
+	TypeMove     = "move"
+	TypeCopy     = "copy"
+	TypeChange   = "change"
+	TypeConflict = "conflict"
 )
 
 // ThickResponse describes response for /thick/:idx
@@ -46,12 +43,43 @@ type ThickResponse struct {
 	BeforePath *string `json:"a"`
 	AfterPath  *string `json:"b"`
 	IsImage    bool    `json:"is_image_diff"`
-	NoChanges  bool    `json:"no_changes"`
-	// Type is "add", "delete", "move", "change"
-	Type          string `json:"type"`
-	Index         int    `json:"idx"`
-	contentBefore []byte
-	contentAfter  []byte
+	contentsInfo
+	// only set for files with merge conflicts
+	IsConflict bool `json:"is_conflict"`
+	IsResolved bool `json:"is_resolved"`
+	// Type is "add", "delete", "move", "copy", "change", "conflict"
+	Type  string `json:"type"`
+	Index int    `json:"idx"`
+	View  string `json:"view,omitempty"` // "staged" or "unstaged"
+}
+
+// contentsInfo is part of ThickResponse that depends on contents of files
+// so it's only known after they're loaded. For images it's loaded in the
+// background after changes are built, for other files when they're first
+// viewed
+type contentsInfo struct {
+	NoChanges bool `json:"no_changes"`
+	// true if files only differ in whitespace we ignore
+	NoMeaningfulChanges bool `json:"no_meaningful_changes"`
+	// only set for images
+	ImageBefore       *ImageInfo `json:"image_a,omitempty"`
+	ImageAfter        *ImageInfo `json:"image_b,omitempty"`
+	AreSamePixels     bool       `json:"are_same_pixels"`
+	DiffPixels        int        `json:"diff_pixels"`
+	DiffPixelsPercent float64    `json:"diff_pixels_percent"`
+}
+
+func newContentsInfo(isImage bool, path string, fc *fileContents) contentsInfo {
+	var res contentsInfo
+	res.NoChanges = bytes.Equal(fc.before, fc.after)
+	res.NoMeaningfulChanges = res.NoChanges
+	if !res.NoChanges && !isImage && defaultWhitespaceOptions.ignoresAnything() {
+		res.NoMeaningfulChanges = !hasMeaningfulChanges(fc.before, fc.after, defaultWhitespaceOptions)
+	}
+	if isImage {
+		fillImageDiffInfo(&res, path, fc)
+	}
+	return res
 }
 
 func gitChangeTypeToThickResponseType(typ int) string {
@@ -64,6 +92,10 @@ func gitChangeTypeToThickResponseType(typ int) string {
 		return TypeDelete
 	case Renamed:
 		return TypeMove
+	case Copied:
+		return TypeCopy
+	case Unmerged:
+		return TypeConflict
 	case NotCheckedIn:
 		return TypeAdd
 	default:
@@ -76,8 +108,14 @@ func hasZipResources() bool {
 	return len(resourcesZipData) > 0
 }
 
+// isTooLargeToDiff returns true if d is binary or larger than we're willing
+// to show as text
+func isTooLargeToDiff(d []byte) bool {
+	return isBinaryData(d) || len(d) > maxFileSizeToDiff
+}
+
 func capFileSize(d []byte) []byte {
-	if isBinaryData(d) || len(d) > maxFileSizeToDiff {
+	if isTooLargeToDiff(d) {
 		var s string
 		if isBinaryData(d) && len(d) > maxFileSizeToDiff {
 			s = fmt.Sprintf("Not showing large (%d bytes), binary file. Size limit is %d bytes", len(d), maxFileSizeToDiff)
@@ -97,37 +135,21 @@ func capFileSize(d []byte) []byte {
 func ThickResponseFromGitChange(c *GitChange) ThickResponse {
 	var res ThickResponse
 	res.Type = gitChangeTypeToThickResponseType(c.Type)
+	res.View = c.View
 	switch c.Type {
-	case Modified:
+	case Modified, Unmerged:
 		res.BeforePath = &c.PathBefore
 		res.AfterPath = &c.PathBefore
-		res.contentBefore = gitGetFileContentHeadMust(c.PathBefore)
-		res.contentAfter = readFileMust(c.PathBefore)
-	case Added:
-		res.BeforePath = nil
+	case Added, NotCheckedIn:
 		res.AfterPath = &c.PathAfter
-		res.contentBefore = nil
-		res.contentAfter = readFileMust(c.PathAfter)
 	case Deleted:
 		res.BeforePath = &c.PathBefore
-		res.AfterPath = nil
-		res.contentBefore = gitGetFileContentHeadMust(c.PathBefore)
-		res.contentAfter = nil
-	case Renamed:
+	case Renamed, Copied:
 		res.BeforePath = &c.PathBefore
 		res.AfterPath = &c.PathAfter
-		res.contentBefore = gitGetFileContentHeadMust(c.PathBefore)
-		res.contentAfter = readFileMust(c.PathAfter)
-	case NotCheckedIn:
-		res.BeforePath = nil
-		res.AfterPath = &c.PathAfter
-		res.contentBefore = nil
-		res.contentAfter = readFileMust(c.PathAfter)
 	}
-	res.contentBefore = capFileSize(res.contentBefore)
-	res.contentAfter = capFileSize(res.contentAfter)
+	res.IsConflict = c.Type == Unmerged
 	res.IsImage = isImageFile(c.GetPath())
-	res.NoChanges = bytes.Equal(res.contentBefore, res.contentAfter)
 	return res
 }
 
@@ -136,67 +158,42 @@ func ThickResponseFromDirDiffs(c *GitChange) ThickResponse {
 	var res ThickResponse
 	res.Type = gitChangeTypeToThickResponseType(c.Type)
 	switch c.Type {
-	case Modified:
+	case Modified, Renamed, Copied:
 		res.BeforePath = &c.PathBefore
 		res.AfterPath = &c.PathAfter
-		res.contentBefore = readFileMust(c.PathBefore)
-		res.contentAfter = readFileMust(c.PathAfter)
-	case Added:
-		res.BeforePath = nil
+	case Added, NotCheckedIn:
 		res.AfterPath = &c.PathAfter
-		res.contentBefore = nil
-		res.contentAfter = readFileMust(c.PathAfter)
 	case Deleted:
 		res.BeforePath = &c.PathBefore
-		res.AfterPath = nil
-		res.contentBefore = readFileMust(c.PathBefore)
-		res.contentAfter = nil
-	case Renamed:
-		res.BeforePath = &c.PathBefore
-		res.AfterPath = &c.PathAfter
-		res.contentBefore = readFileMust(c.PathBefore)
-		res.contentAfter = readFileMust(c.PathAfter)
-	case NotCheckedIn:
-		res.BeforePath = nil
-		res.AfterPath = &c.PathAfter
-		res.contentBefore = nil
-		res.contentAfter = readFileMust(c.PathAfter)
 	}
-	res.contentBefore = capFileSize(res.contentBefore)
-	res.contentAfter = capFileSize(res.contentAfter)
 	res.IsImage = isImageFile(c.GetPath())
-	res.NoChanges = bytes.Equal(res.contentBefore, res.contentAfter)
 	return res
 }
 
-func buildGlobalChanges(changes []*GitChange) {
-	var res []*Change
-	for i, c := range changes {
-		gc := &Change{}
-		gc.GitChange = *c
-		gc.ThickResponse = ThickResponseFromGitChange(c)
-		gc.ThickResponse.Index = i
-		res = append(res, gc)
+// buildChanges creates Change for each GitChange. If old is given, re-uses
+// its entries for changes that don't involve any of changedPaths
+func (s *Session) buildChanges(changes []*GitChange, old []*Change, changedPaths map[string]bool) []*Change {
+	oldByChange := make(map[GitChange]*Change)
+	for _, gc := range old {
+		oldByChange[gc.GitChange] = gc
 	}
-
-	mu.Lock()
-	globalChanges = res
-	mu.Unlock()
-}
-
-func buildGlobalChangesFromDirDiffs(changes []*GitChange) {
 	var res []*Change
 	for i, c := range changes {
 		gc := &Change{}
 		gc.GitChange = *c
-		gc.ThickResponse = ThickResponseFromDirDiffs(c)
+		prev := oldByChange[*c]
+		if prev != nil && !changedPaths[c.PathBefore] && !changedPaths[c.PathAfter] {
+			s.mu.Lock()
+			gc.ThickResponse = prev.ThickResponse
+			gc.infoLoaded = prev.infoLoaded
+			s.mu.Unlock()
+		} else {
+			gc.ThickResponse = s.source.newThickResponse(&gc.GitChange)
+		}
 		gc.ThickResponse.Index = i
 		res = append(res, gc)
 	}
-
-	mu.Lock()
-	globalChanges = res
-	mu.Unlock()
+	return res
 }
 
 func normalizePath(s string) string {
@@ -279,7 +276,7 @@ func serveResourceFromZip(w http.ResponseWriter, r *http.Request, path string) {
 
 	if data == nil {
 		LogVerbosef("no data for file '%s'\n", path)
-		servePlainText(w, r, 404, fmt.Sprintf("file '%s' not found", path))
+		servePlainText(w, r, 404, "file '%s' not found", path)
 		return
 	}
 
@@ -291,19 +288,32 @@ func serveResourceFromZip(w http.ResponseWriter, r *http.Request, path string) {
 	serveData(w, r, 200, MimeTypeByExtensionExt(path), data, gzippedData)
 }
 
+// readResource returns a file in www directory, from the binary if
+// resources are embedded
+func readResource(path string) ([]byte, error) {
+	if hasZipResources() {
+		d, ok := resourcesFromZip[normalizePath(path)]
+		if !ok {
+			return nil, fmt.Errorf("resource '%s' not found", path)
+		}
+		return d, nil
+	}
+	return ioutil.ReadFile(path)
+}
+
 func serveFile(w http.ResponseWriter, r *http.Request, fileName string) {
 	//LogVerbosef("serverFile: fileName='%s'\n", fileName)
-	path := filepath.Join("www", fileName)
+	path := "www/" + fileName
+	if !isStaticFile(path) {
+		LogVerbosef("file '%s' is not in static manifest\n", path)
+		http.NotFound(w, r)
+		return
+	}
 	if hasZipResources() {
 		serveResourceFromZip(w, r, path)
 		return
 	}
-	if u.PathExists(path) {
-		http.ServeFile(w, r, path)
-	} else {
-		LogVerbosef("file '%s' doesn't exist\n", path)
-		http.NotFound(w, r)
-	}
+	http.ServeFile(w, r, filepath.FromSlash(path))
 }
 
 func acceptsGzip(r *http.Request) bool {
@@ -356,103 +366,232 @@ func httpOkWithJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
 	httpOkBytesWithContentType(w, r, "application/json", b)
 }
 
-func serveIndexPage(w http.ResponseWriter, r *http.Request) {
+// must be called with s.mu locked
+func (s *Session) getPairsLocked() []*ThickResponse {
 	var pairs []*ThickResponse
-	mu.Lock()
-	for _, gc := range globalChanges {
+	for _, gc := range s.changes {
 		pairs = append(pairs, &gc.ThickResponse)
 	}
-	mu.Unlock()
+	return pairs
+}
+
+// hasPerceptualDiffLocked returns true if there are images we can compare
+// pixel by pixel, i.e. with both sides. Must be called with s.mu locked
+func (s *Session) hasPerceptualDiffLocked() bool {
+	for _, gc := range s.changes {
+		if gc.IsImage && gc.BeforePath != nil && gc.AfterPath != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func serveIndexPage(w http.ResponseWriter, r *http.Request, s *Session) {
+	s.mu.Lock()
+	pairs := s.getPairsLocked()
+	generation := s.generation
+	hasPerceptualDiff := s.hasPerceptualDiffLocked()
+	s.mu.Unlock()
 	v := struct {
-		Pairs []*ThickResponse
+		Pairs               []*ThickResponse
+		Generation          int
+		BaseURL             string
+		HasPerceptualDiff   bool
+		Whitespace          whitespaceOptions
+		ClientID            string
+		HeartbeatIntervalMs int64
 	}{
-		Pairs: pairs,
+		Pairs:               pairs,
+		Generation:          generation,
+		BaseURL:             s.urlPrefix,
+		HasPerceptualDiff:   hasPerceptualDiff,
+		Whitespace:          defaultWhitespaceOptions,
+		ClientID:            newClient(s.ID),
+		HeartbeatIntervalMs: int64(heartbeatInterval / time.Millisecond),
 	}
 	execTemplate(w, tmplIndex, v)
 }
 
-func handleIndex(w http.ResponseWriter, r *http.Request) {
+func handleIndex(w http.ResponseWriter, r *http.Request, s *Session) {
 	uri := r.URL.Path
 	method := r.Method
 	LogVerbosef("%s '%s'\n", method, uri)
 	path := uri[1:]
 	if path == "" {
-		serveIndexPage(w, r)
+		serveIndexPage(w, r, s)
 		return
 	}
 	serveFile(w, r, path)
 }
 
-func getThickResponseByIdx(idx int) *ThickResponse {
-	mu.Lock()
-	defer mu.Unlock()
-	if idx >= len(globalChanges) {
-		return nil
-	}
-	gc := globalChanges[idx]
-	return &gc.ThickResponse
-}
-
-// /thick/:idx
-func handleThick(w http.ResponseWriter, r *http.Request) {
+// getChangeFromURI returns Change for urls like /thick/:idx or nil after
+// responding with 404 if there's no valid idx
+func getChangeFromURI(w http.ResponseWriter, r *http.Request, s *Session, prefix string) *Change {
 	uri := r.URL.Path
-	LogVerbosef("handleThick uri='%s'\n", uri)
-	idxStr := uri[len("/thick/"):]
+	idxStr := uri[len(prefix):]
 	idx, err := strconv.Atoi(idxStr)
 	if err != nil {
 		LogErrorf("missing argument in '%s'\n", uri)
 		http.NotFound(w, r)
-		return
+		return nil
 	}
-	tr := getThickResponseByIdx(idx)
-	if tr == nil {
+	gc := s.getChangeByIdx(idx)
+	if gc == nil {
 		http.NotFound(w, r)
-		return
+		return nil
 	}
+	return gc
+}
+
+// loadContentsOrFail is loadContents that responds with 500 on error
+func loadContentsOrFail(w http.ResponseWriter, r *http.Request, s *Session, gc *Change) (ThickResponse, *fileContents, bool) {
+	tr, fc, err := s.loadContents(gc)
+	if err != nil {
+		LogErrorf("loadContents() of '%s' failed with '%s'\n", gc.GetPath(), err)
+		servePlainText(w, r, 500, "failed to read '%s': %s", gc.GetPath(), err)
+		return tr, nil, false
+	}
+	return tr, fc, true
+}
 
+// /thick/:idx?ignore_eol=1 etc.
+func handleThick(w http.ResponseWriter, r *http.Request, s *Session) {
+	LogVerbosef("handleThick uri='%s'\n", r.URL.Path)
+	gc := getChangeFromURI(w, r, s, "/thick/")
+	if gc == nil {
+		return
+	}
+	tr, fc, ok := loadContentsOrFail(w, r, s, gc)
+	if !ok {
+		return
+	}
+	ws, err := whitespaceOptionsFromRequest(r)
+	if err != nil {
+		servePlainText(w, r, 400, "%s", err)
+		return
+	}
+	if ws != defaultWhitespaceOptions && !tr.IsImage && !tr.NoChanges {
+		tr.NoMeaningfulChanges = !hasMeaningfulChanges(fc.before, fc.after, ws)
+	}
 	httpOkWithJSON(w, r, tr)
+	s.prefetchContents(tr.Index + 1)
 }
 
-func strPtrToLower(s *string) string {
-	if s == nil {
-		return ""
+// /pdiffbbox/:idx
+func handlePdiffBbox(w http.ResponseWriter, r *http.Request, s *Session) {
+	uri := r.URL.Path
+	LogVerbosef("handlePdiffBbox uri='%s'\n", uri)
+	gc := getChangeFromURI(w, r, s, "/pdiffbbox/")
+	if gc == nil {
+		return
+	}
+	tr, fc, ok := loadContentsOrFail(w, r, s, gc)
+	if !ok {
+		return
 	}
-	return strings.ToLower(*s)
+	if !tr.IsImage || fc.before == nil || fc.after == nil {
+		http.NotFound(w, r)
+		return
+	}
+	bbox, err := imageDiffBBox(fc.before, fc.after)
+	if err != nil {
+		LogErrorf("imageDiffBBox() for '%s' failed with '%s'\n", uri, err)
+		servePlainText(w, r, 400, "%s", err)
+		return
+	}
+	httpOkWithJSON(w, r, bbox)
 }
 
-func findByPath(path string) *ThickResponse {
-	path = strings.ToLower(path)
-	mu.Lock()
-	defer mu.Unlock()
-	var p string
-	for _, gc := range globalChanges {
-		p = strPtrToLower(gc.BeforePath)
-		if p == path {
-			return &gc.ThickResponse
-		}
-		p = strPtrToLower(gc.AfterPath)
-		if p == path {
-			return &gc.ThickResponse
+// /pdiff/:idx returns a png with pixels that differ between the 2 images
+func handlePdiff(w http.ResponseWriter, r *http.Request, s *Session) {
+	uri := r.URL.Path
+	LogVerbosef("handlePdiff uri='%s'\n", uri)
+	gc := getChangeFromURI(w, r, s, "/pdiff/")
+	if gc == nil {
+		return
+	}
+	tr, fc, ok := loadContentsOrFail(w, r, s, gc)
+	if !ok {
+		return
+	}
+	if !tr.IsImage || fc.before == nil || fc.after == nil {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := imageDiffMask(fc.before, fc.after)
+	if err != nil {
+		LogErrorf("imageDiffMask() for '%s' failed with '%s'\n", uri, err)
+		servePlainText(w, r, 400, "%s", err)
+		return
+	}
+	httpOkBytesWithContentType(w, r, "image/png", d)
+}
+
+// /diff/:idx?algorithm=${algorithm}&context=${n}&ignore_eol=1 etc.
+func handleDiff(w http.ResponseWriter, r *http.Request, s *Session) {
+	uri := r.URL.Path
+	LogVerbosef("handleDiff uri='%s'\n", uri)
+	gc := getChangeFromURI(w, r, s, "/diff/")
+	if gc == nil {
+		return
+	}
+	opts, err := diffOptionsFromRequest(r)
+	if err != nil {
+		servePlainText(w, r, 400, "%s", err)
+		return
+	}
+	tr, fc, ok := loadContentsOrFail(w, r, s, gc)
+	if !ok {
+		return
+	}
+	res := computeDiff(fc.before, fc.after, opts)
+	if detectMovedBlocks && !tr.IsImage && len(res.Hunks) > 0 {
+		// finding moves reads all changes so we don't wait for it, the ui
+		// gets them from /moves
+		if moves, ok := s.readyMoves(opts.whitespaceOptions); ok {
+			annotateMoves(res, tr.Index, moves)
+		} else {
+			res.MovesPending = true
 		}
 	}
-	return nil
+	httpOkWithJSON(w, r, res)
 }
 
-func handleGetContents(w http.ResponseWriter, r *http.Request, which string) {
-	path := r.FormValue("path")
-	LogVerbosef("/%s/get_contents, path='%s'\n", which, path)
-	tr := findByPath(path)
-	if tr == nil {
+// sidePath returns path of "a" (before) or "b" (after) side of a change
+func sidePath(tr *ThickResponse, which string) string {
+	p := tr.BeforePath
+	if which == "b" {
+		p = tr.AfterPath
+	}
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+func handleGetContents(w http.ResponseWriter, r *http.Request, s *Session, which string) {
+	LogVerbosef("/%s/get_contents, idx='%s'\n", which, r.FormValue("idx"))
+	idx, err := strconv.Atoi(r.FormValue("idx"))
+	if err != nil {
+		servePlainText(w, r, 400, "missing or invalid idx argument")
+		return
+	}
+	gc := s.getChangeByIdx(idx)
+	if gc == nil {
 		http.NotFound(w, r)
 		return
 	}
+	tr, fc, ok := loadContentsOrFail(w, r, s, gc)
+	if !ok {
+		return
+	}
 	var d []byte
 	if which == "a" {
-		d = tr.contentBefore
+		d = fc.before
 	} else {
-		d = tr.contentAfter
+		d = fc.after
 	}
-	mime := MimeTypeByExtensionExt(path)
+	mime := MimeTypeByExtensionExt(sidePath(&tr, which))
 	// application/json confuses front-end because jQuery ajax
 	// automatically translate those to objects
 	if mime == "application/json" || mime == "application/javascript" {
@@ -461,39 +600,142 @@ func handleGetContents(w http.ResponseWriter, r *http.Request, which string) {
 	httpOkBytesWithContentType(w, r, mime, d)
 }
 
-func handdleGetContentsA(w http.ResponseWriter, r *http.Request) {
-	handleGetContents(w, r, "a")
+func handdleGetContentsA(w http.ResponseWriter, r *http.Request, s *Session) {
+	handleGetContents(w, r, s, "a")
 }
 
-func handdleGetContentsB(w http.ResponseWriter, r *http.Request) {
-	handleGetContents(w, r, "b")
+func handdleGetContentsB(w http.ResponseWriter, r *http.Request, s *Session) {
+	handleGetContents(w, r, s, "b")
 }
 
-func handleKill(w http.ResponseWriter, r *http.Request) {
-	LogVerbosef("handleKill, url: '%s'\n", r.URL.Path)
-	os.Exit(0)
+// /a/image/:idx and /b/image/:idx
+func handleImage(w http.ResponseWriter, r *http.Request, s *Session, which string) {
+	prefix := "/" + which + "/image/"
+	LogVerbosef("%s, uri='%s'\n", prefix, r.URL.Path)
+	gc := getChangeFromURI(w, r, s, prefix)
+	if gc == nil {
+		return
+	}
+	tr, fc, ok := loadContentsOrFail(w, r, s, gc)
+	if !ok {
+		return
+	}
+	d := fc.before
+	if which == "b" {
+		d = fc.after
+	}
+	if !tr.IsImage || d == nil {
+		http.NotFound(w, r)
+		return
+	}
+	httpOkBytesWithContentType(w, r, MimeTypeByExtensionExt(sidePath(&tr, which)), d)
 }
 
-func registerHandlers() {
-	http.HandleFunc("/", handleIndex)
-	http.HandleFunc("/thick/", handleThick)
-	http.HandleFunc("/a/get_contents", handdleGetContentsA)
-	http.HandleFunc("/b/get_contents", handdleGetContentsB)
-	http.HandleFunc("/kill", handleKill)
+func handleImageA(w http.ResponseWriter, r *http.Request, s *Session) {
+	handleImage(w, r, s, "a")
 }
 
-func startWebServer() {
-	registerHandlers()
-
-	go func(uri string) {
-		time.Sleep(time.Second)
-		LogVerbosef("Opening browser with '%s'\n", uri)
-		openDefaultBrowser(uri)
-	}("http://" + httpAddr)
+func handleImageB(w http.ResponseWriter, r *http.Request, s *Session) {
+	handleImage(w, r, s, "b")
+}
 
-	LogVerbosef("Started runing on %s\n", httpAddr)
-	if err := http.ListenAndServe(httpAddr, nil); err != nil {
-		LogErrorf("http.ListendAndServer() failed with %s\n", err)
+// /kill stops the server, even with -persist
+func handleKill(w http.ResponseWriter, r *http.Request) {
+	LogVerbosef("handleKill, url: '%s'\n", r.URL.Path)
+	servePlainText(w, r, 200, "ok")
+	shutdownServer("/kill was called")
+}
+
+// newSessionMux returns a handler of urls of a session. In the daemon
+// they're relative to urlPrefix of the session
+func newSessionMux(s *Session) *http.ServeMux {
+	mux := http.NewServeMux()
+	handle := func(pattern string, h func(http.ResponseWriter, *http.Request, *Session)) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			h(w, r, s)
+		})
+	}
+	handle("/", handleIndex)
+	handle("/thick/", handleThick)
+	handle("/a/get_contents", handdleGetContentsA)
+	handle("/b/get_contents", handdleGetContentsB)
+	handle("/a/image/", handleImageA)
+	handle("/b/image/", handleImageB)
+	handle("/pdiffbbox/", handlePdiffBbox)
+	handle("/pdiff/", handlePdiff)
+	handle("/diff/", handleDiff)
+	handle("/moves", handleMoves)
+	handle("/patch", handlePatch)
+	handle("/patch/", handlePatch)
+	handle("/conflict/", handleConflict)
+	handle("/resolve/", handleResolve)
+	handle("/events", handleEvents)
+	return mux
+}
+
+// registerCommonHandlers registers urls that don't belong to a session
+func registerCommonHandlers() {
+	http.HandleFunc("/login", handleLogin)
+	http.HandleFunc("/heartbeat", withSession(handleHeartbeat))
+	http.HandleFunc("/bye", withSession(handleBye))
+	http.HandleFunc("/kill", withSession(handleKill))
+}
+
+func registerHandlers(s *Session) {
+	registerCommonHandlers()
+	http.HandleFunc("/", withSession(newSessionMux(s).ServeHTTP))
+}
+
+// listenHTTP starts listening for http requests and tells the user and
+// other tools where we are. Returns the listener and url of the server
+func listenHTTP() (net.Listener, string) {
+	l, err := listen()
+	if err != nil {
+		LogErrorf("listen() failed with '%s'\n", err)
+		os.Exit(1)
+	}
+	initTokens()
+	uri := serverURL(l)
+	fmt.Printf("Differ is running at %s\n", uri)
+	if err := writeStateFile(uri); err != nil {
+		LogErrorf("writeStateFile() failed with '%s'\n", err)
+	}
+	shutdownOnSignal()
+	return l, uri
+}
+
+// serveHTTP serves requests until the server is shut down
+func serveHTTP(l net.Listener) {
+	httpServer.RegisterOnShutdown(func() {
+		close(serverDone)
+	})
+	LogVerbosef("Started runing on %s\n", l.Addr())
+	if err := httpServer.Serve(l); err != http.ErrServerClosed {
+		LogErrorf("httpServer.Serve() failed with %s\n", err)
+	} else {
+		<-shutdownDone
 	}
+	removeStateFile()
 	LogVerbosef("Exited\n")
 }
+
+func startWebServer(s *Session) {
+	registerHandlers(s)
+	l, uri := listenHTTP()
+	if !flgPersist {
+		go watchClients(func(string) bool {
+			shutdownServer("all pages were closed")
+			return true
+		})
+	}
+
+	go func() {
+		time.Sleep(time.Second)
+		login := loginURL(uri, "/")
+		LogVerbosef("Opening browser with '%s'\n", login)
+		if err := openDefaultBrowser(login); err != nil {
+			fmt.Printf("Open %s in the browser\n", login)
+		}
+	}()
+	serveHTTP(l)
+}
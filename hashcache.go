@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// if not nil, we remember hashes of files compared in directory diffs
+	hashCache *fileHashCache
+)
+
+// files modified this recently might still change without changing
+// modification time, so we don't cache their hashes
+const racyModTimeWindow = 2 * time.Second
+
+// maxHashCacheEntries limits size of the cache file, an entry takes ~150
+// bytes
+const maxHashCacheEntries = 50000
+
+type hashCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Hash    string `json:"sha1"`
+}
+
+// fileHashCache remembers sha1 of file contents, keyed by absolute path.
+// An entry is only valid if size and modification time didn't change
+type fileHashCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]hashCacheEntry
+	// paths of entries used since differ started
+	seen  map[string]bool
+	dirty bool
+}
+
+func hashCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "differ", "hashes.json"), nil
+}
+
+// loadHashCache loads the cache from disk. A missing or invalid cache
+// file results in an empty cache
+func loadHashCache() (*fileHashCache, error) {
+	path, err := hashCachePath()
+	if err != nil {
+		return nil, err
+	}
+	c := &fileHashCache{
+		path:    path,
+		entries: make(map[string]hashCacheEntry),
+		seen:    make(map[string]bool),
+	}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, nil
+	}
+	if err = json.Unmarshal(d, &c.entries); err != nil {
+		LogErrorf("ignoring invalid hash cache '%s', json.Unmarshal() failed with '%s'\n", path, err)
+		c.entries = make(map[string]hashCacheEntry)
+	}
+	LogVerbosef("loaded %d hashes from '%s'\n", len(c.entries), path)
+	return c, nil
+}
+
+func sha1OfFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileHash returns sha1 of file content, from the cache if possible
+func (c *fileHashCache) fileHash(path string, fi FileInfo) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	modTime := fi.ModTime.UnixNano()
+	c.mu.Lock()
+	e, ok := c.entries[absPath]
+	ok = ok && e.Size == fi.Size && e.ModTime == modTime
+	if ok {
+		c.seen[absPath] = true
+	}
+	c.mu.Unlock()
+	if ok {
+		return e.Hash, nil
+	}
+
+	hash, err := sha1OfFile(path)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(fi.ModTime) < racyModTimeWindow {
+		return hash, nil
+	}
+	c.mu.Lock()
+	c.entries[absPath] = hashCacheEntry{
+		Size:    fi.Size,
+		ModTime: modTime,
+		Hash:    hash,
+	}
+	c.seen[absPath] = true
+	c.dirty = true
+	c.mu.Unlock()
+	return hash, nil
+}
+
+// trim removes entries of the smallest files, which are the fastest to
+// hash again, so that there are at most maxEntries
+func (c *fileHashCache) trim(maxEntries int) {
+	if len(c.entries) <= maxEntries {
+		return
+	}
+	paths := make([]string, 0, len(c.entries))
+	for path := range c.entries {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return c.entries[paths[i]].Size > c.entries[paths[j]].Size
+	})
+	for _, path := range paths[maxEntries:] {
+		delete(c.entries, path)
+	}
+	c.dirty = true
+}
+
+// save writes the cache to disk. filesInRoots maps a compared directory to
+// files in it. Only entries used since differ started are kept, minus
+// files in those directories that are not in filesInRoots because they no
+// longer exist (or are excluded)
+func (c *fileHashCache) save(filesInRoots map[string]map[string]FileInfo) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.entries {
+		if !c.seen[path] {
+			delete(c.entries, path)
+			c.dirty = true
+		}
+	}
+	for root, files := range filesInRoots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		prefix := absRoot + string(filepath.Separator)
+		for path := range c.entries {
+			if !strings.HasPrefix(path, prefix) {
+				continue
+			}
+			if _, exists := files[path[len(prefix):]]; !exists {
+				delete(c.entries, path)
+				delete(c.seen, path)
+				c.dirty = true
+			}
+		}
+	}
+	c.trim(maxHashCacheEntries)
+	if !c.dirty {
+		return nil
+	}
+
+	d, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	// paths of files can be private, so only the user can read the cache
+	if err = os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	// write to a temporary file first so that we never leave a partial cache
+	// (and a leftover one could have different permissions)
+	tmpPath := c.path + ".tmp"
+	os.Remove(tmpPath)
+	if err = ioutil.WriteFile(tmpPath, d, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	LogVerbosef("saved %d hashes to '%s'\n", len(c.entries), c.path)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHashCacheSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "differ-hashcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	writeTestFiles(t, root, map[string]string{"a.txt": "a\n", "b.txt": "b\n", "deleted.txt": "c\n"})
+	// hashes of recently modified files aren't cached
+	old := time.Now().Add(-time.Hour)
+	files := make(map[string]FileInfo)
+	for _, name := range []string{"a.txt", "b.txt", "deleted.txt"} {
+		path := filepath.Join(root, name)
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = FileInfo{Size: fi.Size(), ModTime: fi.ModTime()}
+	}
+
+	c := &fileHashCache{
+		path: filepath.Join(dir, "cache", "hashes.json"),
+		entries: map[string]hashCacheEntry{
+			// from a previous run
+			filepath.Join(dir, "other", "x.txt"): {Size: 1, Hash: "x"},
+		},
+		seen: make(map[string]bool),
+	}
+	for name, fi := range files {
+		if _, err := c.fileHash(filepath.Join(root, name), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delete(files, "deleted.txt")
+	if err := c.save(map[string]map[string]FileInfo{root: files}); err != nil {
+		t.Fatalf("save() failed with '%s'", err)
+	}
+
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// windows only has a read-only flag
+	if perm := fi.Mode().Perm(); perm != 0600 && runtime.GOOS != "windows" {
+		t.Errorf("cache has permissions %o", perm)
+	}
+	var loaded map[string]hashCacheEntry
+	d, err := ioutil.ReadFile(c.path)
+	if err == nil {
+		err = json.Unmarshal(d, &loaded)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for path := range loaded {
+		got = append(got, relPath(root, path))
+	}
+	sort.Strings(got)
+	if exp := []string{"a.txt", "b.txt"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("got entries %v, expected %v", got, exp)
+	}
+}
+
+func TestHashCacheTrim(t *testing.T) {
+	c := &fileHashCache{entries: make(map[string]hashCacheEntry)}
+	for i := 0; i < 10; i++ {
+		c.entries[fmt.Sprintf("f%d", i)] = hashCacheEntry{Size: int64(i)}
+	}
+	c.trim(3)
+	exp := map[string]hashCacheEntry{"f7": {Size: 7}, "f8": {Size: 8}, "f9": {Size: 9}}
+	if !reflect.DeepEqual(c.entries, exp) || !c.dirty {
+		t.Errorf("got %v, expected %v", c.entries, exp)
+	}
+}
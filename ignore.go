@@ -0,0 +1,247 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const differIgnoreFileName = ".differignore"
+
+// stringsFlag is a flag that can be given multiple times
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+var (
+	// gitignore-style patterns of files to exclude when comparing directories
+	excludePatterns stringsFlag
+	// if given, only files matching one of those patterns are compared
+	includePatterns stringsFlag
+	// if true, we honor .gitignore files in compared directories
+	useGitIgnore bool
+)
+
+// ignorePattern is a single pattern in gitignore syntax
+// See https://git-scm.com/docs/gitignore#_pattern_format
+type ignorePattern struct {
+	// directory of .gitignore file that defines the pattern, relative to
+	// the root and separated with /, "" for the root
+	base     string
+	segments []string
+	// anchored patterns (with / other than at the end) match relative to base,
+	// other patterns match the name of a file or directory at any level
+	anchored bool
+	dirOnly  bool
+	negate   bool
+}
+
+func parseIgnorePattern(base, s string) *ignorePattern {
+	s = strings.TrimRight(s, "\r")
+	if !strings.HasSuffix(s, "\\ ") {
+		s = strings.TrimRight(s, " ")
+	}
+	if s == "" || strings.HasPrefix(s, "#") {
+		return nil
+	}
+	p := &ignorePattern{base: base}
+	if strings.HasPrefix(s, "!") {
+		p.negate = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "\\!") || strings.HasPrefix(s, "\\#") {
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimRight(s, "/")
+	}
+	if s == "" {
+		return nil
+	}
+	p.anchored = strings.Contains(s, "/")
+	s = strings.TrimPrefix(s, "/")
+	p.segments = strings.Split(s, "/")
+	return p
+}
+
+// matchSegments matches path segments against pattern segments where
+// "**" matches any number of segments, except at the end where it matches
+// at least one, so that foo/** matches everything inside foo but not foo
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(segments) > 0
+		}
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], segments[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// matches returns true if pattern matches relPath, which is relative to
+// the root of compared directory and separated with /
+func (p *ignorePattern) matches(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(relPath, p.base+"/") {
+			return false
+		}
+		relPath = relPath[len(p.base)+1:]
+	}
+	if !p.anchored {
+		ok, err := path.Match(p.segments[0], path.Base(relPath))
+		return err == nil && ok
+	}
+	return matchSegments(p.segments, strings.Split(relPath, "/"))
+}
+
+// dirFilter decides which files and directories to skip when comparing 2
+// directories. Rules always apply to both directories so that an ignored
+// file doesn't show up as added or deleted
+type dirFilter struct {
+	roots []string
+
+	mu       sync.Mutex
+	excludes []*ignorePattern
+	includes []*ignorePattern
+	// directories (relative) whose .gitignore files we already read
+	loadedDirs map[string]bool
+}
+
+func newDirFilter(rootBefore, rootAfter string) *dirFilter {
+	f := &dirFilter{
+		roots:      []string{rootBefore, rootAfter},
+		loadedDirs: make(map[string]bool),
+	}
+	for _, s := range excludePatterns {
+		f.addPattern(&f.excludes, "", s)
+	}
+	for _, s := range includePatterns {
+		f.addPattern(&f.includes, "", s)
+	}
+	for _, root := range f.roots {
+		f.loadIgnoreFile(filepath.Join(root, differIgnoreFileName), "")
+	}
+	return f
+}
+
+func (f *dirFilter) addPattern(patterns *[]*ignorePattern, base, s string) {
+	if p := parseIgnorePattern(base, s); p != nil {
+		*patterns = append(*patterns, p)
+	}
+}
+
+// must be called with f.mu locked
+func (f *dirFilter) loadIgnoreFile(fileName, base string) {
+	d, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	LogVerbosef("using ignore rules from '%s'\n", fileName)
+	for _, l := range strings.Split(string(d), "\n") {
+		f.addPattern(&f.excludes, base, l)
+	}
+}
+
+// loadGitIgnore reads .gitignore files in relDir of both directories
+func (f *dirFilter) loadGitIgnore(relDir string) {
+	if !useGitIgnore || f.loadedDirs[relDir] {
+		return
+	}
+	f.loadedDirs[relDir] = true
+	for _, root := range f.roots {
+		f.loadIgnoreFile(filepath.Join(root, filepath.FromSlash(relDir), ".gitignore"), relDir)
+	}
+}
+
+func isExcluded(patterns []*ignorePattern, relPath string, isDir bool) bool {
+	excluded := false
+	// the last matching pattern decides
+	for _, p := range patterns {
+		if p.matches(relPath, isDir) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+// isGitDir returns true for .git directories, which we never compare, like
+// walkDirsToWatch never watches them
+func isGitDir(relPath string) bool {
+	return path.Base(relPath) == ".git"
+}
+
+// SkipDir returns true if directory (relative to the root of compared
+// directory) should not be descended into. As a side effect, it loads
+// .gitignore in dirs that are not skipped
+func (f *dirFilter) SkipDir(relDir string) bool {
+	relDir = filepath.ToSlash(relDir)
+	if isGitDir(relDir) {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if relDir != "" && isExcluded(f.excludes, relDir, true) {
+		return true
+	}
+	f.loadGitIgnore(relDir)
+	return false
+}
+
+// SkipFile returns true if a file (relative to the root of compared
+// directory) should not be compared
+func (f *dirFilter) SkipFile(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if isExcluded(f.excludes, relPath, false) {
+		return true
+	}
+	if len(f.includes) == 0 {
+		return false
+	}
+	for _, p := range f.includes {
+		if p.matches(relPath, false) {
+			return false
+		}
+	}
+	return true
+}
+
+// SkipWatchedDir is like SkipDir but for a path that includes the root
+func (f *dirFilter) SkipWatchedDir(dir string) bool {
+	for _, root := range f.roots {
+		if rel, err := filepath.Rel(root, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			if rel == "." {
+				rel = ""
+			}
+			return f.SkipDir(rel)
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		// not anchored patterns match names at any level
+		{[]string{"*.o"}, "a.o", false, true},
+		{[]string{"*.o"}, "dir/sub/a.o", false, true},
+		{[]string{"*.o"}, "a.c", false, false},
+		{[]string{"build"}, "build", true, true},
+		{[]string{"build"}, "src/build", true, true},
+		{[]string{"build"}, "src/build", false, true},
+		// directory only
+		{[]string{"build/"}, "build", true, true},
+		{[]string{"build/"}, "src/build", true, true},
+		{[]string{"build/"}, "build", false, false},
+		// anchored patterns match relative to the root
+		{[]string{"/build"}, "build", true, true},
+		{[]string{"/build"}, "src/build", true, false},
+		{[]string{"doc/*.txt"}, "doc/a.txt", false, true},
+		{[]string{"doc/*.txt"}, "doc/sub/a.txt", false, false},
+		{[]string{"doc/*.txt"}, "src/doc/a.txt", false, false},
+		// **
+		{[]string{"**/foo"}, "foo", false, true},
+		{[]string{"**/foo"}, "a/b/foo", false, true},
+		{[]string{"a/**/b"}, "a/b", false, true},
+		{[]string{"a/**/b"}, "a/x/y/b", false, true},
+		{[]string{"a/**/b"}, "x/a/b", false, false},
+		{[]string{"foo/**"}, "foo/a", false, true},
+		{[]string{"foo/**"}, "foo/a/b", true, true},
+		{[]string{"foo/**"}, "foo", true, false},
+		{[]string{"foo/**"}, "foo", false, false},
+		{[]string{"foo/**"}, "bar/foo/a", false, false},
+		// negation, the last matching pattern decides
+		{[]string{"*.log", "!keep.log"}, "a.log", false, true},
+		{[]string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{[]string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{[]string{"foo/**", "!foo/keep"}, "foo/keep", false, false},
+		{[]string{"foo/**", "!foo/keep"}, "foo/other", false, true},
+		// escapes, comments and trailing space
+		{[]string{`\!important`}, "!important", false, true},
+		{[]string{`\#hash`}, "#hash", false, true},
+		{[]string{"#comment"}, "#comment", false, false},
+		{[]string{"a.txt  "}, "a.txt", false, true},
+		{[]string{"a.txt\r"}, "a.txt", false, true},
+	}
+	for _, test := range tests {
+		var patterns []*ignorePattern
+		for _, s := range test.patterns {
+			if p := parseIgnorePattern("", s); p != nil {
+				patterns = append(patterns, p)
+			}
+		}
+		if got := isExcluded(patterns, test.path, test.isDir); got != test.excluded {
+			t.Errorf("%q, '%s' (dir: %v): got %v, expected %v", test.patterns, test.path, test.isDir, got, test.excluded)
+		}
+	}
+}
+
+func TestIgnorePatternBase(t *testing.T) {
+	// patterns of .gitignore in sub only apply inside sub
+	tests := []struct {
+		pattern  string
+		path     string
+		excluded bool
+	}{
+		{"*.o", "sub/a.o", true},
+		{"*.o", "sub/x/a.o", true},
+		{"*.o", "a.o", false},
+		{"/gen", "sub/gen", true},
+		{"/gen", "sub/x/gen", false},
+		{"/gen", "gen", false},
+		{"x/*.go", "sub/x/a.go", true},
+		{"x/*.go", "x/a.go", false},
+	}
+	for _, test := range tests {
+		p := parseIgnorePattern("sub", test.pattern)
+		if got := p.matches(test.path, false); got != test.excluded {
+			t.Errorf("'%s' in sub, '%s': got %v, expected %v", test.pattern, test.path, got, test.excluded)
+		}
+	}
+}
+
+func TestDirFilterSkipsGitDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "differ-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := newDirFilter(filepath.Join(dir, "a"), filepath.Join(dir, "b"))
+	for _, d := range []string{".git", "sub/.git"} {
+		if !f.SkipDir(d) {
+			t.Errorf("'%s' is not skipped", d)
+		}
+	}
+	for _, d := range []string{"", "sub", ".github", "x.git"} {
+		if f.SkipDir(d) {
+			t.Errorf("'%s' is skipped", d)
+		}
+	}
+}
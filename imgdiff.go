@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+
+	// register decoders for image.Decode()
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+var (
+	// maximum difference of a single color channel (0-255) for two pixels
+	// to still be considered the same
+	pdiffTolerance = 0
+
+	// color of differing pixels in the mask served by /pdiff/:idx, same as
+	// the color of the bounding box in the ui
+	pdiffMaskColor = color.NRGBA{R: 0xff, G: 0x69, B: 0xb4, A: 0xff}
+)
+
+// ImageBBox describes response for /pdiffbbox/:idx, which is a bounding box
+// of differing pixels. right and bottom are exclusive, so an empty box
+// (no differences) has width and height of 0
+type ImageBBox struct {
+	Top    int `json:"top"`
+	Left   int `json:"left"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func decodeImage(d []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(d))
+	return img, err
+}
+
+func channelDiff(c1, c2 uint32) int {
+	// RGBA() returns 16-bit channels, we compare 8-bit values
+	d := int(c1>>8) - int(c2>>8)
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func pixelsDiffer(c1, c2 color.Color, tolerance int) bool {
+	r1, g1, b1, a1 := c1.RGBA()
+	r2, g2, b2, a2 := c2.RGBA()
+	return channelDiff(r1, r2) > tolerance ||
+		channelDiff(g1, g2) > tolerance ||
+		channelDiff(b1, b2) > tolerance ||
+		channelDiff(a1, a2) > tolerance
+}
+
+// ImageInfo describes one side of an image diff, sent as image_a / image_b
+type ImageInfo struct {
+	Width    int `json:"width"`
+	Height   int `json:"height"`
+	NumBytes int `json:"num_bytes"`
+}
+
+// calcImageDiff returns a bounding box of pixels that differ between
+// img1 and img2 and the number of those pixels. Images must have the same size.
+// If mask is not nil, differing pixels are also painted in it
+func calcImageDiff(img1, img2 image.Image, tolerance int, mask *image.NRGBA) (*ImageBBox, int, error) {
+	r1 := img1.Bounds()
+	r2 := img2.Bounds()
+	if r1.Dx() != r2.Dx() || r1.Dy() != r2.Dy() {
+		return nil, 0, fmt.Errorf("images have different sizes (%dx%d vs. %dx%d)", r1.Dx(), r1.Dy(), r2.Dx(), r2.Dy())
+	}
+	nDiff := 0
+	minX, minY := r1.Dx(), r1.Dy()
+	maxX, maxY := -1, -1
+	for y := 0; y < r1.Dy(); y++ {
+		for x := 0; x < r1.Dx(); x++ {
+			c1 := img1.At(r1.Min.X+x, r1.Min.Y+y)
+			c2 := img2.At(r2.Min.X+x, r2.Min.Y+y)
+			if !pixelsDiffer(c1, c2, tolerance) {
+				continue
+			}
+			nDiff++
+			if mask != nil {
+				mask.SetNRGBA(x, y, pdiffMaskColor)
+			}
+			if x < minX {
+				minX = x
+			}
+			if x > maxX {
+				maxX = x
+			}
+			if y < minY {
+				minY = y
+			}
+			if y > maxY {
+				maxY = y
+			}
+		}
+	}
+	res := &ImageBBox{}
+	if maxX == -1 {
+		return res, 0, nil
+	}
+	res.Left = minX
+	res.Top = minY
+	res.Right = maxX + 1
+	res.Bottom = maxY + 1
+	res.Width = res.Right - res.Left
+	res.Height = res.Bottom - res.Top
+	return res, nDiff, nil
+}
+
+func decodeImages(before, after []byte) (image.Image, image.Image, error) {
+	img1, err := decodeImage(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	img2, err := decodeImage(after)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img1, img2, nil
+}
+
+func imageDiffBBox(before, after []byte) (*ImageBBox, error) {
+	img1, img2, err := decodeImages(before, after)
+	if err != nil {
+		return nil, err
+	}
+	bbox, _, err := calcImageDiff(img1, img2, pdiffTolerance, nil)
+	return bbox, err
+}
+
+// imageDiffMask returns a png image of the size of before and after images
+// where pixels that differ are painted and the rest is transparent
+func imageDiffMask(before, after []byte) ([]byte, error) {
+	img1, img2, err := decodeImages(before, after)
+	if err != nil {
+		return nil, err
+	}
+	r := img1.Bounds()
+	mask := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	if _, _, err = calcImageDiff(img1, img2, pdiffTolerance, mask); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, mask); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func imageInfo(img image.Image, d []byte) *ImageInfo {
+	r := img.Bounds()
+	return &ImageInfo{
+		Width:    r.Dx(),
+		Height:   r.Dy(),
+		NumBytes: len(d),
+	}
+}
+
+// fillImageDiffInfo decodes both sides of an image diff and sets image
+// dimensions and pixel comparison results in info
+func fillImageDiffInfo(info *contentsInfo, path string, fc *fileContents) {
+	var img1, img2 image.Image
+	var err error
+	if fc.before != nil {
+		if img1, err = decodeImage(fc.before); err != nil {
+			LogErrorf("decodeImage() of '%s' failed with '%s'\n", path, err)
+			return
+		}
+		info.ImageBefore = imageInfo(img1, fc.before)
+	}
+	if fc.after != nil {
+		if img2, err = decodeImage(fc.after); err != nil {
+			LogErrorf("decodeImage() of '%s' failed with '%s'\n", path, err)
+			return
+		}
+		info.ImageAfter = imageInfo(img2, fc.after)
+	}
+	if img1 == nil || img2 == nil {
+		return
+	}
+	if info.ImageBefore.Width != info.ImageAfter.Width || info.ImageBefore.Height != info.ImageAfter.Height {
+		return
+	}
+	_, nDiff, err := calcImageDiff(img1, img2, pdiffTolerance, nil)
+	if err != nil {
+		return
+	}
+	info.DiffPixels = nDiff
+	info.AreSamePixels = nDiff == 0
+	if nPixels := info.ImageBefore.Width * info.ImageBefore.Height; nPixels > 0 {
+		info.DiffPixelsPercent = float64(nDiff) * 100 / float64(nPixels)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// we don't diff within lines that have more tokens because it's slow:
+	// Myers diff is O(N*D) and lines of minified files can differ in most
+	// places. Longer lines only get the part between common prefix and
+	// suffix diffed, if it's short enough
+	maxIntraLineTokens = 1000
+	// like codediff.js, we don't highlight changes within lines that have
+	// less than half of the text in common, unless only whitespace changed
+	minIntraLineEqualPercent = 50
+)
+
+// DiffSpan is a changed part of a line. Start and End are offsets in
+// characters (not bytes). Op is "delete" in lines before and "insert" in
+// lines after
+type DiffSpan struct {
+	Op    string `json:"op"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// tokenize splits a line into identifiers, numbers, runs of whitespace and
+// single punctuation characters. Tokens concatenated are the line
+func tokenize(s string) []string {
+	var res []string
+	for len(s) > 0 {
+		r, n := utf8.DecodeRuneInString(s)
+		var isPart func(rune) bool
+		switch {
+		case unicode.IsSpace(r):
+			isPart = unicode.IsSpace
+		case unicode.IsDigit(r):
+			// also covers 0x1f, 1.5e10 and 1_000
+			isPart = func(r rune) bool {
+				return r == '.' || isIdentRune(r)
+			}
+		case isIdentRune(r):
+			isPart = isIdentRune
+		}
+		if isPart != nil {
+			for n < len(s) {
+				r, size := utf8.DecodeRuneInString(s[n:])
+				if !isPart(r) {
+					break
+				}
+				n += size
+			}
+		}
+		res = append(res, s[:n])
+		s = s[n:]
+	}
+	return res
+}
+
+// splitRunes splits a line into single characters
+func splitRunes(s string) []string {
+	var res []string
+	for _, r := range s {
+		res = append(res, string(r))
+	}
+	return res
+}
+
+// diffLongTokens diffs tokens of lines too long for diffLines. Common prefix
+// and suffix are equal and the rest is diffed if short enough or otherwise
+// shown as a single changed chunk
+func diffLongTokens(before, after []string) []DiffOp {
+	nA, nB := len(before), len(after)
+	prefix := 0
+	for prefix < nA && prefix < nB && before[prefix] == after[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < nA-prefix && suffix < nB-prefix && before[nA-1-suffix] == after[nB-1-suffix] {
+		suffix++
+	}
+	var matches []diffMatch
+	if prefix > 0 {
+		matches = append(matches, diffMatch{0, 0, prefix})
+	}
+	midBefore, midAfter := before[prefix:nA-suffix], after[prefix:nB-suffix]
+	if len(midBefore)+len(midAfter) <= maxIntraLineTokens {
+		for _, op := range diffLines(midBefore, midAfter, DiffAlgorithmMyers, nil) {
+			if op.Op == OpEqual {
+				matches = append(matches, diffMatch{prefix + op.BeforeStart, prefix + op.AfterStart, op.BeforeEnd - op.BeforeStart})
+			}
+		}
+	}
+	if suffix > 0 {
+		matches = append(matches, diffMatch{nA - suffix, nB - suffix, suffix})
+	}
+	return matchesToOps(matches, nA, nB)
+}
+
+// diffTokens diffs tokens of 2 lines and returns changed parts of both
+// lines, or nil if lines are too different for this to be useful
+func diffTokens(before, after []string) ([]DiffSpan, []DiffSpan) {
+	var ops []DiffOp
+	if len(before)+len(after) > maxIntraLineTokens {
+		ops = diffLongTokens(before, after)
+	} else {
+		ops = diffLines(before, after, DiffAlgorithmMyers, nil)
+	}
+	// offsets of tokens in characters
+	offsets := func(tokens []string) []int {
+		res := make([]int, len(tokens)+1)
+		for i, t := range tokens {
+			res[i+1] = res[i] + utf8.RuneCountInString(t)
+		}
+		return res
+	}
+	offBefore, offAfter := offsets(before), offsets(after)
+
+	var spansBefore, spansAfter []DiffSpan
+	nEqual := 0
+	onlyWhitespace := true
+	addSpan := func(spans []DiffSpan, op string, tokens []string, off []int, start, end int) []DiffSpan {
+		if start == end {
+			return spans
+		}
+		if strings.TrimSpace(strings.Join(tokens[start:end], "")) != "" {
+			onlyWhitespace = false
+		}
+		return append(spans, DiffSpan{op, off[start], off[end]})
+	}
+	for _, op := range ops {
+		if op.Op == OpEqual {
+			nEqual += 2 * (offBefore[op.BeforeEnd] - offBefore[op.BeforeStart])
+			continue
+		}
+		spansBefore = addSpan(spansBefore, OpDelete, before, offBefore, op.BeforeStart, op.BeforeEnd)
+		spansAfter = addSpan(spansAfter, OpInsert, after, offAfter, op.AfterStart, op.AfterEnd)
+	}
+	nTotal := offBefore[len(before)] + offAfter[len(after)]
+	if !onlyWhitespace && nEqual*100 < nTotal*minIntraLineEqualPercent {
+		return nil, nil
+	}
+	return spansBefore, spansAfter
+}
+
+// addIntraLineSpans sets word and character level changes of a line that
+// was replaced with another line
+func addIntraLineSpans(before, after *DiffLine) {
+	before.WordSpans, after.WordSpans = diffTokens(tokenize(before.Text), tokenize(after.Text))
+	before.CharSpans, after.CharSpans = diffTokens(splitRunes(before.Text), splitRunes(after.Text))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntraLineSpansLongLine(t *testing.T) {
+	// a minified file is a single line with many more tokens than
+	// maxIntraLineTokens
+	head := strings.Repeat("a=b+1;", maxIntraLineTokens/2)
+	tail := strings.Repeat("c(d);", maxIntraLineTokens/2)
+	before := &DiffLine{Text: head + "foo(1);" + tail}
+	after := &DiffLine{Text: head + "bar(1,2);" + tail}
+	addIntraLineSpans(before, after)
+
+	start := len(head)
+	expWordBefore := []DiffSpan{{OpDelete, start, start + 3}}
+	expWordAfter := []DiffSpan{{OpInsert, start, start + 3}, {OpInsert, start + 5, start + 7}}
+	if !reflect.DeepEqual(before.WordSpans, expWordBefore) || !reflect.DeepEqual(after.WordSpans, expWordAfter) {
+		t.Errorf("word spans: got %v, %v, expected %v, %v", before.WordSpans, after.WordSpans, expWordBefore, expWordAfter)
+	}
+	expCharBefore := []DiffSpan{{OpDelete, start, start + 3}}
+	expCharAfter := []DiffSpan{{OpInsert, start, start + 3}, {OpInsert, start + 5, start + 7}}
+	if !reflect.DeepEqual(before.CharSpans, expCharBefore) || !reflect.DeepEqual(after.CharSpans, expCharAfter) {
+		t.Errorf("char spans: got %v, %v, expected %v, %v", before.CharSpans, after.CharSpans, expCharBefore, expCharAfter)
+	}
+}
+
+func TestIntraLineSpansLongChange(t *testing.T) {
+	// when the changed part itself is too long, it's a single chunk
+	common := strings.Repeat("x;", maxIntraLineTokens)
+	before := &DiffLine{Text: common + strings.Repeat("a+", maxIntraLineTokens*3/4) + common}
+	after := &DiffLine{Text: common + strings.Repeat("b-", maxIntraLineTokens/4) + common}
+	addIntraLineSpans(before, after)
+
+	start := len(common)
+	expBefore := []DiffSpan{{OpDelete, start, start + 2*maxIntraLineTokens*3/4}}
+	expAfter := []DiffSpan{{OpInsert, start, start + 2*maxIntraLineTokens/4}}
+	if !reflect.DeepEqual(before.CharSpans, expBefore) || !reflect.DeepEqual(after.CharSpans, expAfter) {
+		t.Errorf("got %v, %v, expected %v, %v", before.CharSpans, after.CharSpans, expBefore, expAfter)
+	}
+}
+
+func TestDiffLongMinifiedLines(t *testing.T) {
+	// ~10k characters long lines of minified files changed in many places
+	// used to take seconds to diff within lines
+	rnd := rand.New(rand.NewSource(1))
+	var before, after []string
+	for i := 0; i < 10; i++ {
+		var b, a []string
+		for j := 0; j < 1200; j++ {
+			tok := fmt.Sprintf("v%x=%x;", rnd.Intn(4096), rnd.Intn(4096))
+			b = append(b, tok)
+			if j%2 == 0 {
+				tok = fmt.Sprintf("v%x=%x;", rnd.Intn(4096), rnd.Intn(4096))
+			}
+			a = append(a, tok)
+		}
+		before = append(before, strings.Join(b, ""))
+		after = append(after, strings.Join(a, ""))
+	}
+	opts := diffOptions{Algorithm: DiffAlgorithmMyers, Context: diffContext}
+	start := time.Now()
+	res := computeDiff([]byte(strings.Join(before, "\n")), []byte(strings.Join(after, "\n")), opts)
+	if dur := time.Since(start); dur > time.Second {
+		t.Errorf("diffing took %s", dur)
+	}
+	if len(res.Hunks) != 1 || len(res.Hunks[0].Lines) != 20 {
+		t.Errorf("expected a single hunk with 20 lines, got %d hunks", len(res.Hunks))
+	}
+}
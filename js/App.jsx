@@ -16,7 +16,7 @@ export var App = React.createClass({
 
 export var routes = (
   <Route handler={App}>
-    <Route name="pair" path="/:index?" handler={makeRoot(pairs, initialIdx)} />
+    <Route name="pair" path={BASE_URL + "/:index?"} handler={makeRoot(pairs, initialIdx)} />
   </Route>
 );
 
@@ -13,8 +13,23 @@ var differ = function(beforeText, afterText, userParams) {
 
   this.beforeLines = beforeText ? difflib.stringAsLines(beforeText) : [];
   this.afterLines = afterText ? difflib.stringAsLines(afterText) : [];
-  var sm = new difflib.SequenceMatcher(this.beforeLines, this.afterLines);
-  var opcodes = sm.get_opcodes();
+
+  // Opcodes can be computed by the server, which is much faster for big files.
+  // The server doesn't count the newline at the end of a file as a line.
+  var opcodes = this.params.opcodes;
+  if (opcodes) {
+    differ.dropTrailingEmptyLine_(this.beforeLines);
+    differ.dropTrailingEmptyLine_(this.afterLines);
+    if (!differ.opcodesCoverLines_(opcodes, this.beforeLines.length, this.afterLines.length)) {
+      opcodes = null;
+    }
+  }
+  // Changed words computed by the server only match its opcodes.
+  this.intraLineSpans = opcodes ? this.params.intraLineSpans : null;
+  if (!opcodes) {
+    var sm = new difflib.SequenceMatcher(this.beforeLines, this.afterLines);
+    opcodes = sm.get_opcodes();
+  }
 
   // TODO: don't store the diff ranges -- they're only used once in buildView.
   this.diffRanges = differ.opcodesToDiffRanges(
@@ -28,6 +43,24 @@ var differ = function(beforeText, afterText, userParams) {
   // TODO: from this point on language shouldn't need to be used.
 };
 
+differ.dropTrailingEmptyLine_ = function(lines) {
+  if (lines.length > 1 && lines[lines.length - 1] === '') {
+    lines.pop();
+  }
+};
+
+// Returns true if opcodes describe exactly numBefore and numAfter lines.
+differ.opcodesCoverLines_ = function(opcodes, numBefore, numAfter) {
+  var i = 0, j = 0;
+  for (var k = 0; k < opcodes.length; k++) {
+    var op = opcodes[k];
+    if (op[1] != i || op[3] != j) return false;
+    i = op[2];
+    j = op[4];
+  }
+  return i == numBefore && j == numAfter;
+};
+
 differ.prototype.maxLineNumber = function() {
   return Math.max(this.beforeLines.length, this.afterLines.length);
 };
@@ -167,9 +200,10 @@ differ.prototype.attachHandlers_ = function(el) {
 };
 
 /**
- * Create a single row in the table. Adds character diffs if required.
+ * Create a single row in the table. Adds character diffs if required, using
+ * codes from the server if given.
  */
-differ.buildRowTr_ = function(type, beforeLineNum, beforeTextOrHtml, afterLineNum, afterTextOrHtml, language) {
+differ.buildRowTr_ = function(type, beforeLineNum, beforeTextOrHtml, afterLineNum, afterTextOrHtml, language, opt_codes) {
   var $makeCodeTd = function(textOrHtml) {
     if (textOrHtml == null) {
       return $('<td class="empty code">');
@@ -191,7 +225,7 @@ differ.buildRowTr_ = function(type, beforeLineNum, beforeTextOrHtml, afterLineNu
     $('<td class=line-no>').text(afterLineNum || '').get(0)
   ];
   if (type == 'replace') {
-    differ.addCharacterDiffs_(cells[1], cells[2], language);
+    differ.addCharacterDiffs_(cells[1], cells[2], opt_codes);
   }
 
   return $('<tr>').append(cells).get(0);
@@ -243,13 +277,19 @@ differ.prototype.buildView_ = function() {
       for (var j = 0; j < numRows; j++) {
         var beforeIdx = (j < numBeforeRows) ? range.before[0] + j : null,
             afterIdx = (j < numAfterRows) ? range.after[0] + j : null;
+        var codes;
+        if (type == 'replace' && this.intraLineSpans &&
+            beforeIdx != null && afterIdx != null) {
+          codes = this.serverCharacterDiffs_(beforeIdx, afterIdx);
+        }
         $table.append(differ.buildRowTr_(
             type,
             (beforeIdx != null) && 1 + beforeIdx,
             beforeLines[beforeIdx],
             (afterIdx != null) && 1 + afterIdx,
             afterLines[afterIdx],
-            language));
+            language,
+            codes));
       }
     }
   }
@@ -544,11 +584,73 @@ differ.computeCharacterDiffs_ = function(beforeText, afterText) {
 };
 
 
-// Add character-by-character diffs to a row (if appropriate).
-differ.addCharacterDiffs_ = function(beforeCell, afterCell) {
+/**
+ * Returns offsets in the text of a cell of every character (code point) of
+ * a line, plus its end. The server counts characters, the cell text counts
+ * UTF-16 code units and has tabs expanded to 4 spaces.
+ * @param {string} line
+ * @return {!Array.<number>}
+ */
+differ.lineOffsetsToCellOffsets_ = function(line) {
+  var offsets = [0], off = 0;
+  for (var i = 0; i < line.length; i++) {
+    var c = line.charCodeAt(i);
+    if (c >= 0xd800 && c < 0xdc00 && i + 1 < line.length) {
+      // a surrogate pair is a single character
+      i++;
+      off += 2;
+    } else {
+      off += line[i] == '\t' ? 4 : 1;
+    }
+    offsets.push(off);
+  }
+  return offsets;
+};
+
+/**
+ * Converts changed parts of a line from the server ({op, start, end} with
+ * offsets in characters) to codes like computeCharacterDiffs_ returns.
+ * @param {string} line
+ * @param {Array.<Object>} spans
+ * @return {!Array.<Array>} (span class, start, end) triples covering the
+ *     whole text of the line's cell.
+ */
+differ.spansToCodes_ = function(line, spans) {
+  var offsets = differ.lineOffsetsToCellOffsets_(line);
+  var end = offsets[offsets.length - 1];
+  var at = function(i) {
+    return offsets[Math.min(i, offsets.length - 1)];
+  };
+  var codes = [], pos = 0;
+  spans.forEach(function(span) {
+    var start = at(span.start), limit = at(span.end);
+    if (start > pos) codes.push([null, pos, start]);
+    codes.push([span.op, start, limit]);
+    pos = limit;
+  });
+  if (pos < end) codes.push([null, pos, end]);
+  return codes;
+};
+
+/**
+ * Returns codes for a pair of replaced lines from changed words computed by
+ * the server, or null if the server didn't find them useful.
+ */
+differ.prototype.serverCharacterDiffs_ = function(beforeIdx, afterIdx) {
+  var before = this.intraLineSpans.before[beforeIdx + 1],
+      after = this.intraLineSpans.after[afterIdx + 1];
+  if (!before && !after) return null;
+  return [differ.spansToCodes_(this.beforeLines[beforeIdx], before || []),
+          differ.spansToCodes_(this.afterLines[afterIdx], after || [])];
+};
+
+// Add character-by-character diffs to a row (if appropriate). codes are
+// computed here unless given, null means no diffs.
+differ.addCharacterDiffs_ = function(beforeCell, afterCell, opt_codes) {
   var beforeText = $(beforeCell).text(),
       afterText = $(afterCell).text();
-  var codes = differ.computeCharacterDiffs_(beforeText, afterText);
+  var codes = opt_codes !== undefined ? opt_codes :
+      differ.computeCharacterDiffs_(beforeText, afterText);
   if (codes == null) return;
   beforeOut = codes[0];
   afterOut = codes[1];
@@ -1,6 +1,6 @@
 /**
  * React components for webdiff.
- * Depends on image.jsx.
+ * Depends on image.jsx and conflict.jsx.
  */
 'use strict';
 
@@ -8,6 +8,7 @@ import React from 'react';
 import ReactRouter from 'react-router';
 
 import { ImageDiff, PDIFF_MODE, IMAGE_DIFF_MODES } from './image.jsx';
+import { ConflictView } from './conflict.jsx';
 import { filePairDisplayName, isSameSizeImagePair } from './util.js';
 
 // Webdiff application root.
@@ -19,10 +20,18 @@ export var makeRoot = function(filePairs, initiallySelectedIndex) {
       params: React.PropTypes.object
     },
     mixins: [ReactRouter.Navigation, ReactRouter.State],
-    getInitialState: () => ({
-      imageDiffMode: 'side-by-side',
-      pdiffMode: PDIFF_MODE.OFF
-    }),
+    getInitialState: function() {
+      return {
+        imageDiffMode: 'side-by-side',
+        pdiffMode: PDIFF_MODE.OFF,
+        view: 'all',
+        // updated by the server when files change on disk
+        filePairs: this.props.filePairs,
+        generation: initialGeneration,
+        // which whitespace differences to ignore, defaults set by flags
+        whitespace: WHITESPACE_OPTIONS
+      };
+    },
     getDefaultProps: function() {
       return {filePairs, initiallySelectedIndex};
     },
@@ -34,6 +43,25 @@ export var makeRoot = function(filePairs, initiallySelectedIndex) {
       if (idx == null) idx = this.props.initiallySelectedIndex;
       return Number(idx);
     },
+    // File pairs shown in the current view ('all', 'staged' or 'unstaged').
+    getVisiblePairs: function() {
+      var view = this.state.view;
+      return this.state.filePairs.filter(fp => view == 'all' || fp.view == view);
+    },
+    changeViewHandler: function(view) {
+      this.setState({view}, () => {
+        var pairs = this.getVisiblePairs();
+        var idx = this.getIndex();
+        if (pairs.length > 0 && !pairs.some(fp => fp.idx == idx)) {
+          this.selectIndex(pairs[0].idx);
+        }
+      });
+    },
+    changeWhitespaceHandler: function(whitespace) {
+      // whether a change is meaningful depends on the options
+      getThickDiff.cache = [];
+      this.setState({whitespace});
+    },
     changeImageDiffModeHandler: function(mode) {
       this.setState({imageDiffMode: mode});
     },
@@ -41,9 +69,9 @@ export var makeRoot = function(filePairs, initiallySelectedIndex) {
       this.setState({pdiffMode});
     },
     computePerceptualDiffBox: function() {
-      var fp = this.props.filePairs[this.getIndex()];
+      var fp = this.state.filePairs[this.getIndex()];
       if (!fp.is_image_diff || !isSameSizeImagePair(fp)) return;
-      $.getJSON(`/pdiffbbox/${this.getIndex()}`)
+      $.getJSON(`${BASE_URL}/pdiffbbox/${this.getIndex()}`)
           .done(bbox => {
             if (!fp.diffData) fp.diffData = {};
             fp.diffData.diffBounds = bbox;
@@ -52,17 +80,55 @@ export var makeRoot = function(filePairs, initiallySelectedIndex) {
             console.error(error);
           });
     },
+    // The server only knows some things (e.g. if images have the same pixels)
+    // after loading the files, so we update the list with the thick diff.
+    thickDiffLoaded: function(thickFilePair) {
+      var fp = _.find(this.state.filePairs, fp => fp.idx == thickFilePair.idx);
+      if (!fp) return;
+      _.extend(fp, thickFilePair);
+      this.forceUpdate();
+    },
+    // Called when the server rebuilds the list of changes.
+    onChanges: function(e) {
+      var data = JSON.parse(e.data);
+      var pairs = data.pairs || [];
+      // contents of any file might have changed
+      getThickDiff.cache = [];
+      this.setState({filePairs: pairs, generation: data.generation});
+      if (pairs.length > 0 && this.getIndex() >= pairs.length) {
+        this.selectIndex(pairs.length - 1);
+      }
+    },
+    // Called when the server has compared images of the list of changes.
+    onImages: function(e) {
+      var data = JSON.parse(e.data);
+      if (data.generation != this.state.generation) return;
+      (data.pairs || []).forEach(this.thickDiffLoaded);
+    },
     render: function() {
       var idx = this.getIndex(),
-          filePair = this.props.filePairs[idx];
+          filePair = this.state.filePairs[idx];
+
+      if (!filePair) {
+        return <div className="no-changes">There are no changes!</div>;
+      }
 
       return (
         <div>
+          <ViewSelector filePairs={this.state.filePairs}
+                        view={this.state.view}
+                        changeViewHandler={this.changeViewHandler} />
+          <WhitespaceSelector whitespace={this.state.whitespace}
+                              changeHandler={this.changeWhitespaceHandler} />
           <FileSelector selectedFileIndex={idx}
-                        filePairs={this.props.filePairs}
+                        filePairs={this.getVisiblePairs()}
                         fileChangeHandler={this.selectIndex} />
-          <DiffView key={'diff-' + idx}
+          <DiffView key={'diff-' + idx + '-' + this.state.generation + '-' +
+                         JSON.stringify(this.state.whitespace)}
                     thinFilePair={filePair}
+                    whitespace={this.state.whitespace}
+                    fileChangeHandler={this.selectIndex}
+                    thickDiffLoaded={this.thickDiffLoaded}
                     imageDiffMode={this.state.imageDiffMode}
                     pdiffMode={this.state.pdiffMode}
                     changeImageDiffModeHandler={this.changeImageDiffModeHandler}
@@ -71,16 +137,23 @@ export var makeRoot = function(filePairs, initiallySelectedIndex) {
       );
     },
     componentDidMount: function() {
+      if (window.EventSource) {
+        this.events = new EventSource(BASE_URL + '/events');
+        this.events.addEventListener('changes', this.onChanges);
+        this.events.addEventListener('images', this.onImages);
+      }
       $(document).on('keydown', (e) => {
         if (!isLegitKeypress(e)) return;
         var idx = this.getIndex();
+        var pairs = this.getVisiblePairs();
+        var pos = _.findIndex(pairs, fp => fp.idx == idx);
         if (e.keyCode == 75) {  // j
-          if (idx > 0) {
-            this.selectIndex(idx - 1);
+          if (pos > 0) {
+            this.selectIndex(pairs[pos - 1].idx);
           }
         } else if (e.keyCode == 74) {  // k
-          if (idx < this.props.filePairs.length - 1) {
-            this.selectIndex(idx + 1);
+          if (pos < pairs.length - 1) {
+            this.selectIndex(pairs[pos + 1].idx);
           }
         } else if (e.keyCode == 83) {  // s
           this.setState({imageDiffMode: 'side-by-side'});
@@ -96,6 +169,66 @@ export var makeRoot = function(filePairs, initiallySelectedIndex) {
   });
 };
 
+// A widget to toggle between staged, unstaged or all changes. Only shown
+// when comparing the working tree and there are both kinds of changes.
+var ViewSelector = React.createClass({
+  propTypes: {
+    filePairs: React.PropTypes.array.isRequired,
+    view: React.PropTypes.oneOf(['all', 'staged', 'unstaged']).isRequired,
+    changeViewHandler: React.PropTypes.func.isRequired
+  },
+  render: function() {
+    var views = _.uniq(this.props.filePairs.map(fp => fp.view).filter(v => v));
+    if (views.length < 2) {
+      return null;
+    }
+
+    var linkOrB = (val, text) => {
+      if (val == this.props.view) {
+        return <b>{text}</b>;
+      }
+      return <a href='#' onClick={this.handleClick} value={val}>{text}</a>;
+    };
+    return <div className="view-selector">
+      <span className="mode">{linkOrB('all', 'All')}</span>
+      <span className="mode">{linkOrB('staged', 'Staged')}</span>
+      <span className="mode">{linkOrB('unstaged', 'Unstaged')}</span>
+    </div>;
+  },
+  handleClick: function(e) {
+    e.preventDefault();
+    this.props.changeViewHandler($(e.currentTarget).attr('value'));
+  }
+});
+
+// Checkboxes for whitespace differences to ignore in text diffs.
+var WhitespaceSelector = React.createClass({
+  propTypes: {
+    whitespace: React.PropTypes.object.isRequired,
+    changeHandler: React.PropTypes.func.isRequired
+  },
+  render: function() {
+    var checkbox = (name, text) =>
+      <label className="mode">
+        <input type="checkbox" name={name}
+               checked={this.props.whitespace[name]}
+               onChange={this.handleChange} /> {text}
+      </label>;
+    return <div className="whitespace-selector">
+      Ignore:
+      {checkbox('ignore_all_space', 'all whitespace')}
+      {checkbox('ignore_space_change', 'whitespace changes')}
+      {checkbox('ignore_blank_lines', 'blank lines')}
+      {checkbox('ignore_eol', 'line endings')}
+    </div>;
+  },
+  handleChange: function(e) {
+    var whitespace = _.clone(this.props.whitespace);
+    whitespace[e.target.name] = e.target.checked;
+    this.props.changeHandler(whitespace);
+  }
+});
+
 // Shows a list of files in one of two possible modes (list or dropdown).
 var FileSelector = React.createClass({
   propTypes: {
@@ -166,7 +299,8 @@ var FileList = React.createClass({
   },
   render: function() {
     var props = this.props;
-    var lis = this.props.filePairs.map((filePair, idx) => {
+    var lis = this.props.filePairs.map(filePair => {
+      var idx = filePair.idx;
       var displayName = filePairDisplayName(filePair);
       var content;
       if (idx != props.selectedIndex) {
@@ -175,9 +309,12 @@ var FileList = React.createClass({
       } else {
         content = <b>{displayName}</b>;
       }
+      var view = filePair.view ? <span className="view">({filePair.view})</span> : null;
       return <li key={idx}>
         <span title={filePair.type} className={'diff ' + filePair.type}/>
         {content}
+        {view}
+        <ImageChangeSummary filePair={filePair} />
       </li>;
     });
     return <ul className="file-list">{lis}</ul>;
@@ -187,6 +324,27 @@ var FileList = React.createClass({
   }
 });
 
+// A short note next to an image in the file list, telling if its pixels
+// changed and by how much.
+var ImageChangeSummary = React.createClass({
+  propTypes: {
+    filePair: React.PropTypes.object.isRequired
+  },
+  render: function() {
+    var fp = this.props.filePair;
+    if (!fp.is_image_diff || fp.no_changes || !isSameSizeImagePair(fp)) {
+      return null;
+    }
+    if (fp.are_same_pixels) {
+      return <span className="image-change-summary">(same pixels)</span>;
+    }
+    var pct = fp.diff_pixels_percent.toFixed(2);
+    return <span className="image-change-summary">
+      ({fp.diff_pixels.toLocaleString()} pixels, {pct}%)
+    </span>;
+  }
+});
+
 // A list of files in a dropdown menu. This is more compact with many files.
 var FileDropdown = React.createClass({
   propTypes: {
@@ -197,21 +355,24 @@ var FileDropdown = React.createClass({
   render: function() {
     var props = this.props;
 
-    var linkOrNone = (idx) => {
-      if (idx < 0 || idx >= props.filePairs.length) {
+    // position of the selected file in the list, which might be filtered
+    var pos = _.findIndex(props.filePairs, fp => fp.idx == props.selectedIndex);
+    var linkOrNone = (pos) => {
+      if (pos < 0 || pos >= props.filePairs.length) {
         return <i>none</i>;
       } else {
-        return <a href='#' data-idx={idx} onClick={this.handleLinkClick}>
-          {filePairDisplayName(props.filePairs[idx])}
+        var filePair = props.filePairs[pos];
+        return <a href='#' data-idx={filePair.idx} onClick={this.handleLinkClick}>
+          {filePairDisplayName(filePair)}
         </a>;
       }
     };
 
-    var prevLink = linkOrNone(props.selectedIndex - 1);
-    var nextLink = linkOrNone(props.selectedIndex + 1);
+    var prevLink = linkOrNone(pos - 1);
+    var nextLink = linkOrNone(pos + 1);
 
-    var options = this.props.filePairs.map((filePair, idx) =>
-      <option key={idx} value={idx}>{filePairDisplayName(filePair)} ({filePair.type})</option>);
+    var options = this.props.filePairs.map(filePair =>
+      <option key={filePair.idx} value={filePair.idx}>{filePairDisplayName(filePair)} ({filePair.are_same_pixels ? 'same pixels' : filePair.type})</option>);
 
     return <div className="file-dropdown">
       Prev (k): {prevLink}<br/>
@@ -233,6 +394,9 @@ var FileDropdown = React.createClass({
 var DiffView = React.createClass({
   propTypes: {
     thinFilePair: React.PropTypes.object.isRequired,
+    thickDiffLoaded: React.PropTypes.func,
+    whitespace: React.PropTypes.object,
+    fileChangeHandler: React.PropTypes.func,
     imageDiffMode: React.PropTypes.oneOf(IMAGE_DIFF_MODES).isRequired,
     pdiffMode: React.PropTypes.number,
     changeImageDiffModeHandler: React.PropTypes.func.isRequired,
@@ -244,9 +408,12 @@ var DiffView = React.createClass({
     return {filePair: null};
   },
   componentDidMount: function() {
-    getThickDiff(this.props.thinFilePair.idx).done(filePair => {
+    getThickDiff(this.props.thinFilePair.idx, this.props.whitespace).done(filePair => {
       filePair.idx = this.props.thinFilePair.idx;
       this.setState({filePair});
+      if (this.props.thickDiffLoaded) {
+        this.props.thickDiffLoaded(filePair);
+      }
     });
   },
   render: function() {
@@ -255,10 +422,14 @@ var DiffView = React.createClass({
       return <div>Loading…</div>;
     }
 
-    if (filePair.is_image_diff) {
+    if (filePair.is_conflict) {
+      return <ConflictView filePair={filePair} />;
+    } else if (filePair.is_image_diff) {
       return <ImageDiff filePair={filePair} {...this.props} />;
     } else {
-      return <CodeDiff filePair={filePair} />;
+      return <CodeDiff filePair={filePair}
+                       whitespace={this.props.whitespace}
+                       fileChangeHandler={this.props.fileChangeHandler} />;
     }
   }
 });
@@ -272,6 +443,8 @@ var NoChanges = React.createClass({
     var fp = this.props.filePair;
     if (fp.no_changes) {
       return <div className="no-changes">(File content is identical)</div>;
+    } else if (fp.no_meaningful_changes) {
+      return <div className="no-changes">(No meaningful changes, files only differ in ignored whitespace)</div>;
     } else if (fp.is_image_diff && fp.are_same_pixels) {
       return <div className="no-changes">Pixels are the same, though file content differs (perhaps the headers are different?)</div>;
     } else {
@@ -283,7 +456,9 @@ var NoChanges = React.createClass({
 // A side-by-side diff of source code.
 var CodeDiff = React.createClass({
   propTypes: {
-    filePair: React.PropTypes.object.isRequired
+    filePair: React.PropTypes.object.isRequired,
+    whitespace: React.PropTypes.object,
+    fileChangeHandler: React.PropTypes.func
   },
   render: function() {
     return (
@@ -296,28 +471,55 @@ var CodeDiff = React.createClass({
   renderDiff: function() {
     // Either side can be empty (i.e. an add or a delete), in which case
     // getOrNull returns an empty Deferred object.
-    var getOrNull = (side, path) =>
-        path ? $.post('/' + side + '/get_contents', {path: path}) : [null];
     var pair = this.props.filePair;
+    var getOrNull = (side, path) =>
+        path ? $.post(BASE_URL + '/' + side + '/get_contents', {idx: pair.idx}) : [null];
 
-    // Do XHRs for the contents of both sides in parallel and fill in the diff.
+    // Do XHRs for the contents of both sides and the diff in parallel and
+    // fill in the diff. If the server can't diff, we diff in the browser.
     var beforeDeferred = getOrNull('a', pair.a);
     var afterDeferred = getOrNull('b', pair.b);
+    var serverDiffDeferred = $.Deferred();
+    getServerDiff(pair.idx, _.extend({context: 'all'}, this.props.whitespace))
+        .done(diff => serverDiffDeferred.resolve(diff))
+        .fail(() => serverDiffDeferred.resolve(null));
 
     var self = this;
-    $.when(beforeDeferred, afterDeferred).done(function(before, after) {
+    $.when(beforeDeferred, afterDeferred, serverDiffDeferred).done(function(before, after, diff) {
       if (!self.isMounted()) return;
+      var opcodes = diff ? opcodesFromServerDiff(diff) : null;
       // Call out to codediff.js to construct the side-by-side diff.
-      $(self.refs.codediff.getDOMNode()).empty().append(
-          renderDiff(pair.a, pair.b, before[0], after[0]));
+      var spans = opcodes ? wordSpansFromServerDiff(diff) : null;
+      var diffDiv = renderDiff(pair.a, pair.b, before[0], after[0], opcodes, spans);
+      // line numbers of the server diff only match if we rendered it
+      if (opcodes) markMovedLines(diffDiv, movedLinesFromServerDiff(diff));
+      $(self.refs.codediff.getDOMNode()).empty().append(diffDiv);
+      if (opcodes && diff.moves_pending) {
+        // the server is still finding moved code, mark it when it's done
+        getMoves(self.props.whitespace).done(res => {
+          if (!self.isMounted()) return;
+          markMovedLines(diffDiv, movedLinesFromMoves(res.moves, pair.idx));
+        });
+      }
     })
     .fail((e) => alert("Unable to get diff!"));
   },
   componentDidMount: function() {
     this.renderDiff();  // Called on initial display of this component.
+    $(this.refs.codediff.getDOMNode()).on('click', 'a.moved-link', this.handleMovedLinkClick);
+  },
+  handleMovedLinkClick: function(e) {
+    e.preventDefault();
+    var $a = $(e.currentTarget),
+        idx = Number($a.attr('data-idx'));
+    if (idx != this.props.filePair.idx) {
+      if (this.props.fileChangeHandler) this.props.fileChangeHandler(idx);
+      return;
+    }
+    scrollToLine(this.refs.codediff.getDOMNode(), $a.attr('data-side'), Number($a.attr('data-line')));
   },
   componentDidUpdate: function() {
-    this.componentDidMount();  // Called on updates.
+    this.renderDiff();  // Called on updates.
   }
 });
 
@@ -0,0 +1,114 @@
+/**
+ * React components for resolving merge conflicts.
+ */
+'use strict';
+
+import React from 'react';
+
+// One of base / ours / theirs versions of a conflicted file.
+var ConflictPane = React.createClass({
+  propTypes: {
+    title: React.PropTypes.string.isRequired,
+    content: React.PropTypes.string,
+    side: React.PropTypes.string.isRequired,
+    readOnly: React.PropTypes.bool,
+    resolveHandler: React.PropTypes.func.isRequired
+  },
+  render: function() {
+    var content = this.props.content;
+    var body = content === null ? <i>(deleted)</i> : <pre>{content}</pre>;
+    var label = content === null ? 'Delete the file' : 'Use ' + this.props.side;
+    var button = this.props.readOnly ? null : <button onClick={this.handleClick}>{label}</button>;
+    return (
+      <td className={'conflict-pane ' + this.props.side}>
+        <div className="conflict-pane-title">
+          {this.props.title}{' '}
+          {button}
+        </div>
+        {body}
+      </td>
+    );
+  },
+  handleClick: function() {
+    this.props.resolveHandler({side: this.props.side});
+  }
+});
+
+// A three-pane base / ours / theirs view of a file with merge conflicts and
+// an editable working tree version, which can be saved as a resolution.
+export var ConflictView = React.createClass({
+  propTypes: {
+    filePair: React.PropTypes.object.isRequired
+  },
+  getInitialState: function() {
+    return {conflict: null, merged: null, error: null};
+  },
+  componentDidMount: function() {
+    $.getJSON(BASE_URL + '/conflict/' + this.props.filePair.idx).done(conflict => {
+      if (!this.isMounted()) return;
+      this.setState({conflict, merged: conflict.merged});
+    }).fail(() => this.setState({error: 'Unable to get conflict!'}));
+  },
+  resolve: function(args) {
+    $.post(BASE_URL + '/resolve/' + this.props.filePair.idx, args).done(conflict => {
+      if (!this.isMounted()) return;
+      this.props.filePair.is_resolved = true;
+      this.setState({conflict, merged: conflict.merged, error: null});
+    }).fail(e => this.setState({error: 'Unable to resolve: ' + e.responseText}));
+  },
+  onMergedChange: function(e) {
+    this.setState({merged: e.target.value});
+  },
+  saveMerged: function() {
+    this.resolve({content: this.state.merged});
+  },
+  render: function() {
+    var c = this.state.conflict;
+    if (this.state.error && !c) {
+      return <div className="conflict-error">{this.state.error}</div>;
+    }
+    if (!c) {
+      return <div>Loading…</div>;
+    }
+    var status = c.resolved ? <div className="conflict-resolved">(Resolved and added to the index)</div> : null;
+    var error = this.state.error ? <div className="conflict-error">{this.state.error}</div> : null;
+    var merged;
+    if (c.read_only) {
+      // large and binary files can't be resolved here
+      merged = (
+        <div className="conflict-error">
+          The file is too large or binary, resolve it with git.
+        </div>
+      );
+    } else {
+      merged = (
+        <div>
+          <div className="conflict-pane-title">
+            Working tree{' '}
+            <button onClick={this.saveMerged}>Save and mark as resolved</button>
+          </div>
+          <textarea className="conflict-merged"
+                    value={this.state.merged || ''}
+                    onChange={this.onMergedChange} />
+        </div>
+      );
+    }
+    return (
+      <div className="conflict">
+        {status}
+        {error}
+        <table className="conflict-panes">
+          <tr>
+            <ConflictPane title="Base" side="base" content={c.base}
+                          readOnly={c.read_only} resolveHandler={this.resolve} />
+            <ConflictPane title="Ours" side="ours" content={c.ours}
+                          readOnly={c.read_only} resolveHandler={this.resolve} />
+            <ConflictPane title="Theirs" side="theirs" content={c.theirs}
+                          readOnly={c.read_only} resolveHandler={this.resolve} />
+          </tr>
+        </table>
+        {merged}
+      </div>
+    );
+  }
+});
@@ -2,9 +2,12 @@
  * Display the diff for a single file.
  * @param {string} contentsBefore
  * @param {string} contentsAfter
+ * @param {Array=} opcodes difflib-style opcodes computed by the server.
+ * @param {Object=} intraLineSpans changed words of replaced lines computed
+ *     by the server, see wordSpansFromServerDiff.
  * @param {!HTMLDivElement} An unattached div containing the rendered diff.
  */
-function renderDiff(pathBefore, pathAfter, contentsBefore, contentsAfter) {
+function renderDiff(pathBefore, pathAfter, contentsBefore, contentsAfter, opcodes, intraLineSpans) {
   var diffDiv = $('<div class="diff"></div>').get(0);
 
   // build the diff view and add it to the current DOM
@@ -12,7 +15,9 @@ function renderDiff(pathBefore, pathAfter, contentsBefore, contentsAfter) {
     // set the display titles for each resource
     beforeName: pathBefore || '(none)',
     afterName: pathAfter || '(none)',
-    contextSize: 10
+    contextSize: 10,
+    opcodes: opcodes,
+    intraLineSpans: intraLineSpans
   };
 
   // First guess a language based on the file name.
@@ -43,15 +48,17 @@ function renderDiff(pathBefore, pathAfter, contentsBefore, contentsAfter) {
 /**
  * Get thick file diff information from the server.
  * @param {number} index Index of this diff in the diff list
+ * @param {Object=} whitespace Whitespace options like ignore_eol, used to
+ *     tell if the change is meaningful.
  * @return {jQuery.Deferred} Deferred object for the thick diff.
  */
-function getThickDiff(index) {
+function getThickDiff(index, whitespace) {
   var cache = getThickDiff.cache;
   if (cache[index]) {
     return $.when(cache[index]);
   }
 
-  var deferred = $.getJSON('/thick/' + index);
+  var deferred = $.getJSON(BASE_URL + '/thick/' + index, whitespace || {});
   deferred.done(function(data) {
     cache[index] = data;
   });
@@ -59,6 +66,150 @@ function getThickDiff(index) {
 }
 getThickDiff.cache = [];
 
+/**
+ * Get a diff computed by the server.
+ * @param {number} index Index of this diff in the diff list
+ * @param {Object=} opts algorithm ('myers', 'patience' or 'histogram'),
+ *     context (number of lines or 'all') and whitespace options like
+ *     ignore_eol.
+ * @return {jQuery.Deferred} Deferred object for the diff, with hunks.
+ */
+function getServerDiff(index, opts) {
+  return $.getJSON(BASE_URL + '/diff/' + index, opts || {});
+}
+
+/**
+ * Convert a diff of the whole file (context 'all') from the server to
+ * difflib-style opcodes like ['equal', i1, i2, j1, j2]. Returns null if
+ * there are no opcodes which cover all lines, e.g. when only ignored blank
+ * lines changed.
+ */
+function opcodesFromServerDiff(diff) {
+  if (diff.hunks.length == 0) {
+    if (diff.before_lines != diff.after_lines) return null;
+    return diff.before_lines == 0 ? [] :
+        [['equal', 0, diff.before_lines, 0, diff.after_lines]];
+  }
+  return diff.hunks[0].opcodes.map(function(op) {
+    return [op.op, op.before_start, op.before_end, op.after_start, op.after_end];
+  });
+}
+
+/**
+ * Get changed words of replaced lines in a diff from the server.
+ * @param {Object} diff Diff of the whole file (context 'all').
+ * @return {{before: Object, after: Object}} word_spans of lines, keyed by
+ *     line number before and after.
+ */
+function wordSpansFromServerDiff(diff) {
+  var before = {}, after = {};
+  diff.hunks.forEach(function(hunk) {
+    hunk.lines.forEach(function(line) {
+      if (!line.word_spans) return;
+      if (line.op == 'delete') before[line.before_line] = line.word_spans;
+      if (line.op == 'insert') after[line.after_line] = line.word_spans;
+    });
+  });
+  return {before: before, after: after};
+}
+
+/**
+ * Get blocks moved within and across all files. The server responds when
+ * it's done finding them, which can take a while.
+ * @param {Object=} opts whitespace options like ignore_eol.
+ * @return {jQuery.Deferred} Deferred object for {moves: [...]}.
+ */
+function getMoves(opts) {
+  return $.getJSON(BASE_URL + '/moves', opts || {});
+}
+
+/**
+ * Get lines moved from or to somewhere else using moved_from and moved_to
+ * of lines in a diff from the server.
+ * @param {Object} diff Diff of the whole file (context 'all').
+ * @return {{movedTo: Object, movedFrom: Object}} Locations of the other side
+ *     of moved lines, keyed by line number before and after.
+ */
+function movedLinesFromServerDiff(diff) {
+  var movedTo = {}, movedFrom = {};
+  diff.hunks.forEach(function(hunk) {
+    hunk.lines.forEach(function(line) {
+      if (line.moved_to) movedTo[line.before_line] = line.moved_to;
+      if (line.moved_from) movedFrom[line.after_line] = line.moved_from;
+    });
+  });
+  return {movedTo: movedTo, movedFrom: movedFrom};
+}
+
+/**
+ * Like movedLinesFromServerDiff but for moved blocks from /moves.
+ * @param {Array} moves Moved blocks of all files.
+ * @param {number} idx Index of the file.
+ */
+function movedLinesFromMoves(moves, idx) {
+  var movedTo = {}, movedFrom = {};
+  moves.forEach(function(m) {
+    var i;
+    if (m.from.idx == idx) {
+      for (i = m.from.start; i < m.from.end; i++) {
+        movedTo[i + 1] = {idx: m.to.idx, path: m.to.path, line: m.to.start + i - m.from.start + 1};
+      }
+    }
+    if (m.to.idx == idx) {
+      for (i = m.to.start; i < m.to.end; i++) {
+        movedFrom[i + 1] = {idx: m.from.idx, path: m.from.path, line: m.from.start + i - m.to.start + 1};
+      }
+    }
+  });
+  return {movedTo: movedTo, movedFrom: movedFrom};
+}
+
+/**
+ * Mark lines of a rendered diff which were moved from or to somewhere else.
+ * Line numbers of moved lines become links to the other side of the move.
+ * @param {!HTMLDivElement} diffDiv Diff rendered by renderDiff.
+ * @param {{movedTo: Object, movedFrom: Object}} moved Moved lines, from
+ *     movedLinesFromServerDiff or movedLinesFromMoves.
+ */
+function markMovedLines(diffDiv, moved) {
+  var movedTo = moved.movedTo, movedFrom = moved.movedFrom;
+
+  // a line moved to somewhere is on the 'after' side of the other file
+  var mark = function(lineNoTd, codeTd, move, what, otherSide) {
+    if (!move) return;
+    $(codeTd).addClass('moved')
+        .attr('title', what + ' ' + move.path + ':' + move.line);
+    var $link = $('<a href="#" class="moved-link">')
+        .attr({'data-idx': move.idx, 'data-line': move.line, 'data-side': otherSide})
+        .text($(lineNoTd).text());
+    $(lineNoTd).empty().append($link);
+  };
+  $(diffDiv).find('tr').each(function() {
+    var tds = $(this).children('td');
+    if (tds.length != 4) return;  // e.g. "skip" rows
+    mark(tds[0], tds[1], movedTo[Number($(tds[0]).text())], 'Moved to', 'after');
+    mark(tds[3], tds[2], movedFrom[Number($(tds[3]).text())], 'Moved from', 'before');
+  });
+}
+
+/**
+ * Scroll a rendered diff to a line.
+ * @param {!HTMLDivElement} diffDiv Diff rendered by renderDiff.
+ * @param {string} side 'before' or 'after'.
+ * @param {number} line 1-based line number.
+ */
+function scrollToLine(diffDiv, side, line) {
+  $(diffDiv).find('tr').each(function() {
+    var tds = $(this).children('td');
+    if (tds.length != 4) return true;
+    var lineNoTd = side == 'before' ? tds[0] : tds[3];
+    if (Number($(lineNoTd).text()) == line) {
+      this.scrollIntoView();
+      return false;
+    }
+  });
+}
+
 
 function extractFilename(path) {
   var parts = path.split('/');
@@ -84,7 +84,7 @@ export var ImageDiff = React.createClass({
   },
   computePerceptualDiffBox: function(fp) {
     if (!isSameSizeImagePair(fp)) return;
-    $.getJSON(`/pdiffbbox/${fp.idx}`)
+    $.getJSON(`${BASE_URL}/pdiffbbox/${fp.idx}`)
         .done(bbox => {
           if (!fp.diffData) fp.diffData = {};
           fp.diffData.diffBounds = bbox;
@@ -118,12 +118,7 @@ export var ImageDiff = React.createClass({
     });
     var diffBoxEnabled = isSameSizeImagePair(pair);
     var boxClasses = diffBoxEnabled ? '' : 'diff-box-disabled';
-    var boxStyles = { display: HAS_IMAGE_MAGICK ? '' : 'none' };
-    var imageMagickCallout = !HAS_IMAGE_MAGICK ? (
-        <span className="magick">Install{' '}
-        <a href="http://www.imagemagick.org/script/binary-releases.php">ImageMagick</a>{' '}
-        to see perceptual diffs</span>
-    ) : null;
+    var boxStyles = { display: HAS_PERCEPTUAL_DIFF ? '' : 'none' };
 
     return <div>
       <div className="image-diff-controls">
@@ -155,7 +150,6 @@ export var ImageDiff = React.createClass({
                    onChange={() => this.setPdiffMode(PDIFF_MODE.PIXELS)} />
             <label htmlFor="pdiff-pixels"> Differing Pixels</label>
           </span>
-          {imageMagickCallout}
         </span>
       </div>
       <div className={'image-diff ' + mode}>
@@ -195,7 +189,7 @@ export function makePerceptualBoxDiv(pdiffMode, filePair, scaleDown) {
     var styles = {top: 0, left: 0},
         width = filePair.image_a.width * scaleDown,
         height = filePair.image_a.height * scaleDown,
-        src = `/pdiff/${filePair.idx}`;
+        src = `${BASE_URL}/pdiff/${filePair.idx}`;
     return (
         <img className='perceptual-diff pixels'
              style={styles}
@@ -245,8 +239,7 @@ export var SingleImage = React.createClass({
       return null;  // or: return empty <img> same size as other image?
     }
 
-    var url = (side == 'a') ? '/a/image/' + filePair.a
-                            : '/b/image/' + filePair.b;
+    var url = BASE_URL + '/' + side + '/image/' + filePair.idx;
     var im = _.clone(filePair['image_' + side]);
     var scaleDown = 1.0;
     if (this.props.maxWidth !== null && this.props.maxWidth < im.width) {
@@ -418,8 +411,8 @@ export var ImageSwipe = React.createClass({
       width: containerWidth + 'px',
       height: Math.max(imA.height, imB.height) + 'px'
     };
-    var urlA = '/a/image/' + pair.a,
-        urlB = '/b/image/' + pair.b;
+    var urlA = BASE_URL + '/a/image/' + pair.idx,
+        urlB = BASE_URL + '/b/image/' + pair.idx;
     _.extend(styleA, {
       'backgroundImage': 'url(' + urlA + ')',
       'backgroundSize': imA.width + 'px ' + imA.height + 'px',
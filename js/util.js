@@ -8,7 +8,7 @@
  * filePair is like {type, path, a, b}
  */
 export function filePairDisplayName(filePair) {
-  if (filePair.type != 'move') {
+  if (filePair.type != 'move' && filePair.type != 'copy') {
     return filePair.a || filePair.b;
   }
 
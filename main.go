@@ -4,18 +4,24 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
 var (
-	flgDev bool
+	flgDev       bool
+	flgMergeBase string
+	flgStaged    bool
+	flgUnstaged  bool
+	flgWatch     bool
+	flgHashCache bool
 )
 
 // Change combines a GitChange and corresponding server response
 type Change struct {
 	GitChange
 	ThickResponse
+	// true if ThickResponse.contentsInfo is filled, protected by mu
+	infoLoaded bool
 }
 
 func dumpGitChanges(gitChanges []*GitChange) {
@@ -25,41 +31,186 @@ func dumpGitChanges(gitChanges []*GitChange) {
 	}
 }
 
-/* for a new directory, git status returns:
-?? js/
-*/
-func gitStatusShouldExpandDir(c *GitChange) bool {
-	return c.Type == NotCheckedIn && strings.HasSuffix(c.GetPath(), "/")
+func revOrHead(rev string) string {
+	if rev == "" {
+		return revHead
+	}
+	return rev
 }
 
-func gitStatusExpandDirs(changes []*GitChange) []*GitChange {
-	var res []*GitChange
-	for _, c := range changes {
-		if !gitStatusShouldExpandDir(c) {
-			res = append(res, c)
-			continue
+// gitRevsFromArgsMust returns revisions to compare, following conventions
+// of git diff:
+// differ rev                  : rev vs. working tree
+// differ rev1 rev2            : rev1 vs. rev2
+// differ rev1..rev2           : same as above
+// differ rev1...rev2          : merge base of rev1 and rev2 vs. rev2
+// differ -merge-base rev1     : merge base of rev1 and HEAD vs. working tree
+// differ -merge-base rev1 rev2: merge base of rev1 and rev2 vs. rev2
+func gitRevsFromArgsMust(args []string) (string, string) {
+	fatalif(len(args) > 2, "too many arguments: %v\n", args)
+	if flgMergeBase != "" {
+		switch len(args) {
+		case 0:
+			return gitMergeBaseMust(flgMergeBase, revHead), revAfterDefault()
+		case 1:
+			return gitMergeBaseMust(flgMergeBase, args[0]), args[0]
 		}
-		filepath.Walk(c.GetPath(), func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.Mode().IsRegular() {
-				return nil
-			}
-			gc := &GitChange{
-				PathAfter: path,
-				Type:      NotCheckedIn,
-			}
-			res = append(res, gc)
-			return nil
-		})
-	}
-	return res
+		fatalf("-merge-base accepts at most one revision, got %v\n", args)
+	}
+	if len(args) == 2 {
+		return args[0], args[1]
+	}
+	arg := args[0]
+	if parts := strings.SplitN(arg, "...", 2); len(parts) == 2 {
+		revAfter := revOrHead(parts[1])
+		return gitMergeBaseMust(revOrHead(parts[0]), revAfter), revAfter
+	}
+	if parts := strings.SplitN(arg, "..", 2); len(parts) == 2 {
+		return revOrHead(parts[0]), revOrHead(parts[1])
+	}
+	return arg, revAfterDefault()
+}
+
+// when only one revision is given, it's compared with the working tree or,
+// if -staged, with the index
+func revAfterDefault() string {
+	if flgStaged {
+		return revIndex
+	}
+	return revWorkTree
+}
+
+// gitStatusView returns which changes in the working tree to show
+func gitStatusView() string {
+	fatalif(flgStaged && flgUnstaged, "-staged and -unstaged are mutually exclusive\n")
+	if flgStaged {
+		return viewStaged
+	}
+	if flgUnstaged {
+		return viewUnstaged
+	}
+	return ""
 }
 
 func parseFlags() {
 	flag.BoolVar(&flgDev, "dev", false, "running in dev mode")
+	flag.BoolVar(&flgStaged, "staged", false, "only show changes staged in the index (index vs. HEAD)")
+	flag.BoolVar(&flgUnstaged, "unstaged", false, "only show changes not staged in the index (working tree vs. index)")
+	flag.BoolVar(&flgWatch, "watch", true, "refresh the diff when files change on disk")
+	flag.StringVar(&flgMergeBase, "merge-base", "", "compare with the merge base of this revision and HEAD")
+	flag.IntVar(&renameThreshold, "M", 50, "similarity (in percent) for detecting renames when comparing directories, 0 to disable")
+	flag.BoolVar(&findCopies, "C", false, "detect copies of modified files when comparing directories")
+	flag.BoolVar(&findCopiesHarder, "find-copies-harder", false, "detect copies of any file when comparing directories, slower than -C")
+	flag.Var(&excludePatterns, "exclude", "when comparing directories, skip files matching this gitignore-style pattern (can be repeated)")
+	flag.Var(&includePatterns, "include", "when comparing directories, only compare files matching this pattern (can be repeated)")
+	flag.BoolVar(&useGitIgnore, "gitignore", false, "when comparing directories, honor .gitignore files in both of them")
+	flag.IntVar(&dirDiffWorkers, "workers", dirDiffWorkers, "number of goroutines that walk and compare directories")
+	flag.BoolVar(&fastDirCompare, "fast", false, "when comparing directories, assume files with the same size and modification time are equal")
+	flag.BoolVar(&flgHashCache, "hash-cache", true, "when comparing directories, remember hashes of compared files to speed up next runs")
+	flag.IntVar(&contentsCacheMB, "cache-mb", contentsCacheMB, "how much memory (in MB) to use for caching contents of files")
+	flag.StringVar(&diffAlgorithm, "diff-algorithm", diffAlgorithm, "diff algorithm: myers, patience or histogram")
+	flag.IntVar(&diffContext, "U", diffContext, "number of context lines around changes")
+	flag.BoolVar(&detectMovedBlocks, "moves", true, "detect blocks of code moved within and across files")
+	flag.BoolVar(&defaultWhitespaceOptions.IgnoreAllSpace, "w", false, "ignore all whitespace when comparing lines")
+	flag.BoolVar(&defaultWhitespaceOptions.IgnoreSpaceChange, "b", false, "ignore changes in amount of whitespace")
+	flag.BoolVar(&defaultWhitespaceOptions.IgnoreBlankLines, "ignore-blank-lines", false, "ignore changes that only add or remove blank lines")
+	flag.BoolVar(&defaultWhitespaceOptions.IgnoreEOL, "ignore-eol", false, "ignore CRLF vs. LF line endings")
+	flag.BoolVar(&flgPatch, "patch", false, "print changes as a unified diff and exit")
+	flag.BoolVar(&flgPrint, "print", false, "print changed files and a colored diff to stdout and exit")
+	flag.BoolVar(&flgStat, "stat", false, "print number of changed lines in each file and exit")
+	flag.BoolVar(&flgNameStatus, "name-status", false, "print status and name of each changed file and exit")
+	flag.StringVar(&flgColor, "color", flgColor, "color output of -print and -stat: auto, always or never")
+	flag.BoolVar(&flgPager, "pager", flgPager, "with -print etc., show output in $PAGER if stdout is a terminal")
+	flag.StringVar(&flgAddr, "addr", flgAddr, "address to listen on, e.g. 0.0.0.0 for all interfaces")
+	flag.IntVar(&flgPort, "port", flgPort, "port to listen on. If not given and the default is taken, a free port is used")
+	flag.BoolVar(&flgPersist, "persist", false, "keep running when all browser tabs are closed, until ctrl-c")
+	flag.BoolVar(&flgDaemon, "daemon", false, "keep running and show changes of differ started later in other repositories or directories")
+	flag.BoolVar(&flgTUI, "tui", false, "show changes in the terminal instead of the browser")
+	flag.StringVar(&flgExport, "export", "", "write changes to a self-contained html file and exit")
+	flag.StringVar(&flgPatchFile, "patch-file", "", "show changes in a patch file (unified diff, git diff or git format-patch output), - for stdin")
+	flag.StringVar(&flgPatchBase, "base", "", "with -patch-file, directory the patch applies to, for showing whole files")
+	flag.IntVar(&pdiffTolerance, "pdiff-tolerance", 0, "max difference (0-255) of a color channel for pixels to be considered the same")
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "port" {
+			flgPortSet = true
+		}
+	})
+	fatalif(!isValidDiffAlgorithm(diffAlgorithm), "invalid -diff-algorithm '%s'\n", diffAlgorithm)
+	fatalif(!isValidColorMode(flgColor), "invalid -color '%s'\n", flgColor)
+}
+
+// runOutputModes handles flags that write changes somewhere instead of
+// showing them in the browser. They exit when done
+func runOutputModes(s *Session) {
+	if flgPatch {
+		printPatchAndExit(s)
+	}
+	if flgExport != "" {
+		exportAndExit(s)
+	}
+	if flgPrint || flgStat || flgNameStatus {
+		printChangesAndExit(s)
+	}
+}
+
+// usesBrowser returns true if changes will be shown in the browser, as
+// opposed to the terminal or a file
+func usesBrowser() bool {
+	return !flgTUI && !flgPatch && flgExport == "" && !flgPrint && !flgStat && !flgNameStatus
+}
+
+// startUI shows changes in the terminal with -tui, in the browser otherwise
+func startUI(s *Session) {
+	if flgTUI {
+		runTUI(s)
+		return
+	}
+	startWebServer(s)
+}
+
+// sessionSpecFromArgs returns what to show, given command line arguments
+func sessionSpecFromArgs(args []string) *sessionSpec {
+	if len(args) == 1 && args[0] == "-" {
+		flgPatchFile = "-"
+	}
+	if flgPatchFile != "" {
+		LogVerbosef("showing patch '%s'\n", flgPatchFile)
+		d, err := readPatchFile(flgPatchFile)
+		if err != nil {
+			LogErrorf("reading patch '%s' failed with '%s'\n", flgPatchFile, err)
+			os.Exit(1)
+		}
+		return &sessionSpec{Kind: sessionPatch, Patch: d, PatchBase: flgPatchBase}
+	}
+
+	if len(args) == 2 && dirExists(args[0]) && dirExists(args[1]) {
+		LogVerbosef("comparing 2 directories: '%s' and '%s'\n", args[0], args[1])
+		return &sessionSpec{Kind: sessionDirs, DirBefore: args[0], DirAfter: args[1]}
+	}
+
+	LogVerbosef("getting list of changed files\n")
+	detectGitExeMust()
+	cdToGitRoot()
+	if len(args) == 0 && flgMergeBase == "" {
+		return &sessionSpec{Kind: sessionGitStatus, View: gitStatusView()}
+	}
+	revBefore, revAfter := gitRevsFromArgsMust(args)
+	LogVerbosef("comparing revisions '%s' and '%s'\n", revBefore, revAfter)
+	return &sessionSpec{Kind: sessionGitDiff, RevBefore: revBefore, RevAfter: revAfter}
+}
+
+// initDirDiff must be called once before comparing directories
+func initDirDiff() {
+	if dirDiffWorkers < 1 {
+		dirDiffWorkers = 1
+	}
+	if flgHashCache {
+		var err error
+		if hashCache, err = loadHashCache(); err != nil {
+			LogErrorf("Not using hash cache, loadHashCache() failed with '%s'\n", err)
+		}
+	}
 }
 
 func main() {
@@ -74,36 +225,31 @@ func main() {
 	}
 
 	args := flag.Args()
-	if len(args) == 2 {
-		dirBefore := args[0]
-		dirAfter := args[1]
-		LogVerbosef("comparing 2 directories: '%s' and '%s'\n", dirBefore, dirAfter)
-		dirDiffs, err := dirDiff(dirBefore, dirAfter)
-		if err != nil {
-			LogErrorf("dirDiff() failed with '%s'\n", err)
-			os.Exit(1)
-		}
-		dumpGitChanges(dirDiffs)
-		buildGlobalChangesFromDirDiffs(dirDiffs)
-		if len(globalChanges) == 0 {
-			fmt.Printf("There are no changes!\n")
-			os.Exit(0)
-		}
-		startWebServer()
-		os.Exit(0)
+	if flgDaemon {
+		fatalif(len(args) > 0, "-daemon doesn't take arguments, run differ with them while the daemon is running\n")
+		runDaemon()
+		return
 	}
 
-	LogVerbosef("getting list of changed files\n")
-	detectGitExeMust()
-	cdToGitRoot()
-
-	gitChanges := gitStatusMust()
-	gitChanges = gitStatusExpandDirs(gitChanges)
-	buildGlobalChanges(gitChanges)
-	dumpGitChanges(gitChanges)
-	if len(globalChanges) == 0 {
+	spec := sessionSpecFromArgs(args)
+	if usesBrowser() && showInDaemon(spec) {
+		os.Exit(0)
+	}
+	if spec.Kind == sessionDirs {
+		initDirDiff()
+	}
+	s, err := newSession(spec)
+	if err != nil {
+		LogErrorf("getting list of changes failed with '%s'\n", err)
+		os.Exit(1)
+	}
+	runOutputModes(s)
+	if len(s.getChanges()) == 0 {
 		fmt.Printf("There are no changes!\n")
 		os.Exit(0)
 	}
-	startWebServer()
+	if flgWatch {
+		s.startWatching()
+	}
+	startUI(s)
 }
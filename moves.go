@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"unicode"
+)
+
+const (
+	// like git --color-moved, blocks with fewer alphanumeric characters are
+	// not considered moved, so that e.g. a moved "}" isn't reported
+	minMovedBlockChars = 20
+	// we only look for moves among that many changes because contents of
+	// all of them have to be read
+	maxMoveDetectionChanges = 1000
+	// lines like "}" are inserted in many places, we only try that many
+	maxMoveCandidates = 64
+)
+
+var (
+	// set with -moves flag
+	detectMovedBlocks = true
+)
+
+// movesCache remembers moves found in changes of a session. They're found
+// in the background because contents of all changes have to be read
+type movesCache struct {
+	sync.Mutex
+	generation int
+	ws         whitespaceOptions
+	moves      []*MovedBlock
+	// closed when moves for generation and ws are found, nil if not started
+	done chan struct{}
+}
+
+// MoveRange is a range of lines [Start, End) (0-based) of idx-th change
+type MoveRange struct {
+	Index int    `json:"idx"`
+	Path  string `json:"path"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// MovedBlock is a block of lines deleted in From and inserted in To. Both
+// can be the same change if code was moved within a file
+type MovedBlock struct {
+	From MoveRange `json:"from"`
+	To   MoveRange `json:"to"`
+}
+
+// MoveLocation is where a moved line is on the other side of the move.
+// Line is 1-based
+type MoveLocation struct {
+	Index int    `json:"idx"`
+	Path  string `json:"path"`
+	Line  int    `json:"line"`
+}
+
+// MovesResponse describes response for /moves
+type MovesResponse struct {
+	Moves []*MovedBlock `json:"moves"`
+}
+
+// lineRun is a run of consecutive deleted or inserted lines of a change.
+// lines are normalized according to whitespace options
+type lineRun struct {
+	idx   int
+	path  string
+	start int
+	lines []string
+}
+
+func countAlnum(lines []string) int {
+	n := 0
+	for _, l := range lines {
+		for _, r := range l {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// contentsForMoves returns contents of a change for move detection. Contents
+// that are not cached are read but not cached, so that reading all changes
+// doesn't evict contents of files being viewed
+func (s *Session) contentsForMoves(gc *Change) (*fileContents, bool, error) {
+	s.mu.Lock()
+	key := gc.GitChange
+	isText := !gc.IsImage && !gc.IsConflict
+	s.mu.Unlock()
+	if !isText {
+		return nil, false, nil
+	}
+	fc := s.contentsCache.get(key)
+	if fc == nil {
+		var err error
+		if fc, err = s.readContents(&key, false); err != nil {
+			return nil, false, err
+		}
+	}
+	return fc, true, nil
+}
+
+// changedLineRuns returns runs of deleted and inserted lines of all text
+// changes
+func (s *Session) changedLineRuns(changes []*Change, ws whitespaceOptions) ([]*lineRun, []*lineRun) {
+	if len(changes) > maxMoveDetectionChanges {
+		LogVerbosef("only detecting moves in first %d of %d changes\n", maxMoveDetectionChanges, len(changes))
+		changes = changes[:maxMoveDetectionChanges]
+	}
+
+	var deleted, inserted []*lineRun
+	for i, gc := range changes {
+		fc, isText, err := s.contentsForMoves(gc)
+		if err != nil {
+			LogErrorf("contentsForMoves() of '%s' failed with '%s'\n", gc.GetPath(), err)
+			continue
+		}
+		if !isText || bytes.Equal(fc.before, fc.after) {
+			continue
+		}
+		before, after := splitLines(fc.before), splitLines(fc.after)
+		for j, l := range before {
+			before[j] = ws.normalizeLine(l)
+		}
+		for j, l := range after {
+			after[j] = ws.normalizeLine(l)
+		}
+		pathBefore, pathAfter := gc.PathBefore, gc.PathAfter
+		if pathBefore == "" {
+			pathBefore = pathAfter
+		}
+		if pathAfter == "" {
+			pathAfter = pathBefore
+		}
+		for _, op := range diffLines(before, after, diffAlgorithm, nil) {
+			if op.Op == OpEqual {
+				continue
+			}
+			if op.BeforeStart < op.BeforeEnd {
+				deleted = append(deleted, &lineRun{i, pathBefore, op.BeforeStart, before[op.BeforeStart:op.BeforeEnd]})
+			}
+			if op.AfterStart < op.AfterEnd {
+				inserted = append(inserted, &lineRun{i, pathAfter, op.AfterStart, after[op.AfterStart:op.AfterEnd]})
+			}
+		}
+	}
+	return deleted, inserted
+}
+
+// matchMovedBlocks finds blocks of deleted lines that were inserted
+// somewhere else. Each deleted and inserted line is part of at most one
+// block and the longest match wins
+func matchMovedBlocks(deleted, inserted []*lineRun) []*MovedBlock {
+	type linePos struct {
+		run, i int
+	}
+	positions := make(map[string][]linePos)
+	used := make([][]bool, len(inserted))
+	for run, ins := range inserted {
+		used[run] = make([]bool, len(ins.lines))
+		for i, l := range ins.lines {
+			if isBlankLine(l) {
+				continue
+			}
+			if len(positions[l]) < maxMoveCandidates {
+				positions[l] = append(positions[l], linePos{run, i})
+			}
+		}
+	}
+
+	var res []*MovedBlock
+	for _, del := range deleted {
+		for i := 0; i < len(del.lines); {
+			best, bestN := linePos{}, 0
+			for _, p := range positions[del.lines[i]] {
+				ins := inserted[p.run].lines
+				n := 0
+				for i+n < len(del.lines) && p.i+n < len(ins) && !used[p.run][p.i+n] && del.lines[i+n] == ins[p.i+n] {
+					n++
+				}
+				if n > bestN {
+					best, bestN = p, n
+				}
+			}
+			if bestN == 0 || countAlnum(del.lines[i:i+bestN]) < minMovedBlockChars {
+				i++
+				continue
+			}
+			for n := 0; n < bestN; n++ {
+				used[best.run][best.i+n] = true
+			}
+			ins := inserted[best.run]
+			res = append(res, &MovedBlock{
+				From: MoveRange{del.idx, del.path, del.start + i, del.start + i + bestN},
+				To:   MoveRange{ins.idx, ins.path, ins.start + best.i, ins.start + best.i + bestN},
+			})
+			i += bestN
+		}
+	}
+	return res
+}
+
+// startMoves starts finding blocks moved within and across all changes in
+// the background, unless already started for current changes and ws.
+// Returns a channel closed when they're found
+func (s *Session) startMoves(ws whitespaceOptions) chan struct{} {
+	s.mu.Lock()
+	generation := s.generation
+	changes := s.changes
+	s.mu.Unlock()
+
+	c := &s.moves
+	c.Lock()
+	defer c.Unlock()
+	if c.done != nil && c.generation == generation && c.ws == ws {
+		return c.done
+	}
+	done := make(chan struct{})
+	c.done, c.generation, c.ws, c.moves = done, generation, ws, nil
+	go func() {
+		deleted, inserted := s.changedLineRuns(changes, ws)
+		moves := matchMovedBlocks(deleted, inserted)
+		LogVerbosef("found %d moved blocks\n", len(moves))
+		c.Lock()
+		if c.done == done {
+			c.moves = moves
+		}
+		c.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// movesIfFound returns moves of done, false if they're no longer current
+func (s *Session) movesIfFound(done chan struct{}) ([]*MovedBlock, bool) {
+	c := &s.moves
+	c.Lock()
+	defer c.Unlock()
+	return c.moves, c.done == done
+}
+
+// readyMoves returns moved blocks if they're already found, otherwise
+// starts finding them and returns false
+func (s *Session) readyMoves(ws whitespaceOptions) ([]*MovedBlock, bool) {
+	done := s.startMoves(ws)
+	select {
+	case <-done:
+		return s.movesIfFound(done)
+	default:
+		return nil, false
+	}
+}
+
+// getMoves returns moved blocks, waiting until they're found. They're only
+// found again if changes or whitespace options change
+func (s *Session) getMoves(ws whitespaceOptions) []*MovedBlock {
+	for {
+		done := s.startMoves(ws)
+		<-done
+		if moves, ok := s.movesIfFound(done); ok {
+			return moves
+		}
+	}
+}
+
+// annotateMoves marks deleted and inserted lines of idx-th change that are
+// part of moved blocks with the other side of the move
+func annotateMoves(res *DiffResponse, idx int, moves []*MovedBlock) {
+	movedTo := make(map[int]*MoveLocation)
+	movedFrom := make(map[int]*MoveLocation)
+	for _, m := range moves {
+		if m.From.Index == idx {
+			for i := m.From.Start; i < m.From.End; i++ {
+				movedTo[i+1] = &MoveLocation{m.To.Index, m.To.Path, m.To.Start + i - m.From.Start + 1}
+			}
+		}
+		if m.To.Index == idx {
+			for i := m.To.Start; i < m.To.End; i++ {
+				movedFrom[i+1] = &MoveLocation{m.From.Index, m.From.Path, m.From.Start + i - m.To.Start + 1}
+			}
+		}
+		if m.From.Index == idx || m.To.Index == idx {
+			res.Moves = append(res.Moves, m)
+		}
+	}
+	for _, h := range res.Hunks {
+		for _, l := range h.Lines {
+			switch l.Op {
+			case OpDelete:
+				l.MovedTo = movedTo[l.BeforeLine]
+			case OpInsert:
+				l.MovedFrom = movedFrom[l.AfterLine]
+			}
+		}
+	}
+}
+
+// /moves?ignore_space_change=1 etc. waits until moves are found
+func handleMoves(w http.ResponseWriter, r *http.Request, s *Session) {
+	LogVerbosef("handleMoves uri='%s'\n", r.URL.Path)
+	ws, err := whitespaceOptionsFromRequest(r)
+	if err != nil {
+		servePlainText(w, r, 400, "%s", err)
+		return
+	}
+	res := MovesResponse{Moves: []*MovedBlock{}}
+	if detectMovedBlocks {
+		res.Moves = append(res.Moves, s.getMoves(ws)...)
+	}
+	httpOkWithJSON(w, r, res)
+}
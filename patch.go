@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	devNull = "/dev/null"
+	// blob hash of a missing file in "index" lines
+	gitHashNone = "0000000000000000000000000000000000000000"
+	// alphabet of base85 encoding in git binary patches
+	gitBase85Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+)
+
+var (
+	// set with -patch flag
+	flgPatch bool
+)
+
+// patchPath returns path of a file as shown in a patch: relative to the
+// root of a compared directory (git paths already are) with forward slashes
+func patchPath(path, root string) string {
+	if root != "" {
+		if rel, err := filepath.Rel(root, path); err == nil {
+			path = rel
+		}
+	}
+	return filepath.ToSlash(path)
+}
+
+// gitBlobHash returns hash git uses for a file with contents d
+func gitBlobHash(d []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(d))
+	h.Write(d)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// writeBinaryLiteral writes d as a "literal" hunk of git binary patch:
+// deflated data in lines of base85 encoded chunks of up to 52 bytes, each
+// prefixed with its length ('A'-'Z' for 1-26, 'a'-'z' for 27-52)
+func writeBinaryLiteral(w io.Writer, d []byte) {
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write(d)
+	zw.Close()
+	fmt.Fprintf(w, "literal %d\n", len(d))
+	z := deflated.Bytes()
+	for len(z) > 0 {
+		n := minInt(len(z), 52)
+		chunk := z[:n]
+		z = z[n:]
+		if n <= 26 {
+			w.Write([]byte{byte('A' + n - 1)})
+		} else {
+			w.Write([]byte{byte('a' + n - 27)})
+		}
+		var line []byte
+		for i := 0; i < n; i += 4 {
+			var v uint32
+			for j := 0; j < 4; j++ {
+				v <<= 8
+				if i+j < n {
+					v |= uint32(chunk[i+j])
+				}
+			}
+			var enc [5]byte
+			for j := 4; j >= 0; j-- {
+				enc[j] = gitBase85Chars[v%85]
+				v /= 85
+			}
+			line = append(line, enc[:]...)
+		}
+		w.Write(line)
+		io.WriteString(w, "\n")
+	}
+	io.WriteString(w, "\n")
+}
+
+// fileModeOnDisk returns git mode of a file
+func fileModeOnDisk(path string) string {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return ""
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return "120000"
+	}
+	if fi.Mode()&0111 != 0 {
+		return "100755"
+	}
+	return "100644"
+}
+
+// patchModes returns git modes of both sides of a change, "" for a side
+// that doesn't exist. git tells us modes, for directories we check files
+func (s *Session) patchModes(c *GitChange) (string, string) {
+	before, after := c.ModeBefore, c.ModeAfter
+	if s.spec.Kind == sessionDirs {
+		before, after = "", ""
+		if c.PathBefore != "" {
+			before = fileModeOnDisk(c.PathBefore)
+		}
+		if c.PathAfter != "" {
+			after = fileModeOnDisk(c.PathAfter)
+		}
+	}
+	if c.Type == NotCheckedIn {
+		after = fileModeOnDisk(filepath.Join(s.spec.GitDir, c.PathAfter))
+	}
+	if before == gitModeNone {
+		before = ""
+	}
+	if after == gitModeNone {
+		after = ""
+	}
+	// 100644 is the most likely mode if we don't know
+	switch c.Type {
+	case Added, NotCheckedIn:
+		before = ""
+		if after == "" {
+			after = "100644"
+		}
+	case Deleted:
+		after = ""
+		if before == "" {
+			before = "100644"
+		}
+	default:
+		if before == "" {
+			before = "100644"
+		}
+		if after == "" {
+			after = before
+		}
+	}
+	return before, after
+}
+
+// patchRange formats start and count of a hunk like diff -u: count is
+// omitted if it's 1
+func patchRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// writePatchHunks writes unified diff hunks of before and after
+func writePatchHunks(w io.Writer, before, after []byte) {
+	linesBefore, linesAfter := splitLines(before), splitLines(after)
+	noEOLBefore := len(before) > 0 && before[len(before)-1] != '\n'
+	noEOLAfter := len(after) > 0 && after[len(after)-1] != '\n'
+	// the last line without a newline is different from the same line with
+	// one, so we diff lines with their newlines
+	withEOL := func(lines []string, noEOL bool) []string {
+		res := make([]string, len(lines))
+		for i, l := range lines {
+			res[i] = l + "\n"
+		}
+		if noEOL {
+			res[len(res)-1] = lines[len(lines)-1]
+		}
+		return res
+	}
+	ops := diffLines(withEOL(linesBefore, noEOLBefore), withEOL(linesAfter, noEOLAfter), diffAlgorithm, nil)
+
+	writeLine := func(prefix string, lines []string, i int, noEOL bool) {
+		fmt.Fprintf(w, "%s%s\n", prefix, lines[i])
+		if noEOL && i == len(lines)-1 {
+			io.WriteString(w, "\\ No newline at end of file\n")
+		}
+	}
+	for _, group := range groupOps(ops, diffContext) {
+		first, last := group[0], group[len(group)-1]
+		bs, bc := unifiedRange(first.BeforeStart, last.BeforeEnd)
+		as, ac := unifiedRange(first.AfterStart, last.AfterEnd)
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", patchRange(bs, bc), patchRange(as, ac))
+		for _, op := range group {
+			if op.Op == OpEqual {
+				for i := op.BeforeStart; i < op.BeforeEnd; i++ {
+					writeLine(" ", linesBefore, i, noEOLBefore)
+				}
+				continue
+			}
+			for i := op.BeforeStart; i < op.BeforeEnd; i++ {
+				writeLine("-", linesBefore, i, noEOLBefore)
+			}
+			for i := op.AfterStart; i < op.AfterEnd; i++ {
+				writeLine("+", linesAfter, i, noEOLAfter)
+			}
+		}
+	}
+}
+
+// contentsSimilarity returns similarity (in percent) of contents of a
+// renamed or copied file, as shown by git
+func contentsSimilarity(before, after []byte) int {
+	return similarity(
+		&renameCandidate{size: int64(len(before)), lines: countLines(before)},
+		&renameCandidate{size: int64(len(after)), lines: countLines(after)})
+}
+
+// changeNames returns names of both sides of a change as shown in patches
+// and reports. Like git, a missing side has the same name as the other one
+func (s *Session) changeNames(c *GitChange) (string, string) {
+	var nameBefore, nameAfter string
+	if c.PathBefore != "" {
+		nameBefore = patchPath(c.PathBefore, s.spec.DirBefore)
+	}
+	if c.PathAfter != "" {
+		nameAfter = patchPath(c.PathAfter, s.spec.DirAfter)
+	}
+	if nameBefore == "" {
+		nameBefore = nameAfter
+	}
+	if nameAfter == "" {
+		nameAfter = nameBefore
+	}
+	return nameBefore, nameAfter
+}
+
+// writeChangePatch writes a change as a diff in git's format, which can be
+// applied with git apply or patch -p1
+func (s *Session) writeChangePatch(w io.Writer, c *GitChange) error {
+	nameBefore, nameAfter := s.changeNames(c)
+	if c.Type == Unmerged {
+		// like git diff
+		fmt.Fprintf(w, "* Unmerged path %s\n", nameBefore)
+		return nil
+	}
+	fc, err := s.source.readContents(c)
+	if err != nil {
+		return err
+	}
+
+	isAdded := c.Type == Added || c.Type == NotCheckedIn
+	isDeleted := c.Type == Deleted
+	modeBefore, modeAfter := s.patchModes(c)
+	fmt.Fprintf(w, "diff --git a/%s b/%s\n", nameBefore, nameAfter)
+	switch {
+	case isAdded:
+		fmt.Fprintf(w, "new file mode %s\n", modeAfter)
+	case isDeleted:
+		fmt.Fprintf(w, "deleted file mode %s\n", modeBefore)
+	default:
+		if modeBefore != modeAfter {
+			fmt.Fprintf(w, "old mode %s\nnew mode %s\n", modeBefore, modeAfter)
+		}
+		if c.Type == Renamed || c.Type == Copied {
+			sim := contentsSimilarity(fc.before, fc.after)
+			what := "rename"
+			if c.Type == Copied {
+				what = "copy"
+			}
+			fmt.Fprintf(w, "similarity index %d%%\n", sim)
+			fmt.Fprintf(w, "%s from %s\n%s to %s\n", what, nameBefore, what, nameAfter)
+		}
+		if bytes.Equal(fc.before, fc.after) {
+			// only renamed or mode changed
+			return nil
+		}
+	}
+
+	hashBefore, hashAfter := gitHashNone, gitHashNone
+	fromFile, toFile := devNull, devNull
+	if !isAdded {
+		hashBefore = gitBlobHash(fc.before)
+		fromFile = "a/" + nameBefore
+	}
+	if !isDeleted {
+		hashAfter = gitBlobHash(fc.after)
+		toFile = "b/" + nameAfter
+	}
+	isBinary := isBinaryData(fc.before) || isBinaryData(fc.after)
+	if !isBinary {
+		// like git, full hashes are only needed to apply binary patches
+		hashBefore, hashAfter = hashBefore[:7], hashAfter[:7]
+	}
+	fmt.Fprintf(w, "index %s..%s", hashBefore, hashAfter)
+	if !isAdded && !isDeleted && modeBefore == modeAfter {
+		fmt.Fprintf(w, " %s", modeBefore)
+	}
+	io.WriteString(w, "\n")
+	if isBinary {
+		// like git diff --binary, so that the patch can be applied
+		io.WriteString(w, "GIT binary patch\n")
+		writeBinaryLiteral(w, fc.after)
+		writeBinaryLiteral(w, fc.before)
+		return nil
+	}
+	if len(fc.before) == 0 && len(fc.after) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", fromFile, toFile)
+	writePatchHunks(w, fc.before, fc.after)
+	return nil
+}
+
+// writePatch writes changes as a patch
+func (s *Session) writePatch(w io.Writer, changes []*Change) error {
+	for _, gc := range changes {
+		if err := s.writeChangePatch(w, &gc.GitChange); err != nil {
+			return fmt.Errorf("failed to read '%s': %s", gc.GetPath(), err)
+		}
+	}
+	return nil
+}
+
+// printPatchAndExit implements -patch: writes all changes to stdout
+func printPatchAndExit(s *Session) {
+	w := bufio.NewWriter(os.Stdout)
+	err := s.writePatch(w, s.getChanges())
+	if err == nil {
+		err = w.Flush()
+	}
+	fataliferr(err)
+	os.Exit(0)
+}
+
+// /patch for all changes or /patch/:idx for one change
+func handlePatch(w http.ResponseWriter, r *http.Request, s *Session) {
+	uri := r.URL.Path
+	LogVerbosef("handlePatch uri='%s'\n", uri)
+	var changes []*Change
+	if strings.TrimSuffix(uri, "/") == "/patch" {
+		changes = s.getChanges()
+	} else {
+		gc := getChangeFromURI(w, r, s, "/patch/")
+		if gc == nil {
+			return
+		}
+		changes = []*Change{gc}
+	}
+	var buf bytes.Buffer
+	if err := s.writePatch(&buf, changes); err != nil {
+		LogErrorf("writePatch() failed with '%s'\n", err)
+		servePlainText(w, r, 500, "%s", err)
+		return
+	}
+	writeHeader(w, 200, "text/plain")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		LogErrorf("err: '%s'\n", err)
+	}
+}
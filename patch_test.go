@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWritePatchHunks(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		exp           string
+	}{
+		{"equal", "a\n", "a\n", ""},
+		{"modified", "a\nb\nc\n", "a\nB\nc\n", "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"added", "", "a\n", "@@ -0,0 +1 @@\n+a\n"},
+		{"deleted", "a\nb\n", "", "@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{
+			"newline added at the end", "a\nb", "a\nb\n",
+			"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			"line added after no newline", "a", "a\nb",
+			"@@ -1 +1,2 @@\n-a\n\\ No newline at end of file\n+a\n+b\n\\ No newline at end of file\n",
+		},
+		{
+			"hunks far apart", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "x\n2\n3\n4\n5\n6\n7\n8\n9\ny\n",
+			"@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+y\n",
+		},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writePatchHunks(&buf, []byte(test.before), []byte(test.after))
+		if got := buf.String(); got != test.exp {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, got, test.exp)
+		}
+	}
+}
+
+// patchTestDirs returns contents of directories compared in
+// TestWritePatchRoundTrip
+func patchTestDirs() (map[string]string, map[string]string) {
+	before := map[string]string{
+		"modified.txt":  "a\nb\nc\n",
+		"no-eol.txt":    "a\nb",
+		"deleted.txt":   "gone\n",
+		"old/moved.txt": tenLines("x"),
+		"empty.txt":     "",
+		"image.bin":     string(binaryTestData(false)),
+		"run.sh":        "echo a\n",
+		"space in.txt":  "a\n",
+	}
+	after := map[string]string{
+		"modified.txt":  "a\nB\nc\nd\n",
+		"no-eol.txt":    "a\nb\nc",
+		"added.txt":     "new\n",
+		"new/moved.txt": tenLines("x", 2),
+		"image.bin":     string(binaryTestData(true)),
+		"added.bin":     "\x00\x01\x02",
+		"run.sh":        "echo b\n",
+		"space in.txt":  "b\n",
+	}
+	return before, after
+}
+
+func TestWritePatchRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "differ-patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dirBefore, dirAfter := filepath.Join(dir, "before"), filepath.Join(dir, "after")
+	filesBefore, filesAfter := patchTestDirs()
+	writeTestFiles(t, dirBefore, filesBefore)
+	writeTestFiles(t, dirAfter, filesAfter)
+	if err := os.Chmod(filepath.Join(dirAfter, "run.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSession(&sessionSpec{Kind: sessionDirs, DirBefore: dirBefore, DirAfter: dirAfter})
+	if err != nil {
+		t.Fatalf("newSession() failed with '%s'", err)
+	}
+	defer s.close()
+	var patch bytes.Buffer
+	if err := s.writePatch(&patch, s.getChanges()); err != nil {
+		t.Fatalf("writePatch() failed with '%s'", err)
+	}
+
+	// the patch has the same changes, with paths relative to directories
+	changes, src, err := parsePatchChanges(patch.Bytes(), dirBefore)
+	if err != nil {
+		t.Fatalf("parsePatch() failed with '%s'\n%s", err, patch.String())
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, fmt.Sprintf("%s %s %s %s %s", gitTypeToString(c.Type), c.PathBefore, c.PathAfter, c.ModeBefore, c.ModeAfter))
+	}
+	sort.Strings(got)
+	exp := []string{
+		"Added  added.bin  100644",
+		"Added  added.txt  100644",
+		"Deleted deleted.txt  100644 ",
+		"Deleted empty.txt  100644 ",
+		"Modified image.bin image.bin 100644 100644",
+		"Modified modified.txt modified.txt 100644 100644",
+		"Modified no-eol.txt no-eol.txt 100644 100644",
+		"Modified run.sh run.sh 100644 100755",
+		"Modified space in.txt space in.txt 100644 100644",
+		"Renamed old/moved.txt new/moved.txt 100644 100644",
+	}
+	if strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Errorf("got changes\n%s\nexpected\n%s\npatch:\n%s", strings.Join(got, "\n"), strings.Join(exp, "\n"), patch.String())
+	}
+
+	// and contents of files can be recreated from it
+	for _, c := range changes {
+		fc, err := src.readContents(c)
+		if err != nil {
+			t.Errorf("%s: readContents() failed with '%s'", c.GetPath(), err)
+			continue
+		}
+		if string(fc.before) != filesBefore[c.PathBefore] || string(fc.after) != filesAfter[c.PathAfter] {
+			t.Errorf("%s: got %q, %q, expected %q, %q", c.GetPath(), fc.before, fc.after, filesBefore[c.PathBefore], filesAfter[c.PathAfter])
+		}
+	}
+}
+
+func TestWritePatchGitApply(t *testing.T) {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "differ-patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dirBefore, dirAfter := filepath.Join(dir, "before"), filepath.Join(dir, "after")
+	filesBefore, filesAfter := patchTestDirs()
+	writeTestFiles(t, dirBefore, filesBefore)
+	writeTestFiles(t, dirAfter, filesAfter)
+
+	s, err := newSession(&sessionSpec{Kind: sessionDirs, DirBefore: dirBefore, DirAfter: dirAfter})
+	if err != nil {
+		t.Fatalf("newSession() failed with '%s'", err)
+	}
+	defer s.close()
+	patchPath := filepath.Join(dir, "changes.patch")
+	var patch bytes.Buffer
+	if err := s.writePatch(&patch, s.getChanges()); err != nil {
+		t.Fatalf("writePatch() failed with '%s'", err)
+	}
+	if err := ioutil.WriteFile(patchPath, patch.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// git apply outside of a repository applies to the current directory
+	cmd := exec.Command(git, "apply", patchPath)
+	cmd.Dir = dirBefore
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git apply failed with '%s'\n%s\npatch:\n%s", err, out, patch.String())
+	}
+	for path, exp := range filesAfter {
+		d, err := ioutil.ReadFile(filepath.Join(dirBefore, filepath.FromSlash(path)))
+		if err != nil || string(d) != exp {
+			t.Errorf("%s: got %q, %v, expected %q", path, d, err, exp)
+		}
+	}
+	for path := range filesBefore {
+		if _, ok := filesAfter[path]; ok {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dirBefore, filepath.FromSlash(path))); err == nil {
+			t.Errorf("%s wasn't deleted", path)
+		}
+	}
+}
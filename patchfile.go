@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// set with -patch-file flag, "-" for stdin
+	flgPatchFile string
+	// set with -base flag: directory the patch applies to, which gives
+	// full contents of files instead of only lines in hunks
+	flgPatchBase string
+)
+
+// patchHunk is a hunk of a unified diff
+type patchHunk struct {
+	beforeStart, beforeCount int
+	afterStart, afterCount   int
+	// lines with ' ', '-' or '+' prefix
+	lines []string
+	// "\ No newline at end of file" after the last line of a side
+	noEOLBefore, noEOLAfter bool
+}
+
+// filePatch is a diff of one file in a patch
+type filePatch struct {
+	change GitChange
+	hunks  []*patchHunk
+	// for binary files, contents are only known if the patch has
+	// "GIT binary patch" literals or a delta and we have the base
+	isBinary                  bool
+	binaryBefore, binaryAfter []byte
+	binaryDelta               []byte
+}
+
+// hasBinaryContents returns true if we know contents of a binary file,
+// possibly after reading its base
+func (fp *filePatch) hasBinaryContents(base string) bool {
+	c := fp.change
+	hasBefore := fp.binaryBefore != nil || c.Type == Added || base != ""
+	hasAfter := fp.binaryAfter != nil || c.Type == Deleted || (fp.binaryDelta != nil && base != "")
+	return hasBefore && hasAfter
+}
+
+type patchParser struct {
+	lines []string
+	pos   int
+	// commit of git format-patch output we're in
+	commit string
+	files  []*filePatch
+}
+
+// parsePatchPath returns path from ---, +++ or rename lines, without a/ or
+// b/ prefix if stripPrefix is true. Returns "" for /dev/null
+func parsePatchPath(s string, stripPrefix bool) string {
+	if strings.HasPrefix(s, `"`) {
+		if unquoted, err := strconv.Unquote(s); err == nil {
+			s = unquoted
+		}
+	} else if i := strings.IndexByte(s, '\t'); i >= 0 {
+		// diff -u puts a timestamp after a tab
+		s = s[:i]
+	}
+	s = strings.TrimRight(s, "\r")
+	if s == devNull {
+		return ""
+	}
+	if stripPrefix && (strings.HasPrefix(s, "a/") || strings.HasPrefix(s, "b/")) {
+		s = s[2:]
+	}
+	return s
+}
+
+// parseGitDiffPaths returns paths from "diff --git a/x b/y" line. They're
+// ambiguous if paths have spaces, so we prefer a split where they're equal
+func parseGitDiffPaths(s string) (string, string) {
+	if strings.HasPrefix(s, `"`) {
+		if i := strings.Index(s[1:], `" `); i >= 0 {
+			return parsePatchPath(s[:i+2], true), parsePatchPath(s[i+3:], true)
+		}
+	}
+	var first []string
+	for i := 0; i < len(s); i++ {
+		if !strings.HasPrefix(s[i:], " b/") && !strings.HasPrefix(s[i:], ` "b/`) {
+			continue
+		}
+		a, b := parsePatchPath(s[:i], true), parsePatchPath(s[i+1:], true)
+		if a == b {
+			return a, b
+		}
+		if first == nil {
+			first = []string{a, b}
+		}
+	}
+	if first == nil {
+		return "", ""
+	}
+	return first[0], first[1]
+}
+
+// parseHunkRange parses "12,3" or "12" of "@@ -12,3 +12 @@"
+func parseHunkRange(s string) (int, int, error) {
+	count := 1
+	parts := strings.SplitN(s, ",", 2)
+	start, err := strconv.Atoi(parts[0])
+	if err == nil && len(parts) == 2 {
+		count, err = strconv.Atoi(parts[1])
+	}
+	return start, count, err
+}
+
+func (p *patchParser) parseHunkHeader(l string) (*patchHunk, error) {
+	fields := strings.Fields(l)
+	if len(fields) < 4 || fields[3] != "@@" || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return nil, fmt.Errorf("line %d: invalid hunk header %q", p.pos+1, l)
+	}
+	h := &patchHunk{}
+	var err1, err2 error
+	h.beforeStart, h.beforeCount, err1 = parseHunkRange(fields[1][1:])
+	h.afterStart, h.afterCount, err2 = parseHunkRange(fields[2][1:])
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("line %d: invalid hunk header %q", p.pos+1, l)
+	}
+	return h, nil
+}
+
+// parseHunks parses hunks following ---/+++ lines
+func (p *patchParser) parseHunks(fp *filePatch) error {
+	for p.pos < len(p.lines) && strings.HasPrefix(p.lines[p.pos], "@@ ") {
+		h, err := p.parseHunkHeader(p.lines[p.pos])
+		if err != nil {
+			return err
+		}
+		p.pos++
+		nBefore, nAfter := h.beforeCount, h.afterCount
+		prefix := byte(' ')
+		for p.pos < len(p.lines) {
+			l := p.lines[p.pos]
+			if strings.HasPrefix(l, "\\") {
+				// "\ No newline at end of file" is about the previous line
+				h.noEOLBefore = h.noEOLBefore || prefix != '+'
+				h.noEOLAfter = h.noEOLAfter || prefix != '-'
+				p.pos++
+				continue
+			}
+			if nBefore == 0 && nAfter == 0 {
+				break
+			}
+			if l == "" {
+				// some editors strip trailing space of empty context lines
+				l = " "
+			}
+			prefix = l[0]
+			switch prefix {
+			case ' ':
+				nBefore--
+				nAfter--
+			case '-':
+				nBefore--
+			case '+':
+				nAfter--
+			default:
+				return fmt.Errorf("line %d: invalid line in hunk %q", p.pos+1, l)
+			}
+			if nBefore < 0 || nAfter < 0 {
+				return fmt.Errorf("line %d: hunk is longer than its header says", p.pos+1)
+			}
+			h.lines = append(h.lines, l)
+			p.pos++
+		}
+		if nBefore > 0 || nAfter > 0 {
+			return fmt.Errorf("line %d: hunk is shorter than its header says", p.pos+1)
+		}
+		fp.hunks = append(fp.hunks, h)
+	}
+	return nil
+}
+
+// decodeGitBase85 decodes a line of git binary patch, the reverse of
+// writeBinaryLiteral
+func decodeGitBase85(l string) ([]byte, error) {
+	if len(l) < 6 {
+		return nil, fmt.Errorf("binary line too short")
+	}
+	var n int
+	switch c := l[0]; {
+	case c >= 'A' && c <= 'Z':
+		n = int(c-'A') + 1
+	case c >= 'a' && c <= 'z':
+		n = int(c-'a') + 27
+	default:
+		return nil, fmt.Errorf("invalid length of binary line")
+	}
+	enc := l[1:]
+	if len(enc)%5 != 0 || len(enc)/5*4 < n {
+		return nil, fmt.Errorf("invalid length of binary line")
+	}
+	var res []byte
+	for i := 0; i < len(enc); i += 5 {
+		var v uint64
+		for j := 0; j < 5; j++ {
+			d := strings.IndexByte(gitBase85Chars, enc[i+j])
+			if d < 0 {
+				return nil, fmt.Errorf("invalid character in binary line")
+			}
+			v = v*85 + uint64(d)
+		}
+		if v > 0xffffffff {
+			return nil, fmt.Errorf("invalid binary line")
+		}
+		res = append(res, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return res[:n], nil
+}
+
+// parseBinaryHunk parses "literal ${size}" or "delta ${size}" followed by
+// base85 lines and returns the data and if it's a delta
+func (p *patchParser) parseBinaryHunk() ([]byte, bool, error) {
+	fields := strings.Fields(p.lines[p.pos])
+	if len(fields) != 2 || (fields[0] != "literal" && fields[0] != "delta") {
+		return nil, false, nil
+	}
+	size, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, false, fmt.Errorf("line %d: invalid binary hunk header", p.pos+1)
+	}
+	p.pos++
+	var deflated []byte
+	for p.pos < len(p.lines) && strings.TrimRight(p.lines[p.pos], "\r") != "" {
+		d, err := decodeGitBase85(strings.TrimRight(p.lines[p.pos], "\r"))
+		if err != nil {
+			return nil, false, fmt.Errorf("line %d: %s", p.pos+1, err)
+		}
+		deflated = append(deflated, d...)
+		p.pos++
+	}
+	// skip the empty line ending the hunk
+	p.pos++
+	r, err := zlib.NewReader(bytes.NewReader(deflated))
+	if err != nil {
+		return nil, false, err
+	}
+	res, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(res) != size {
+		return nil, false, fmt.Errorf("binary data has size %d, expected %d", len(res), size)
+	}
+	return res, fields[0] == "delta", nil
+}
+
+// applyGitDelta applies a delta of git binary patch to src. A delta is
+// sizes of src and result followed by instructions to copy parts of src
+// or insert new data
+func applyGitDelta(src, delta []byte) ([]byte, error) {
+	errInvalid := fmt.Errorf("invalid binary delta")
+	varint := func() (int, error) {
+		n, shift := 0, uint(0)
+		for len(delta) > 0 {
+			b := delta[0]
+			delta = delta[1:]
+			n |= int(b&0x7f) << shift
+			if b&0x80 == 0 {
+				return n, nil
+			}
+			shift += 7
+		}
+		return 0, errInvalid
+	}
+	srcSize, err := varint()
+	if err != nil {
+		return nil, err
+	}
+	dstSize, err := varint()
+	if err != nil {
+		return nil, err
+	}
+	if srcSize != len(src) {
+		return nil, fmt.Errorf("binary delta doesn't apply, file has a different size")
+	}
+	var res []byte
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		if op == 0 {
+			return nil, errInvalid
+		}
+		if op&0x80 == 0 {
+			// insert next op bytes
+			n := int(op)
+			if n > len(delta) {
+				return nil, errInvalid
+			}
+			res = append(res, delta[:n]...)
+			delta = delta[n:]
+			continue
+		}
+		// copy from src: bits tell which bytes of offset and size follow
+		var off, size int
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, errInvalid
+			}
+			if i < 4 {
+				off |= int(delta[0]) << (8 * i)
+			} else {
+				size |= int(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if size == 0 {
+			size = 0x10000
+		}
+		if off+size > len(src) {
+			return nil, errInvalid
+		}
+		res = append(res, src[off:off+size]...)
+	}
+	if len(res) != dstSize {
+		return nil, errInvalid
+	}
+	return res, nil
+}
+
+// parseGitDiff parses a diff of one file starting with "diff --git"
+func (p *patchParser) parseGitDiff() error {
+	fp := &filePatch{}
+	c := &fp.change
+	c.Type = Modified
+	c.PathBefore, c.PathAfter = parseGitDiffPaths(strings.TrimPrefix(p.lines[p.pos], "diff --git "))
+	p.pos++
+	for p.pos < len(p.lines) {
+		l := strings.TrimRight(p.lines[p.pos], "\r")
+		field := func(prefix string) (string, bool) {
+			if strings.HasPrefix(l, prefix) {
+				return l[len(prefix):], true
+			}
+			return "", false
+		}
+		if v, ok := field("old mode "); ok {
+			c.ModeBefore = v
+		} else if v, ok := field("new mode "); ok {
+			c.ModeAfter = v
+		} else if v, ok := field("deleted file mode "); ok {
+			c.Type = Deleted
+			c.ModeBefore = v
+		} else if v, ok := field("new file mode "); ok {
+			c.Type = Added
+			c.ModeAfter = v
+		} else if v, ok := field("rename from "); ok {
+			c.Type = Renamed
+			c.PathBefore = parsePatchPath(v, false)
+		} else if v, ok := field("rename to "); ok {
+			c.PathAfter = parsePatchPath(v, false)
+		} else if v, ok := field("copy from "); ok {
+			c.Type = Copied
+			c.PathBefore = parsePatchPath(v, false)
+		} else if v, ok := field("copy to "); ok {
+			c.PathAfter = parsePatchPath(v, false)
+		} else if v, ok := field("index "); ok {
+			// "index abc..def 100644" has the mode of both sides
+			if parts := strings.Fields(v); len(parts) == 2 {
+				c.ModeBefore, c.ModeAfter = parts[1], parts[1]
+			}
+		} else if strings.HasPrefix(l, "similarity index ") || strings.HasPrefix(l, "dissimilarity index ") {
+			// we don't need it
+		} else {
+			break
+		}
+		p.pos++
+	}
+
+	if p.pos < len(p.lines) {
+		l := strings.TrimRight(p.lines[p.pos], "\r")
+		switch {
+		case strings.HasPrefix(l, "--- ") && p.pos+1 < len(p.lines) && strings.HasPrefix(p.lines[p.pos+1], "+++ "):
+			p.pos += 2
+			if err := p.parseHunks(fp); err != nil {
+				return err
+			}
+		case strings.HasPrefix(l, "Binary files "):
+			fp.isBinary = true
+			p.pos++
+		case l == "GIT binary patch":
+			fp.isBinary = true
+			p.pos++
+			// forward hunk gives after, reverse hunk before
+			if p.pos < len(p.lines) {
+				d, isDelta, err := p.parseBinaryHunk()
+				if err != nil {
+					return err
+				}
+				if isDelta {
+					fp.binaryDelta = d
+				} else {
+					fp.binaryAfter = d
+				}
+			}
+			if p.pos < len(p.lines) {
+				d, isDelta, err := p.parseBinaryHunk()
+				if err != nil {
+					return err
+				}
+				if !isDelta {
+					fp.binaryBefore = d
+				}
+			}
+		}
+	}
+	p.addFile(fp)
+	return nil
+}
+
+// stripFirstDir returns path without its first directory, like patch -p1,
+// or "" if it has no directory
+func stripFirstDir(path string) string {
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[i+1:]
+	}
+	return ""
+}
+
+// parseUnifiedDiff parses a diff of one file starting with ---/+++ lines,
+// as produced by diff -u
+func (p *patchParser) parseUnifiedDiff() error {
+	before := parsePatchPath(strings.TrimPrefix(p.lines[p.pos], "--- "), false)
+	after := parsePatchPath(strings.TrimPrefix(p.lines[p.pos+1], "+++ "), false)
+	// like patch -p1, but only if paths look like they have prefixes
+	hasPrefixes := (before == "" || strings.HasPrefix(before, "a/")) && (after == "" || strings.HasPrefix(after, "b/"))
+	if hasPrefixes {
+		before = strings.TrimPrefix(before, "a/")
+		after = strings.TrimPrefix(after, "b/")
+	}
+	fp := &filePatch{}
+	c := &fp.change
+	switch {
+	case before == "":
+		c.Type = Added
+		c.PathAfter = after
+	case after == "":
+		c.Type = Deleted
+		c.PathBefore = before
+	default:
+		// diff -u doesn't know about renames. Different names usually
+		// differ in the first directory (diff -u old/x new/x) or are a
+		// backup (diff -u x.orig x), like patch we use the new name
+		if b, a := stripFirstDir(before), stripFirstDir(after); b != "" && b == a {
+			after = a
+		}
+		c.Type = Modified
+		c.PathBefore, c.PathAfter = after, after
+	}
+	p.pos += 2
+	if err := p.parseHunks(fp); err != nil {
+		return err
+	}
+	p.addFile(fp)
+	return nil
+}
+
+func (p *patchParser) addFile(fp *filePatch) {
+	c := &fp.change
+	switch c.Type {
+	case Added:
+		if c.PathAfter == "" {
+			c.PathAfter = c.PathBefore
+		}
+		c.PathBefore = ""
+	case Deleted:
+		if c.PathBefore == "" {
+			c.PathBefore = c.PathAfter
+		}
+		c.PathAfter = ""
+	case Modified:
+		if c.PathAfter == "" {
+			c.PathAfter = c.PathBefore
+		}
+	}
+	if p.commit != "" {
+		c.RevBefore = p.commit + "^"
+		c.RevAfter = p.commit
+	}
+	p.files = append(p.files, fp)
+}
+
+// isMboxFromLine returns commit of "From ${sha} Mon Sep 17 00:00:00 2001"
+// which starts every patch in git format-patch output
+func isMboxFromLine(l string) (string, bool) {
+	fields := strings.Fields(l)
+	if len(fields) < 2 || fields[0] != "From" || len(fields[1]) != 40 {
+		return "", false
+	}
+	for _, c := range fields[1] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return "", false
+		}
+	}
+	return fields[1], true
+}
+
+// parsePatch parses unified diffs, git diffs and git format-patch output.
+// Text that isn't a diff (e.g. commit messages) is skipped
+func parsePatch(d []byte) ([]*filePatch, error) {
+	p := &patchParser{lines: strings.Split(string(d), "\n")}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		var err error
+		if commit, ok := isMboxFromLine(l); ok {
+			p.commit = commit
+			p.pos++
+		} else if strings.HasPrefix(l, "diff --git ") {
+			err = p.parseGitDiff()
+		} else if strings.HasPrefix(l, "--- ") && p.pos+1 < len(p.lines) && strings.HasPrefix(p.lines[p.pos+1], "+++ ") {
+			err = p.parseUnifiedDiff()
+		} else {
+			p.pos++
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p.files, nil
+}
+
+// hunkSides returns lines of before and after of a hunk, without prefixes
+func hunkSides(h *patchHunk) ([]string, []string) {
+	var before, after []string
+	for _, l := range h.lines {
+		switch l[0] {
+		case ' ':
+			before = append(before, l[1:])
+			after = append(after, l[1:])
+		case '-':
+			before = append(before, l[1:])
+		case '+':
+			after = append(after, l[1:])
+		}
+	}
+	return before, after
+}
+
+func joinLines(lines []string, noEOL bool) []byte {
+	if len(lines) == 0 {
+		return nil
+	}
+	s := strings.Join(lines, "\n")
+	if !noEOL {
+		s += "\n"
+	}
+	return []byte(s)
+}
+
+// hunkStart returns index of the first line of a hunk. A hunk that doesn't
+// have lines on a side starts after the line in its header
+func hunkStart(start, count int) int {
+	if count == 0 {
+		return start
+	}
+	return start - 1
+}
+
+// reconstructFromHunks returns contents of both sides of a file made only
+// of lines in hunks. Lines between hunks are unknown, so we fill them with
+// empty lines to keep line numbers right
+func reconstructFromHunks(hunks []*patchHunk) ([]byte, []byte) {
+	var before, after []string
+	var noEOLBefore, noEOLAfter bool
+	for _, h := range hunks {
+		for len(before) < hunkStart(h.beforeStart, h.beforeCount) {
+			before = append(before, "")
+		}
+		for len(after) < hunkStart(h.afterStart, h.afterCount) {
+			after = append(after, "")
+		}
+		b, a := hunkSides(h)
+		before = append(before, b...)
+		after = append(after, a...)
+		noEOLBefore, noEOLAfter = h.noEOLBefore, h.noEOLAfter
+	}
+	return joinLines(before, noEOLBefore), joinLines(after, noEOLAfter)
+}
+
+func linesEqualAt(lines []string, at int, want []string) bool {
+	if at < 0 || at+len(want) > len(lines) {
+		return false
+	}
+	for i, l := range want {
+		if lines[at+i] != l {
+			return false
+		}
+	}
+	return true
+}
+
+// applyHunks applies hunks to base, like patch: if lines moved since the
+// patch was made, hunks are looked for at other positions
+func applyHunks(base []byte, hunks []*patchHunk) ([]byte, error) {
+	lines := splitLines(base)
+	baseNoEOL := len(base) > 0 && base[len(base)-1] != '\n'
+	var res []string
+	pos, offset := 0, 0
+	noEOL := baseNoEOL
+	for i, h := range hunks {
+		before, after := hunkSides(h)
+		want := hunkStart(h.beforeStart, h.beforeCount) + offset
+		at := -1
+		for d := 0; at < 0 && (want-d >= pos || want+d+len(before) <= len(lines)); d++ {
+			if want-d >= pos && linesEqualAt(lines, want-d, before) {
+				at = want - d
+			} else if linesEqualAt(lines, want+d, before) {
+				at = want + d
+			}
+		}
+		if at < 0 {
+			return nil, fmt.Errorf("hunk %d doesn't apply", i+1)
+		}
+		offset = at - hunkStart(h.beforeStart, h.beforeCount)
+		res = append(res, lines[pos:at]...)
+		res = append(res, after...)
+		pos = at + len(before)
+		if pos == len(lines) {
+			noEOL = h.noEOLAfter
+		}
+	}
+	res = append(res, lines[pos:]...)
+	return joinLines(res, noEOL), nil
+}
+
+// contents returns contents of both sides of a file. If base directory is
+// given, they're full contents of files
+func (fp *filePatch) contents(base string) (*fileContents, error) {
+	c := &fp.change
+	var res fileContents
+	if fp.isBinary {
+		msg := []byte("Binary file, contents are not in the patch.")
+		if !fp.hasBinaryContents(base) {
+			return &fileContents{before: msg, after: msg}, nil
+		}
+		res.before, res.after = fp.binaryBefore, fp.binaryAfter
+		if res.before == nil && c.Type != Added {
+			d, err := ioutil.ReadFile(filepath.Join(base, c.PathBefore))
+			if err != nil {
+				return nil, err
+			}
+			res.before = d
+		}
+		if res.after == nil && fp.binaryDelta != nil {
+			d, err := applyGitDelta(res.before, fp.binaryDelta)
+			if err != nil {
+				LogErrorf("can't show '%s': %s\n", c.GetPath(), err)
+				return &fileContents{before: msg, after: msg}, nil
+			}
+			res.after = d
+		}
+		return &res, nil
+	}
+
+	if base != "" && c.Type != Added {
+		d, err := ioutil.ReadFile(filepath.Join(base, c.PathBefore))
+		if err == nil {
+			res.before = d
+			if c.Type != Deleted {
+				res.after, err = applyHunks(d, fp.hunks)
+			}
+		}
+		if err == nil {
+			return &res, nil
+		}
+		LogErrorf("showing only lines in the patch for '%s': %s\n", c.GetPath(), err)
+	}
+	res.before, res.after = reconstructFromHunks(fp.hunks)
+	return &res, nil
+}
+
+// newPatchSource returns changeSource for changes in a parsed patch
+func newPatchSource(files []*filePatch, base string) *changeSource {
+	byChange := make(map[GitChange]*filePatch)
+	for _, fp := range files {
+		byChange[fp.change] = fp
+	}
+	return &changeSource{
+		newThickResponse: func(c *GitChange) ThickResponse {
+			res := ThickResponseFromDirDiffs(c)
+			if fp := byChange[*c]; fp != nil && fp.isBinary && !fp.hasBinaryContents(base) {
+				// we can't show the image
+				res.IsImage = false
+			}
+			return res
+		},
+		readContents: func(c *GitChange) (*fileContents, error) {
+			fp := byChange[*c]
+			if fp == nil {
+				return nil, fmt.Errorf("'%s' is not in the patch", c.GetPath())
+			}
+			return fp.contents(base)
+		},
+	}
+}
+
+// readPatchFile reads a patch file, or stdin if path is "-"
+func readPatchFile(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// parsePatchChanges parses a patch that applies to base directory, "" if
+// not known
+func parsePatchChanges(d []byte, base string) ([]*GitChange, *changeSource, error) {
+	files, err := parsePatch(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a file can be in a patch more than once, e.g. in many commits of git
+	// format-patch output, and changes must be unique
+	seen := make(map[GitChange]int)
+	var changes []*GitChange
+	for _, fp := range files {
+		n := seen[fp.change]
+		seen[fp.change]++
+		if n > 0 {
+			fp.change.RevAfter = fmt.Sprintf("%s#%d", fp.change.RevAfter, n+1)
+		}
+		changes = append(changes, &fp.change)
+	}
+	return changes, newPatchSource(files, base), nil
+}
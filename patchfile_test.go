@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// output of git format-patch --stdout of 2 commits
+const formatPatchOutput = `From d4f3ea940ee6a2b099ad3d550ef5065590f2a31d Mon Sep 17 00:00:00 2001
+From: A U Thor <a@example.com>
+Date: Sat, 23 Jan 2016 10:00:00 +0000
+Subject: [PATCH 1/2] change b
+
+---
+ a.txt | 2 +-
+ 1 file changed, 1 insertion(+), 1 deletion(-)
+
+diff --git a/a.txt b/a.txt
+index de98044..7be73ce 100644
+--- a/a.txt
++++ b/a.txt
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+-- 
+2.39.5
+
+
+From 9e7ce81dc44ec2f5984c72404b808fb214397944 Mon Sep 17 00:00:00 2001
+From: A U Thor <a@example.com>
+Date: Sat, 23 Jan 2016 10:05:00 +0000
+Subject: [PATCH 2/2] add d
+
+Longer description
+--- with a line that looks like a diff
+---
+ a.txt              |   1 +
+ img.bin => pic.bin | Bin
+ 2 files changed, 1 insertion(+)
+ rename img.bin => pic.bin (100%)
+
+diff --git a/a.txt b/a.txt
+index 7be73ce..f8f7a32 100644
+--- a/a.txt
++++ b/a.txt
+@@ -1,3 +1,4 @@
+ a
+ B
+ c
++d
+\ No newline at end of file
+diff --git a/img.bin b/pic.bin
+similarity index 100%
+rename from img.bin
+rename to pic.bin
+-- 
+2.39.5
+
+`
+
+func TestParsePatch(t *testing.T) {
+	const (
+		commit1 = "d4f3ea940ee6a2b099ad3d550ef5065590f2a31d"
+		commit2 = "9e7ce81dc44ec2f5984c72404b808fb214397944"
+	)
+	tests := []struct {
+		name  string
+		patch string
+		exp   []GitChange
+	}{
+		{
+			"diff -u of directories",
+			"--- old/a.txt\t2016-01-23 10:00:00.000000000 +0100\n+++ new/a.txt\t2016-01-23 10:05:00.000000000 +0100\n@@ -1 +1 @@\n-a\n+b\n",
+			[]GitChange{{Type: Modified, PathBefore: "a.txt", PathAfter: "a.txt"}},
+		},
+		{
+			"diff -u of a backup",
+			"--- a.txt.orig\n+++ a.txt\n@@ -1 +1 @@\n-a\n+b\n",
+			[]GitChange{{Type: Modified, PathBefore: "a.txt", PathAfter: "a.txt"}},
+		},
+		{
+			"diff -u with prefixes",
+			"--- /dev/null\n+++ b/dir/new.txt\n@@ -0,0 +1 @@\n+a\n--- a/old.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-a\n",
+			[]GitChange{{Type: Added, PathAfter: "dir/new.txt"}, {Type: Deleted, PathBefore: "old.txt"}},
+		},
+		{
+			"git diff",
+			"diff --git a/a.txt b/a.txt\nindex de98044..7be73ce 100644\n--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-a\n+b\n",
+			[]GitChange{{Type: Modified, PathBefore: "a.txt", PathAfter: "a.txt", ModeBefore: "100644", ModeAfter: "100644"}},
+		},
+		{
+			"git diff of added and deleted files",
+			"diff --git a/new.txt b/new.txt\nnew file mode 100755\nindex 0000000..7898192\n--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1 @@\n+a\n" +
+				"diff --git a/empty b/empty\ndeleted file mode 100644\nindex e69de29..0000000\n",
+			[]GitChange{{Type: Added, PathAfter: "new.txt", ModeAfter: "100755"}, {Type: Deleted, PathBefore: "empty", ModeBefore: "100644"}},
+		},
+		{
+			"git diff of a mode change",
+			"diff --git a/run.sh b/run.sh\nold mode 100644\nnew mode 100755\n",
+			[]GitChange{{Type: Modified, PathBefore: "run.sh", PathAfter: "run.sh", ModeBefore: "100644", ModeAfter: "100755"}},
+		},
+		{
+			"git diff of a rename and a copy",
+			"diff --git a/a.txt b/dir/b.txt\nsimilarity index 90%\nrename from a.txt\nrename to dir/b.txt\nindex de98044..7be73ce 100644\n--- a/a.txt\n+++ b/dir/b.txt\n@@ -1 +1 @@\n-a\n+b\n" +
+				"diff --git a/x.txt b/y.txt\nsimilarity index 100%\ncopy from x.txt\ncopy to y.txt\n",
+			[]GitChange{
+				{Type: Renamed, PathBefore: "a.txt", PathAfter: "dir/b.txt", ModeBefore: "100644", ModeAfter: "100644"},
+				{Type: Copied, PathBefore: "x.txt", PathAfter: "y.txt"},
+			},
+		},
+		{
+			"git diff of paths with spaces and quotes",
+			"diff --git a/with space.txt b/with space.txt\nindex de98044..7be73ce 100644\n--- a/with space.txt\n+++ b/with space.txt\n@@ -1 +1 @@\n-a\n+b\n" +
+				"diff --git \"a/tab\\there\" \"b/tab\\there\"\nold mode 100644\nnew mode 100755\n",
+			[]GitChange{
+				{Type: Modified, PathBefore: "with space.txt", PathAfter: "with space.txt", ModeBefore: "100644", ModeAfter: "100644"},
+				{Type: Modified, PathBefore: "tab\there", PathAfter: "tab\there", ModeBefore: "100644", ModeAfter: "100755"},
+			},
+		},
+		{
+			"git diff of a binary file",
+			"diff --git a/img.png b/img.png\nindex 27a4c7b..9309108 100644\nBinary files a/img.png and b/img.png differ\n",
+			[]GitChange{{Type: Modified, PathBefore: "img.png", PathAfter: "img.png", ModeBefore: "100644", ModeAfter: "100644"}},
+		},
+		{
+			"CRLF",
+			"diff --git a/a.txt b/a.txt\r\nnew file mode 100644\r\nindex 0000000..7898192\r\n--- /dev/null\r\n+++ b/a.txt\r\n@@ -0,0 +1 @@\r\n+a\r\n",
+			[]GitChange{{Type: Added, PathAfter: "a.txt", ModeAfter: "100644"}},
+		},
+		{
+			"git format-patch",
+			formatPatchOutput,
+			[]GitChange{
+				{Type: Modified, PathBefore: "a.txt", PathAfter: "a.txt", ModeBefore: "100644", ModeAfter: "100644", RevBefore: commit1 + "^", RevAfter: commit1},
+				{Type: Modified, PathBefore: "a.txt", PathAfter: "a.txt", ModeBefore: "100644", ModeAfter: "100644", RevBefore: commit2 + "^", RevAfter: commit2},
+				{Type: Renamed, PathBefore: "img.bin", PathAfter: "pic.bin", RevBefore: commit2 + "^", RevAfter: commit2},
+			},
+		},
+		{
+			"the same file twice",
+			"--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-a\n+b\n--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-b\n+c\n",
+			[]GitChange{
+				{Type: Modified, PathBefore: "a.txt", PathAfter: "a.txt"},
+				{Type: Modified, PathBefore: "a.txt", PathAfter: "a.txt", RevAfter: "#2"},
+			},
+		},
+		{"not a patch", "hello\n--- a\nworld\n", nil},
+	}
+	for _, test := range tests {
+		changes, _, err := parsePatchChanges([]byte(test.patch), "")
+		if err != nil {
+			t.Errorf("%s: failed with '%s'", test.name, err)
+			continue
+		}
+		var got []GitChange
+		for _, c := range changes {
+			got = append(got, *c)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestParsePatchErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+	}{
+		{"invalid hunk header", "--- a/a.txt\n+++ b/a.txt\n@@ -1 +x @@\n-a\n+b\n"},
+		{"hunk is too short", "--- a/a.txt\n+++ b/a.txt\n@@ -1,3 +1,3 @@\n-a\n+b\n"},
+		{"invalid line in hunk", "--- a/a.txt\n+++ b/a.txt\n@@ -1,2 +1,2 @@\n-a\n*b\n"},
+		{"invalid binary line", "diff --git a/x b/x\nindex 1..2\nGIT binary patch\nliteral 3\nA.....\n\n"},
+		{"wrong binary size", "diff --git a/x b/x\nindex 1..2\nGIT binary patch\nliteral 1\nHcmV?d00001\n\n"},
+	}
+	for _, test := range tests {
+		if _, err := parsePatch([]byte(test.patch)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestPatchContentsWithoutBase(t *testing.T) {
+	// only lines in hunks are known, the rest are empty lines
+	tests := []struct {
+		name          string
+		patch         string
+		before, after string
+	}{
+		{
+			"modified",
+			"--- a/a.txt\n+++ b/a.txt\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+			"a\nb\nc\n", "a\nB\nc\n",
+		},
+		{
+			"lines between hunks",
+			"--- a/a.txt\n+++ b/a.txt\n@@ -2 +2 @@\n-b\n+B\n@@ -5,0 +6 @@\n+f\n",
+			"\nb\n\n\n\n", "\nB\n\n\n\nf\n",
+		},
+		{
+			"no newline at the end",
+			"--- a/a.txt\n+++ b/a.txt\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+			"a\nb", "a\nb\n",
+		},
+		{
+			"added",
+			"--- /dev/null\n+++ b/a.txt\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+			"", "a\nb\n",
+		},
+		{
+			"empty context line without a space",
+			"--- a/a.txt\n+++ b/a.txt\n@@ -1,3 +1,3 @@\n a\n\n-b\n+B\n",
+			"a\n\nb\n", "a\n\nB\n",
+		},
+	}
+	for _, test := range tests {
+		files, err := parsePatch([]byte(test.patch))
+		if err != nil {
+			t.Fatalf("%s: failed with '%s'", test.name, err)
+		}
+		fc, err := files[0].contents("")
+		if err != nil {
+			t.Fatalf("%s: contents() failed with '%s'", test.name, err)
+		}
+		if string(fc.before) != test.before || string(fc.after) != test.after {
+			t.Errorf("%s: got %q, %q, expected %q, %q", test.name, fc.before, fc.after, test.before, test.after)
+		}
+	}
+}
+
+func TestApplyHunks(t *testing.T) {
+	hunk := &patchHunk{beforeStart: 2, beforeCount: 3, afterStart: 2, afterCount: 3, lines: []string{" b", "-c", "+C", " d"}}
+	tests := []struct {
+		name string
+		base string
+		exp  string
+	}{
+		{"in place", "a\nb\nc\nd\ne\n", "a\nb\nC\nd\ne\n"},
+		{"lines added before", "x\ny\na\nb\nc\nd\ne\n", "x\ny\na\nb\nC\nd\ne\n"},
+		{"lines removed before", "b\nc\nd\ne\n", "b\nC\nd\ne\n"},
+		{"no newline at the end", "a\nb\nc\nd\ne", "a\nb\nC\nd\ne"},
+		{"doesn't apply", "a\nb\nx\nd\n", ""},
+	}
+	for _, test := range tests {
+		got, err := applyHunks([]byte(test.base), []*patchHunk{hunk})
+		if test.exp == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.name, got)
+			}
+			continue
+		}
+		if err != nil || string(got) != test.exp {
+			t.Errorf("%s: got %q, %v, expected %q", test.name, got, err, test.exp)
+		}
+	}
+}
+
+// binaryTestData returns contents of img.bin in gitBinaryPatch
+func binaryTestData(modified bool) []byte {
+	d := make([]byte, 2000)
+	for i := range d {
+		d[i] = byte(i*31 + (i>>3)*7)
+	}
+	if modified {
+		for i := 100; i < 110; i++ {
+			d[i] = 0xff
+		}
+	}
+	return d
+}
+
+// output of git diff --binary: img.bin changed a bit so it's a delta,
+// new.bin is a literal
+const gitBinaryPatch = `diff --git a/img.bin b/img.bin
+index 27a4c7bf08b502124e62b73bdc213199e2268c48..930910894944712d8d74443289b2c9984cccbf44 100644
+GIT binary patch
+delta 21
+Vcmcb>e}R8O3fF%)*qE2Z4gi*~4m$t<
+
+delta 21
+dcmcb>e}R8O3Rgk@y0f2!3<L7}Hs&R<0|05D2|@q>
+
+diff --git a/new.bin b/new.bin
+new file mode 100644
+index 0000000000000000000000000000000000000000..36720b133fde80b8fb7b1ccf1a3d905d832a5e55
+GIT binary patch
+literal 18
+QcmZQzWMcmRj{%7U04;t73IG5A
+
+literal 0
+HcmV?d00001
+
+`
+
+func TestParseBinaryPatch(t *testing.T) {
+	base, err := ioutil.TempDir("", "differ-patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	if err := ioutil.WriteFile(filepath.Join(base, "img.bin"), binaryTestData(false), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := parsePatch([]byte(gitBinaryPatch))
+	if err != nil {
+		t.Fatalf("parsePatch() failed with '%s'", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d files, expected 2", len(files))
+	}
+	img, added := files[0], files[1]
+	if !img.isBinary || img.binaryDelta == nil || img.binaryAfter != nil {
+		t.Errorf("img.bin should be a binary delta")
+	}
+	if !added.isBinary || added.change.Type != Added {
+		t.Errorf("new.bin should be an added binary file")
+	}
+
+	fc, err := img.contents(base)
+	if err != nil {
+		t.Fatalf("contents() of img.bin failed with '%s'", err)
+	}
+	if !bytes.Equal(fc.before, binaryTestData(false)) || !bytes.Equal(fc.after, binaryTestData(true)) {
+		t.Errorf("wrong contents of img.bin")
+	}
+	if gitBlobHash(fc.after) != "930910894944712d8d74443289b2c9984cccbf44" {
+		t.Errorf("img.bin has hash %s after applying the delta", gitBlobHash(fc.after))
+	}
+
+	// literals don't need the base
+	fc, err = added.contents("")
+	if err != nil {
+		t.Fatalf("contents() of new.bin failed with '%s'", err)
+	}
+	exp := bytes.Repeat([]byte{0, 1, 2, 3, 255, 254}, 3)
+	if len(fc.before) != 0 || !bytes.Equal(fc.after, exp) {
+		t.Errorf("new.bin: got %v, %v, expected empty, %v", fc.before, fc.after, exp)
+	}
+
+	// without the base we can't apply the delta
+	fc, err = img.contents("")
+	if err != nil || !bytes.HasPrefix(fc.after, []byte("Binary file")) {
+		t.Errorf("img.bin without base: got %q, %v", fc.after, err)
+	}
+}
+
+func TestBinaryLiteralRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 4, 26, 27, 52, 53, 1000, 100000} {
+		d := make([]byte, n)
+		rnd.Read(d)
+		var buf bytes.Buffer
+		buf.WriteString("diff --git a/x b/x\nindex 1..2\nGIT binary patch\n")
+		writeBinaryLiteral(&buf, d)
+		writeBinaryLiteral(&buf, nil)
+		files, err := parsePatch(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%d bytes: parsePatch() failed with '%s'", n, err)
+		}
+		if !bytes.Equal(files[0].binaryAfter, d) {
+			t.Errorf("%d bytes: got different data", n)
+		}
+		for _, l := range strings.Split(buf.String(), "\n") {
+			if len(l) > 66 {
+				t.Errorf("%d bytes: line %q is too long", n, l)
+				break
+			}
+		}
+	}
+}
+
+func TestApplyGitDelta(t *testing.T) {
+	src := []byte("hello world")
+	tests := []struct {
+		name  string
+		delta []byte
+		exp   string
+	}{
+		{
+			// copy 6 bytes from offset 0, insert "there"
+			"copy and insert",
+			[]byte{11, 11, 0x80 | 0x10, 6, 5, 't', 'h', 'e', 'r', 'e'},
+			"hello there",
+		},
+		{
+			// copy 5 bytes from offset 6 and 6 bytes from offset 0
+			"copy with offset",
+			[]byte{11, 11, 0x80 | 0x01 | 0x10, 6, 5, 1, ' ', 0x80 | 0x10, 5},
+			"world hello",
+		},
+		{"wrong multi byte result size", []byte{11, 0x80 | 0x2c, 1, 0x80 | 0x10, 11}, ""},
+		{"wrong source size", []byte{10, 11, 0x80 | 0x10, 11}, ""},
+		{"wrong result size", []byte{11, 12, 0x80 | 0x10, 11}, ""},
+		{"copy past the end", []byte{11, 11, 0x80 | 0x01 | 0x10, 6, 6}, ""},
+		{"insert past the end", []byte{11, 11, 5, 'a'}, ""},
+		{"zero op", []byte{11, 0, 0}, ""},
+		{"truncated", []byte{11}, ""},
+	}
+	for _, test := range tests {
+		got, err := applyGitDelta(src, test.delta)
+		if test.exp == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.name, got)
+			}
+			continue
+		}
+		if err != nil || string(got) != test.exp {
+			t.Errorf("%s: got %q, %v, expected %q", test.name, got, err, test.exp)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// width of -stat output, like git
+	statWidth = 80
+	// longer names are shortened to "...${end of the name}"
+	statMaxNameWidth = 50
+)
+
+var (
+	// set with -print, -stat and -name-status flags
+	flgPrint      bool
+	flgStat       bool
+	flgNameStatus bool
+	// set with -color flag: auto, always or never
+	flgColor = "auto"
+	// set with -pager flag
+	flgPager = true
+)
+
+func isValidColorMode(s string) bool {
+	return s == "auto" || s == "always" || s == "never"
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// useColor returns true if output to stdout should be colored. Like other
+// tools, we honor NO_COLOR (https://no-color.org) and TERM=dumb
+func useColor() bool {
+	switch flgColor {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(os.Stdout)
+}
+
+// startPager starts $PAGER (less by default) if stdout is a terminal. It
+// returns nil if output should go directly to stdout
+func startPager() (*exec.Cmd, io.WriteCloser) {
+	if !flgPager || !isTerminal(os.Stdout) {
+		return nil, nil
+	}
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less"
+	}
+	args := strings.Fields(pager)
+	if len(args) == 0 || args[0] == "cat" {
+		return nil, nil
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		LogVerbosef("not using pager '%s': %s\n", pager, err)
+		return nil, nil
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if os.Getenv("LESS") == "" {
+		// like git: quit if output fits on one screen, show colors and
+		// don't clear the screen
+		cmd.Env = append(os.Environ(), "LESS=FRX")
+	}
+	w, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		LogErrorf("starting pager '%s' failed with '%s'\n", pager, err)
+		return nil, nil
+	}
+	return cmd, w
+}
+
+// nameStatus returns status of a change as shown by git diff --name-status
+func nameStatus(c *GitChange) string {
+	switch c.Type {
+	case Added, NotCheckedIn:
+		return "A"
+	case Deleted:
+		return "D"
+	case Renamed:
+		return "R"
+	case Copied:
+		return "C"
+	case Unmerged:
+		return "U"
+	}
+	return "M"
+}
+
+// writeNameStatus writes a line with status and names of each change
+func writeNameStatus(w io.Writer, s *Session, changes []*Change) error {
+	for _, gc := range changes {
+		c := &gc.GitChange
+		nameBefore, nameAfter := s.changeNames(c)
+		status := nameStatus(c)
+		if c.Type != Renamed && c.Type != Copied {
+			fmt.Fprintf(w, "%s\t%s\n", status, nameAfter)
+			continue
+		}
+		fc, err := s.source.readContents(c)
+		if err != nil {
+			return fmt.Errorf("failed to read '%s': %s", c.GetPath(), err)
+		}
+		sim := contentsSimilarity(fc.before, fc.after)
+		fmt.Fprintf(w, "%s%03d\t%s\t%s\n", status, sim, nameBefore, nameAfter)
+	}
+	return nil
+}
+
+// fileStat is a line of -stat output
+type fileStat struct {
+	name       string
+	insertions int
+	deletions  int
+	isBinary   bool
+	isUnmerged bool
+	sizeBefore int
+	sizeAfter  int
+}
+
+func newFileStat(s *Session, c *GitChange) (*fileStat, error) {
+	nameBefore, nameAfter := s.changeNames(c)
+	res := &fileStat{name: nameAfter}
+	if nameBefore != nameAfter {
+		res.name = nameBefore + " => " + nameAfter
+	}
+	if c.Type == Unmerged {
+		res.isUnmerged = true
+		return res, nil
+	}
+	fc, err := s.source.readContents(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %s", c.GetPath(), err)
+	}
+	if isBinaryData(fc.before) || isBinaryData(fc.after) {
+		res.isBinary = true
+		res.sizeBefore, res.sizeAfter = len(fc.before), len(fc.after)
+		return res, nil
+	}
+	opts := diffOptions{Algorithm: diffAlgorithm, Context: 0, whitespaceOptions: defaultWhitespaceOptions}
+	for _, h := range computeDiff(fc.before, fc.after, opts).Hunks {
+		for _, l := range h.Lines {
+			switch l.Op {
+			case OpInsert:
+				res.insertions++
+			case OpDelete:
+				res.deletions++
+			}
+		}
+	}
+	return res, nil
+}
+
+// scaleStat scales n out of max changes to a graph of width characters, like
+// git. Any change is at least 1 character
+func scaleStat(n, max, width int) int {
+	if max <= width || n == 0 {
+		return n
+	}
+	if width <= 1 {
+		return 1
+	}
+	return (n*(width-1))/max + 1
+}
+
+func plural(n int, s string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, s)
+	}
+	return fmt.Sprintf("%d %ss", n, s)
+}
+
+// writeStat writes number of changed lines in each change, like git diff
+// --stat
+func writeStat(w io.Writer, s *Session, changes []*Change, color bool) error {
+	var stats []*fileStat
+	nameWidth, maxChanges := 0, 0
+	for _, gc := range changes {
+		st, err := newFileStat(s, &gc.GitChange)
+		if err != nil {
+			return err
+		}
+		stats = append(stats, st)
+		nameWidth = maxInt(nameWidth, len(st.name))
+		maxChanges = maxInt(maxChanges, st.insertions+st.deletions)
+	}
+	nameWidth = minInt(nameWidth, statMaxNameWidth)
+	numWidth := len(fmt.Sprintf("%d", maxChanges))
+	graphWidth := maxInt(statWidth-nameWidth-numWidth-6, 10)
+
+	totalIns, totalDel := 0, 0
+	for _, st := range stats {
+		name := st.name
+		if len(name) > nameWidth {
+			name = "..." + name[len(name)-nameWidth+3:]
+		}
+		fmt.Fprintf(w, " %-*s | ", nameWidth, name)
+		switch {
+		case st.isUnmerged:
+			io.WriteString(w, "Unmerged\n")
+			continue
+		case st.isBinary:
+			fmt.Fprintf(w, "Bin %d -> %d bytes\n", st.sizeBefore, st.sizeAfter)
+			continue
+		}
+		totalIns += st.insertions
+		totalDel += st.deletions
+		fmt.Fprintf(w, "%*d", numWidth, st.insertions+st.deletions)
+		plus := strings.Repeat("+", scaleStat(st.insertions, maxChanges, graphWidth))
+		minus := strings.Repeat("-", scaleStat(st.deletions, maxChanges, graphWidth))
+		if plus+minus != "" {
+			if color {
+				plus = ansiGreen + plus + ansiReset
+				minus = ansiRed + minus + ansiReset
+			}
+			fmt.Fprintf(w, " %s%s", plus, minus)
+		}
+		io.WriteString(w, "\n")
+	}
+	summary := " " + plural(len(stats), "file") + " changed"
+	if totalIns > 0 {
+		summary += ", " + plural(totalIns, "insertion") + "(+)"
+	}
+	if totalDel > 0 {
+		summary += ", " + plural(totalDel, "deletion") + "(-)"
+	}
+	fmt.Fprintf(w, "%s\n", summary)
+	return nil
+}
+
+// writeColoredPatch writes changes as a patch, colored like git diff
+func writeColoredPatch(w io.Writer, s *Session, changes []*Change) error {
+	var buf bytes.Buffer
+	if err := s.writePatch(&buf, changes); err != nil {
+		return err
+	}
+	// lines in headers of files are bold, in hunks colored by their prefix
+	// and data of binary patches isn't colored
+	const (
+		inHeader = iota
+		inHunk
+		inBinary
+	)
+	state := inHeader
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "diff --git ") || strings.HasPrefix(line, "* Unmerged path ") {
+			state = inHeader
+		}
+		style := ""
+		switch {
+		case state == inBinary:
+		case strings.HasPrefix(line, "@@ "):
+			state = inHunk
+			style = ansiCyan
+		case state == inHeader:
+			style = ansiBold
+			if line == "GIT binary patch\n" {
+				state = inBinary
+			}
+		case strings.HasPrefix(line, "-"):
+			style = ansiRed
+		case strings.HasPrefix(line, "+"):
+			style = ansiGreen
+		}
+		text := strings.TrimSuffix(line, "\n")
+		if style != "" {
+			text = style + text + ansiReset
+		}
+		io.WriteString(w, text+"\n")
+	}
+	return nil
+}
+
+// printChanges writes changes to stdout, through a pager if it's a terminal
+func printChanges(w io.Writer, s *Session, changes []*Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	color := useColor()
+	if flgNameStatus || (flgPrint && !flgStat) {
+		if err := writeNameStatus(w, s, changes); err != nil {
+			return err
+		}
+	}
+	if flgStat {
+		if err := writeStat(w, s, changes, color); err != nil {
+			return err
+		}
+	}
+	if !flgPrint {
+		return nil
+	}
+	io.WriteString(w, "\n")
+	if color {
+		return writeColoredPatch(w, s, changes)
+	}
+	return s.writePatch(w, changes)
+}
+
+// printChangesAndExit implements -print, -stat and -name-status. Like diff,
+// exits with 1 if there are differences, 0 if not and 2 on errors
+func printChangesAndExit(s *Session) {
+	changes := s.getChanges()
+
+	var out io.Writer = os.Stdout
+	pager, pagerIn := startPager()
+	if pager != nil {
+		out = pagerIn
+	}
+	w := bufio.NewWriter(out)
+	err := printChanges(w, s, changes)
+	// write errors only happen if the pager was closed early, which is fine
+	w.Flush()
+	if pager != nil {
+		pagerIn.Close()
+		pager.Wait()
+	}
+	if err != nil {
+		LogErrorf("%s\n", err)
+		os.Exit(2)
+	}
+	if len(changes) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	// minimum similarity (in percent) of a deleted and added file to be
+	// considered a rename, like git's -M50%. 0 disables rename detection
+	renameThreshold = 50
+	// if true, also detect added files that are copies of modified files,
+	// like git's -C
+	findCopies = false
+	// if true, any file that existed before can be the source of a copy, like
+	// git's --find-copies-harder
+	findCopiesHarder = false
+	// inexact detection compares every pair so we skip it for too many files,
+	// like git's diff.renameLimit
+	renameLimit = 1000
+	// bigger files are only detected as renamed or copied if identical
+	renameMaxFileSize int64 = 16 * 1024 * 1024
+)
+
+// a file considered as a source or destination of a rename or copy. We only
+// know its size up front, hash and lines are read when needed
+type renameCandidate struct {
+	change   *GitChange
+	path     string
+	fi       FileInfo
+	size     int64
+	hash     string
+	lines    map[string]int
+	consumed bool
+}
+
+func newRenameCandidate(c *GitChange, path string, fi FileInfo) *renameCandidate {
+	return &renameCandidate{
+		change: c,
+		path:   path,
+		fi:     fi,
+		size:   fi.Size,
+	}
+}
+
+// getHash returns sha1 of the file, from hashCache if possible
+func (rc *renameCandidate) getHash() (string, error) {
+	if rc.hash != "" {
+		return rc.hash, nil
+	}
+	var err error
+	if hashCache != nil {
+		rc.hash, err = hashCache.fileHash(rc.path, rc.fi)
+	} else {
+		rc.hash, err = sha1OfFile(rc.path)
+	}
+	return rc.hash, err
+}
+
+// getLines reads the file and returns how many times each line occurs
+func (rc *renameCandidate) getLines() (map[string]int, error) {
+	if rc.lines != nil {
+		return rc.lines, nil
+	}
+	d, err := ioutil.ReadFile(rc.path)
+	if err != nil {
+		return nil, err
+	}
+	rc.lines = countLines(d)
+	return rc.lines, nil
+}
+
+// countLines returns how many times each line occurs in d. A line includes
+// the newline so that counts sum up to the size of d
+func countLines(d []byte) map[string]int {
+	res := make(map[string]int)
+	for len(d) > 0 {
+		n := bytes.IndexByte(d, '\n') + 1
+		if n == 0 {
+			n = len(d)
+		}
+		res[string(d[:n])]++
+		d = d[n:]
+	}
+	return res
+}
+
+// similarity returns how similar 2 files are, in percent, as the number
+// of bytes in lines they share vs. the size of the bigger file
+func similarity(c1, c2 *renameCandidate) int {
+	maxSize := c1.size
+	if c2.size > maxSize {
+		maxSize = c2.size
+	}
+	if maxSize == 0 {
+		return 100
+	}
+	lines1, lines2 := c1.lines, c2.lines
+	if len(lines2) < len(lines1) {
+		lines1, lines2 = lines2, lines1
+	}
+	var shared int64
+	for line, n1 := range lines1 {
+		n2 := lines2[line]
+		if n2 < n1 {
+			n1 = n2
+		}
+		shared += int64(n1 * len(line))
+	}
+	return int(shared * 100 / maxSize)
+}
+
+// maxSimilarity is an upper bound of similarity based only on file sizes
+func maxSimilarity(c1, c2 *renameCandidate) int {
+	minSize, maxSize := c1.size, c2.size
+	if minSize > maxSize {
+		minSize, maxSize = maxSize, minSize
+	}
+	if maxSize == 0 {
+		return 100
+	}
+	return int(minSize * 100 / maxSize)
+}
+
+type renamePair struct {
+	src   *renameCandidate
+	dst   *renameCandidate
+	score int
+}
+
+// matchExact pairs dst with srcs of identical content. Only files of the
+// same size are hashed. If consumeSrc is true, a src can only be matched
+// once (renames as opposed to copies)
+func matchExact(srcs, dsts []*renameCandidate, consumeSrc bool) ([]renamePair, error) {
+	bySize := make(map[int64][]*renameCandidate)
+	for _, src := range srcs {
+		if !src.consumed {
+			bySize[src.size] = append(bySize[src.size], src)
+		}
+	}
+	var res []renamePair
+	for _, dst := range dsts {
+		sameSize := bySize[dst.size]
+		if dst.consumed || len(sameSize) == 0 {
+			continue
+		}
+		dstHash, err := dst.getHash()
+		if err != nil {
+			return nil, err
+		}
+		for _, src := range sameSize {
+			if src.consumed {
+				continue
+			}
+			srcHash, err := src.getHash()
+			if err != nil {
+				return nil, err
+			}
+			if srcHash != dstHash {
+				continue
+			}
+			res = append(res, renamePair{src, dst, 100})
+			dst.consumed = true
+			src.consumed = consumeSrc
+			break
+		}
+	}
+	return res, nil
+}
+
+// matchSimilar pairs dst with the most similar src, best scores first.
+// Lines are only read for pairs whose sizes are close enough
+func matchSimilar(srcs, dsts []*renameCandidate, threshold int, consumeSrc bool) ([]renamePair, error) {
+	var candidates []renamePair
+	for _, dst := range dsts {
+		if dst.consumed {
+			continue
+		}
+		for _, src := range srcs {
+			if src.consumed || maxSimilarity(src, dst) < threshold {
+				continue
+			}
+			if _, err := src.getLines(); err != nil {
+				return nil, err
+			}
+			if _, err := dst.getLines(); err != nil {
+				return nil, err
+			}
+			if score := similarity(src, dst); score >= threshold {
+				candidates = append(candidates, renamePair{src, dst, score})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	var res []renamePair
+	for _, p := range candidates {
+		if p.dst.consumed || p.src.consumed {
+			continue
+		}
+		res = append(res, p)
+		p.dst.consumed = true
+		p.src.consumed = consumeSrc
+	}
+	return res, nil
+}
+
+// notConsumed returns candidates that are not yet matched and, if maxSize
+// is > 0, are not bigger than maxSize
+func notConsumed(candidates []*renameCandidate, maxSize int64) []*renameCandidate {
+	var res []*renameCandidate
+	for _, rc := range candidates {
+		if !rc.consumed && (maxSize <= 0 || rc.size <= maxSize) {
+			res = append(res, rc)
+		}
+	}
+	return res
+}
+
+func matchRenamesOrCopies(srcs, dsts []*renameCandidate, threshold int, consumeSrc bool) ([]renamePair, error) {
+	res, err := matchExact(srcs, dsts, consumeSrc)
+	if err != nil || threshold >= 100 {
+		return res, err
+	}
+	srcsLeft := notConsumed(srcs, renameMaxFileSize)
+	dstsLeft := notConsumed(dsts, renameMaxFileSize)
+	if len(srcsLeft) == 0 || len(dstsLeft) == 0 {
+		return res, nil
+	}
+	if len(srcsLeft) > renameLimit || len(dstsLeft) > renameLimit {
+		LogErrorf("Too many files (%d, %d) for inexact rename detection, limit is %d\n", len(srcsLeft), len(dstsLeft), renameLimit)
+		return res, nil
+	}
+	similar, err := matchSimilar(srcsLeft, dstsLeft, threshold, consumeSrc)
+	if err != nil {
+		return nil, err
+	}
+	return append(res, similar...), nil
+}
+
+// detectRenames turns pairs of Deleted and Added changes into Renamed and,
+// if findCopies is true, Added changes similar to a modified file (or, with
+// findCopiesHarder, any file in rootBefore) into Copied. Files are only read
+// if their sizes make a match possible
+func detectRenames(changes []*GitChange, rootBefore, rootAfter string, filesBefore, filesAfter map[string]FileInfo) ([]*GitChange, error) {
+	if renameThreshold <= 0 {
+		return changes, nil
+	}
+	var deleted, modified, added []*renameCandidate
+	deletedPaths := make(map[string]bool)
+	for _, c := range changes {
+		switch c.Type {
+		case Deleted:
+			fi := filesBefore[relPath(rootBefore, c.PathBefore)]
+			deleted = append(deleted, newRenameCandidate(c, c.PathBefore, fi))
+			deletedPaths[c.PathBefore] = true
+		case Modified:
+			fi := filesBefore[relPath(rootBefore, c.PathBefore)]
+			modified = append(modified, newRenameCandidate(nil, c.PathBefore, fi))
+		case Added:
+			fi := filesAfter[relPath(rootAfter, c.PathAfter)]
+			added = append(added, newRenameCandidate(c, c.PathAfter, fi))
+		}
+	}
+	if len(added) == 0 {
+		return changes, nil
+	}
+
+	renames, err := matchRenamesOrCopies(deleted, added, renameThreshold, true)
+	if err != nil {
+		return nil, err
+	}
+	var copies []renamePair
+	if findCopies || findCopiesHarder {
+		srcs := append(deleted, modified...)
+		if findCopiesHarder {
+			// source of a copy can be any file that existed before
+			srcs = deleted
+			for path, fi := range filesBefore {
+				fullPath := filepath.Join(rootBefore, path)
+				if !deletedPaths[fullPath] {
+					srcs = append(srcs, newRenameCandidate(nil, fullPath, fi))
+				}
+			}
+		}
+		for _, src := range srcs {
+			src.consumed = false
+		}
+		if copies, err = matchRenamesOrCopies(srcs, added, renameThreshold, false); err != nil {
+			return nil, err
+		}
+	}
+
+	// a rename replaces deleted and added change, a copy replaces added change
+	replaced := make(map[*GitChange]*GitChange)
+	for _, p := range renames {
+		replaced[p.src.change] = nil
+		replaced[p.dst.change] = &GitChange{
+			PathBefore: p.src.path,
+			PathAfter:  p.dst.path,
+			Type:       Renamed,
+		}
+	}
+	for _, p := range copies {
+		replaced[p.dst.change] = &GitChange{
+			PathBefore: p.src.path,
+			PathAfter:  p.dst.path,
+			Type:       Copied,
+		}
+	}
+	var res []*GitChange
+	for _, c := range changes {
+		newChange, ok := replaced[c]
+		if !ok {
+			res = append(res, c)
+		} else if newChange != nil {
+			res = append(res, newChange)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tenLines returns 10 lines of 10 bytes where lines in changed are
+// different, so that files only differing in changed lines are
+// 100 - 10 * len(changed) percent similar
+func tenLines(name string, changed ...int) string {
+	var lines []string
+	for i := 0; i < 10; i++ {
+		l := fmt.Sprintf("line %04d\n", i)
+		for _, c := range changed {
+			if c == i {
+				l = fmt.Sprintf("%-4s %04d\n", name, i)
+			}
+		}
+		lines = append(lines, l)
+	}
+	return strings.Join(lines, "")
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		exp  int
+	}{
+		{"", "", 100},
+		{tenLines("x"), tenLines("x"), 100},
+		{tenLines("x"), tenLines("x", 0), 90},
+		{tenLines("x"), tenLines("x", 0, 5, 9), 70},
+		{tenLines("x", 1, 2), tenLines("y", 1, 2), 80},
+		{tenLines("x"), "", 0},
+		// lines are compared as a set, order doesn't matter
+		{"a\nb\nc\n", "c\nb\na\n", 100},
+		// similarity is relative to the bigger file
+		{"a\nb\n", "a\nb\nc\nd\n", 50},
+		// repeated lines only count as many times as they're in both
+		{"a\na\na\na\n", "a\nb\nb\nb\n", 25},
+		// the last line without a newline is different
+		{"a\nb\n", "a\nb", 50},
+	}
+	for _, test := range tests {
+		got := contentsSimilarity([]byte(test.a), []byte(test.b))
+		if got != test.exp {
+			t.Errorf("%q, %q: got %d, expected %d", test.a, test.b, got, test.exp)
+		}
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for path, s := range files {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDetectRenames(t *testing.T) {
+	defer func(threshold int, copies, harder bool) {
+		renameThreshold, findCopies, findCopiesHarder = threshold, copies, harder
+	}(renameThreshold, findCopies, findCopiesHarder)
+
+	tests := []struct {
+		name           string
+		threshold      int
+		copies, harder bool
+		before, after  map[string]string
+		exp            []string
+	}{
+		{
+			"identical", 50, false, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"b.txt": tenLines("x")},
+			[]string{"Renamed a.txt b.txt"},
+		},
+		{
+			"moved to a directory", 50, false, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"dir/a.txt": tenLines("x", 3)},
+			[]string{"Renamed a.txt dir/a.txt"},
+		},
+		{
+			"above threshold", 50, false, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"b.txt": tenLines("x", 0, 1, 2, 3)},
+			[]string{"Renamed a.txt b.txt"},
+		},
+		{
+			"at threshold", 50, false, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"b.txt": tenLines("x", 0, 1, 2, 3, 4)},
+			[]string{"Renamed a.txt b.txt"},
+		},
+		{
+			"below threshold", 50, false, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"b.txt": tenLines("x", 0, 1, 2, 3, 4, 5)},
+			[]string{"Added  b.txt", "Deleted a.txt "},
+		},
+		{
+			"higher threshold", 70, false, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"b.txt": tenLines("x", 0, 1, 2, 3)},
+			[]string{"Added  b.txt", "Deleted a.txt "},
+		},
+		{
+			"only identical at 100", 100, false, false,
+			map[string]string{"a.txt": tenLines("x"), "c.txt": "other\n"},
+			map[string]string{"b.txt": tenLines("x", 0), "d.txt": "other\n"},
+			[]string{"Added  b.txt", "Deleted a.txt ", "Renamed c.txt d.txt"},
+		},
+		{
+			"disabled", 0, false, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"b.txt": tenLines("x")},
+			[]string{"Added  b.txt", "Deleted a.txt "},
+		},
+		{
+			"most similar wins", 50, false, false,
+			map[string]string{"a.txt": tenLines("x", 0, 1, 2), "b.txt": tenLines("x", 0)},
+			map[string]string{"c.txt": tenLines("x")},
+			[]string{"Deleted a.txt ", "Renamed b.txt c.txt"},
+		},
+		{
+			"a deleted file is renamed only once", 50, false, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"b.txt": tenLines("x"), "c.txt": tenLines("x", 0)},
+			[]string{"Added  c.txt", "Renamed a.txt b.txt"},
+		},
+		{
+			"no copies without -C", 50, false, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"a.txt": tenLines("x", 9), "b.txt": tenLines("x", 0)},
+			[]string{"Added  b.txt", "Modified a.txt a.txt"},
+		},
+		{
+			"copy of a modified file", 50, true, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"a.txt": tenLines("x", 9), "b.txt": tenLines("x", 0)},
+			[]string{"Copied a.txt b.txt", "Modified a.txt a.txt"},
+		},
+		{
+			"copy below threshold", 50, true, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"a.txt": tenLines("x", 9), "b.txt": tenLines("y", 0, 1, 2, 3, 4, 5)},
+			[]string{"Added  b.txt", "Modified a.txt a.txt"},
+		},
+		{
+			"copy of an unmodified file needs -find-copies-harder", 50, true, false,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"a.txt": tenLines("x"), "b.txt": tenLines("x", 0)},
+			[]string{"Added  b.txt"},
+		},
+		{
+			"copy of an unmodified file", 50, false, true,
+			map[string]string{"a.txt": tenLines("x")},
+			map[string]string{"a.txt": tenLines("x"), "b.txt": tenLines("x", 0)},
+			[]string{"Copied a.txt b.txt"},
+		},
+		{
+			"renames take precedence over copies", 50, true, false,
+			map[string]string{"a.txt": tenLines("x"), "b.txt": tenLines("x", 0)},
+			map[string]string{"a.txt": tenLines("x", 9), "c.txt": tenLines("x", 0)},
+			[]string{"Modified a.txt a.txt", "Renamed b.txt c.txt"},
+		},
+	}
+	for _, test := range tests {
+		renameThreshold, findCopies, findCopiesHarder = test.threshold, test.copies, test.harder
+		dir, err := ioutil.TempDir("", "differ-renames")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirBefore, dirAfter := filepath.Join(dir, "before"), filepath.Join(dir, "after")
+		writeTestFiles(t, dirBefore, test.before)
+		writeTestFiles(t, dirAfter, test.after)
+		changes, err := dirDiff(dirBefore, dirAfter)
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Fatalf("%s: dirDiff() failed with '%s'", test.name, err)
+		}
+		var got []string
+		for _, c := range changes {
+			got = append(got, fmt.Sprintf("%s %s %s", gitTypeToString(c.Type),
+				filepath.ToSlash(relPathOrEmpty(dirBefore, c.PathBefore)),
+				filepath.ToSlash(relPathOrEmpty(dirAfter, c.PathAfter))))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: got %q, expected %q", test.name, got, test.exp)
+		}
+	}
+}
+
+func relPathOrEmpty(root, path string) string {
+	if path == "" {
+		return ""
+	}
+	return relPath(root, path)
+}
@@ -6,4 +6,4 @@ set -o pipefail
 
 ./node_modules/.bin/gulp default
 
-go run empty_resources.go handlers.go log.go utils.go git.go main.go	templates.go dirdiff.go -dev $@
+go run empty_resources.go handlers.go log.go utils.go git.go main.go	templates.go dirdiff.go imgdiff.go conflict.go watch.go watch_linux.go watch_other.go renames.go ignore.go hashcache.go contents.go diff.go intraline.go whitespace.go moves.go patch.go patchfile.go export.go tui.go print.go server.go auth.go static.go clients.go session.go daemon.go -dev $@
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how long we wait for requests in progress when shutting down
+const shutdownTimeout = 5 * time.Second
+
+var (
+	// set with -addr and -port flags
+	flgAddr = "127.0.0.1"
+	flgPort = 6111
+	// true if -port was given, in which case we don't fall back to a
+	// random port
+	flgPortSet bool
+
+	// path of a file that tells other tools about this instance, removed
+	// when we exit
+	stateFilePath string
+
+	httpServer   = &http.Server{}
+	shutdownOnce sync.Once
+	// closed when shutdown starts, so that long running requests like
+	// /events can finish
+	serverDone = make(chan struct{})
+	// closed when shutdown is finished
+	shutdownDone = make(chan struct{})
+)
+
+// instanceState is written to a state file so that other tools can find
+// running instances of differ
+type instanceState struct {
+	Pid int    `json:"pid"`
+	URL string `json:"url"`
+	// send it in X-Differ-Token header or open /login?token=${token}
+	Token   string    `json:"token"`
+	Dir     string    `json:"dir"`
+	Args    []string  `json:"args"`
+	Started time.Time `json:"started"`
+}
+
+// listen listens on -addr and -port. If the port is taken and wasn't
+// explicitly asked for, we let the OS pick a free one, so that differ can
+// run for several repositories at once
+func listen() (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(flgAddr, strconv.Itoa(flgPort)))
+	if err == nil || flgPortSet {
+		return l, err
+	}
+	LogVerbosef("listening on port %d failed with '%s', using a random port\n", flgPort, err)
+	return net.Listen("tcp", net.JoinHostPort(flgAddr, "0"))
+}
+
+// serverURL returns url of the server listening on l
+func serverURL(l net.Listener) string {
+	host := flgAddr
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		// listening on all interfaces, localhost is one of them
+		host = "127.0.0.1"
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// stateDir returns directory with state files of running instances, one
+// per process: ${user cache dir}/differ/instances/${pid}.json
+func stateDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "differ", "instances"), nil
+}
+
+// writeStateFile writes url and other information about this instance.
+// It's only readable by the user
+func writeStateFile(url string) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	cwd, _ := os.Getwd()
+	st := instanceState{
+		Pid:     os.Getpid(),
+		URL:     url,
+		Token:   sessionToken,
+		Dir:     cwd,
+		Args:    os.Args[1:],
+		Started: time.Now(),
+	}
+	d, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.json", st.Pid))
+	if err = ioutil.WriteFile(path, d, 0600); err != nil {
+		return err
+	}
+	// WriteFile doesn't change permissions of an existing file
+	if err = os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	stateFilePath = path
+	LogVerbosef("wrote state file '%s'\n", path)
+	return nil
+}
+
+func removeStateFile() {
+	if stateFilePath == "" {
+		return
+	}
+	if err := os.Remove(stateFilePath); err != nil && !os.IsNotExist(err) {
+		LogErrorf("os.Remove('%s') failed with '%s'\n", stateFilePath, err)
+	}
+}
+
+// shutdownServer gracefully stops the server: startWebServer returns once
+// requests in progress are finished
+func shutdownServer(reason string) {
+	shutdownOnce.Do(func() {
+		LogVerbosef("shutting down: %s\n", reason)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := httpServer.Shutdown(ctx); err != nil {
+				LogErrorf("httpServer.Shutdown() failed with '%s'\n", err)
+			}
+			close(shutdownDone)
+		}()
+	})
+}
+
+// shutdownOnSignal shuts down the server when we're killed with ctrl-c
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		shutdownServer("interrupted")
+		// a second ctrl-c exits right away
+		<-signals
+		removeStateFile()
+		os.Exit(1)
+	}()
+}
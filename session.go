@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// kinds of sessions
+	sessionGitStatus = "git-status"
+	sessionGitDiff   = "git-diff"
+	sessionDirs      = "dirs"
+	sessionPatch     = "patch"
+)
+
+// sessionSpec describes what a session shows. differ builds it from its
+// arguments and either shows the session itself or, if differ -daemon is
+// running, sends it to the daemon
+type sessionSpec struct {
+	Kind string `json:"kind"`
+	// root of the git repository, "" for the current directory
+	GitDir string `json:"git_dir,omitempty"`
+	// with sessionGitStatus: viewStaged, viewUnstaged or "" for both
+	View string `json:"view,omitempty"`
+	// with sessionGitDiff
+	RevBefore string `json:"rev_before,omitempty"`
+	RevAfter  string `json:"rev_after,omitempty"`
+	// with sessionDirs
+	DirBefore string `json:"dir_before,omitempty"`
+	DirAfter  string `json:"dir_after,omitempty"`
+	// with sessionPatch: the patch and directory it applies to
+	Patch     []byte `json:"patch,omitempty"`
+	PatchBase string `json:"patch_base,omitempty"`
+	// values of sessionFlags of differ that sent the spec to the daemon
+	Flags map[string]string `json:"flags,omitempty"`
+}
+
+func isGitSession(kind string) bool {
+	return kind == sessionGitStatus || kind == sessionGitDiff
+}
+
+// makeAbs makes directories in spec absolute, so that they can be used by
+// the daemon, which runs in a different directory
+func (spec *sessionSpec) makeAbs() error {
+	var err error
+	if isGitSession(spec.Kind) {
+		// "" is the current directory
+		if spec.GitDir, err = filepath.Abs(spec.GitDir); err != nil {
+			return err
+		}
+	}
+	for _, dir := range []*string{&spec.DirBefore, &spec.DirAfter, &spec.PatchBase} {
+		if *dir == "" {
+			continue
+		}
+		if *dir, err = filepath.Abs(*dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// title describes the session in the list of sessions of the daemon
+func (spec *sessionSpec) title() string {
+	switch spec.Kind {
+	case sessionGitStatus:
+		if spec.View != "" {
+			return spec.GitDir + " (" + spec.View + ")"
+		}
+		return spec.GitDir
+	case sessionGitDiff:
+		after := spec.RevAfter
+		switch after {
+		case revWorkTree:
+			after = "working tree"
+		case revIndex:
+			after = "index"
+		}
+		return fmt.Sprintf("%s (%s vs. %s)", spec.GitDir, spec.RevBefore, after)
+	case sessionDirs:
+		return spec.DirBefore + " vs. " + spec.DirAfter
+	}
+	if spec.PatchBase != "" {
+		return "patch of " + spec.PatchBase
+	}
+	return "patch"
+}
+
+// Session is a list of changes shown in the browser: in a git repository,
+// between 2 directories or in a patch. differ shows a single session,
+// differ -daemon one for each differ that registered with it
+type Session struct {
+	ID   string
+	spec *sessionSpec
+	// prefix of urls of the session, "" or "/s/${id}" in the daemon
+	urlPrefix string
+
+	source *changeSource
+	detect changeDetector
+	// false if changes can't change on disk, e.g. between 2 commits
+	canChange bool
+	// nil if we don't watch for changes
+	watcher *fileWatcher
+	// closed when the session is closed
+	done chan struct{}
+
+	// protects changes, generation and parts of changes filled lazily
+	mu      sync.Mutex
+	changes []*Change
+	// incremented every time changes are rebuilt
+	generation int
+
+	contentsCache    *contentsLRU
+	prefetchRequests chan int
+	moves            movesCache
+
+	eventsMu          sync.Mutex
+	eventsSubscribers map[chan []byte]bool
+}
+
+// newSession finds changes described by spec and starts loading their
+// contents in the background. Call startWatching to keep them up to date
+func newSession(spec *sessionSpec) (*Session, error) {
+	s := &Session{
+		spec:              spec,
+		contentsCache:     newContentsLRU(contentsCacheMB * 1024 * 1024),
+		prefetchRequests:  make(chan int, 1),
+		eventsSubscribers: make(map[chan []byte]bool),
+		done:              make(chan struct{}),
+	}
+	switch spec.Kind {
+	case sessionGitStatus:
+		s.source = newGitSource(spec.GitDir)
+		s.detect = func() ([]*GitChange, error) {
+			return gitStatus(spec.GitDir, spec.View)
+		}
+		s.canChange = true
+	case sessionGitDiff:
+		s.source = newGitSource(spec.GitDir)
+		s.detect = func() ([]*GitChange, error) {
+			return gitDiff(spec.GitDir, spec.RevBefore, spec.RevAfter)
+		}
+		// only changes in the working tree or the index can change on disk
+		s.canChange = spec.RevAfter == revWorkTree || spec.RevAfter == revIndex
+	case sessionDirs:
+		s.source = dirSource
+		s.detect = func() ([]*GitChange, error) {
+			return dirDiff(spec.DirBefore, spec.DirAfter)
+		}
+		s.canChange = true
+	case sessionPatch:
+		changes, src, err := parsePatchChanges(spec.Patch, spec.PatchBase)
+		if err != nil {
+			return nil, err
+		}
+		s.source = src
+		s.detect = func() ([]*GitChange, error) {
+			return changes, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown kind of session '%s'", spec.Kind)
+	}
+	changes, err := s.detect()
+	if err != nil {
+		return nil, err
+	}
+	dumpGitChanges(changes)
+	s.changes = s.buildChanges(changes, nil, nil)
+	go s.prefetcher()
+	go s.loadImagesInfo()
+	s.prefetchContents(0)
+	return s, nil
+}
+
+// startWatching rebuilds changes when files they come from change on disk
+func (s *Session) startWatching() {
+	if !s.canChange {
+		return
+	}
+	if isGitSession(s.spec.Kind) {
+		s.startWatchingGit()
+		return
+	}
+	s.startWatchingDirs()
+}
+
+// close stops watching for changes and loading contents in the background
+// and frees cached contents. Requests in progress can still use the session
+func (s *Session) close() {
+	close(s.done)
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
+	s.contentsCache.removeIf(func(GitChange) bool {
+		return true
+	})
+}
+
+// getChanges returns the current list of changes
+func (s *Session) getChanges() []*Change {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changes
+}
+
+// getChangeByIdx returns a change or nil if idx is not valid
+func (s *Session) getChangeByIdx(idx int) *Change {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idx < 0 || idx >= len(s.changes) {
+		return nil
+	}
+	return s.changes[idx]
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	staticDir = "www/static"
+	// when a file is not in the manifest in dev mode, we re-build the
+	// manifest at most that often so that requests for missing files can't
+	// make us walk the directory over and over
+	staticManifestRebuildInterval = time.Second
+)
+
+var (
+	// paths of static files we serve, like "www/static/dist/main.css".
+	// Only files in the manifest are served, so urls can't reach other
+	// files e.g. with "..". Matching is case-sensitive
+	staticManifest          map[string]bool
+	staticManifestBuildTime time.Time
+	staticManifestMu        sync.Mutex
+)
+
+// buildStaticManifest returns files in www/static, from the zip embedded
+// in the binary or from disk in dev mode. Symlinks are not followed
+func buildStaticManifest() map[string]bool {
+	res := make(map[string]bool)
+	if hasZipResources() {
+		for name := range resourcesFromZip {
+			// .gz files are compressed versions of other files
+			if strings.HasPrefix(name, staticDir+"/") && !strings.HasSuffix(name, ".gz") {
+				res[name] = true
+			}
+		}
+		return res
+	}
+	filepath.Walk(staticDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			LogErrorf("skipping '%s' in static manifest, error: '%s'\n", path, err)
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			res[filepath.ToSlash(path)] = true
+		}
+		return nil
+	})
+	return res
+}
+
+// must be called with staticManifestMu locked
+func rebuildStaticManifestLocked() {
+	staticManifest = buildStaticManifest()
+	staticManifestBuildTime = time.Now()
+	LogVerbosef("%d files in static manifest\n", len(staticManifest))
+}
+
+// isStaticFile returns true if path is in the manifest. In dev mode files
+// are re-built while we run, so we check the disk again if it isn't, unless
+// we did it recently
+func isStaticFile(path string) bool {
+	staticManifestMu.Lock()
+	defer staticManifestMu.Unlock()
+	if staticManifest == nil {
+		rebuildStaticManifestLocked()
+	}
+	if staticManifest[path] {
+		return true
+	}
+	if !flgDev || hasZipResources() || time.Since(staticManifestBuildTime) < staticManifestRebuildInterval {
+		return false
+	}
+	rebuildStaticManifestLocked()
+	return staticManifest[path]
+}
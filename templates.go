@@ -10,8 +10,9 @@ import (
 
 var (
 	tmplIndex     = "index.html"
-	templateNames = []string{tmplIndex}
-	templatePaths []string
+	tmplExport    = "export.html"
+	tmplSessions  = "sessions.html"
+	templateNames = []string{tmplIndex, tmplExport, tmplSessions}
 	templates     *template.Template
 
 	reloadTemplates = true
@@ -19,12 +20,13 @@ var (
 
 func getTemplates() *template.Template {
 	if reloadTemplates || (nil == templates) {
-		if 0 == len(templatePaths) {
-			for _, name := range templateNames {
-				templatePaths = append(templatePaths, filepath.Join("www", name))
-			}
+		t := template.New("")
+		for _, name := range templateNames {
+			d, err := readResource(filepath.Join("www", name))
+			fataliferr(err)
+			template.Must(t.New(name).Parse(string(d)))
 		}
-		templates = template.Must(template.ParseFiles(templatePaths...))
+		templates = t
 	}
 	return templates
 }
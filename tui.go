@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiDim     = "\x1b[2m"
+	ansiReverse = "\x1b[7m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiMagenta = "\x1b[35m"
+	ansiCyan    = "\x1b[36m"
+	ansiSearch  = "\x1b[30;43m"
+
+	// tabs are shown as that many spaces
+	tuiTabWidth = 4
+	// width of a column with line numbers
+	tuiLineNoWidth = 5
+	// with more changes files start collapsed, so that we don't have to
+	// read all of them before showing anything
+	tuiMaxExpandedChanges = 50
+	// how often we check if changes were refreshed or terminal was resized
+	tuiPollInterval = time.Second
+)
+
+var (
+	// set with -tui flag
+	flgTUI bool
+)
+
+// tuiSpan is a part of a line shown in a given style (ansi escape codes)
+type tuiSpan struct {
+	style string
+	text  string
+}
+
+// tuiRow is a line shown in the terminal ui
+type tuiRow struct {
+	spans []tuiSpan
+}
+
+func (r *tuiRow) add(style, text string) *tuiRow {
+	r.spans = append(r.spans, tuiSpan{style, text})
+	return r
+}
+
+func (r *tuiRow) plain() string {
+	var s string
+	for _, span := range r.spans {
+		s += span.text
+	}
+	return s
+}
+
+// tuiText makes text safe to show in the terminal: tabs are expanded and
+// control characters, which could be escape sequences, are replaced
+func tuiText(s string) string {
+	var buf bytes.Buffer
+	for _, c := range s {
+		switch {
+		case c == '\t':
+			buf.WriteString(strings.Repeat(" ", tuiTabWidth))
+		case c == '\r':
+			// of CRLF line endings
+		case unicode.IsControl(c):
+			buf.WriteRune('?')
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+// fitSpans truncates or pads spans to exactly width characters
+func fitSpans(spans []tuiSpan, width int) []tuiSpan {
+	var res []tuiSpan
+	n := 0
+	for _, s := range spans {
+		if n >= width {
+			break
+		}
+		text := s.text
+		if l := utf8.RuneCountInString(text); n+l > width {
+			text = string([]rune(text)[:width-n])
+		}
+		n += utf8.RuneCountInString(text)
+		res = append(res, tuiSpan{s.style, text})
+	}
+	if n < width {
+		res = append(res, tuiSpan{"", strings.Repeat(" ", width-n)})
+	}
+	return res
+}
+
+// lineSpans returns spans of a diff line in style, with changed words in
+// style plus reverse video
+func lineSpans(l *DiffLine, style string) []tuiSpan {
+	var res []tuiSpan
+	runes := []rune(l.Text)
+	pos := 0
+	for _, span := range l.WordSpans {
+		start, end := minInt(span.Start, len(runes)), minInt(span.End, len(runes))
+		if start > pos {
+			res = append(res, tuiSpan{style, tuiText(string(runes[pos:start]))})
+		}
+		if end > start {
+			res = append(res, tuiSpan{style + ansiReverse, tuiText(string(runes[start:end]))})
+		}
+		pos = maxInt(pos, end)
+	}
+	if pos < len(runes) {
+		res = append(res, tuiSpan{style, tuiText(string(runes[pos:]))})
+	}
+	return res
+}
+
+// lineStyle returns color of a deleted or inserted line, like git diff
+// --color-moved moved lines have a different color
+func lineStyle(l *DiffLine) string {
+	switch {
+	case l.MovedTo != nil:
+		return ansiMagenta
+	case l.MovedFrom != nil:
+		return ansiCyan
+	case l.Op == OpDelete:
+		return ansiRed
+	case l.Op == OpInsert:
+		return ansiGreen
+	}
+	return ""
+}
+
+func lineNo(n int) string {
+	if n == 0 {
+		return strings.Repeat(" ", tuiLineNoWidth)
+	}
+	return fmt.Sprintf("%*d", tuiLineNoWidth, n)
+}
+
+func unifiedRows(hunks []*DiffHunk) []*tuiRow {
+	var res []*tuiRow
+	for _, h := range hunks {
+		hdr := fmt.Sprintf("@@ -%s +%s @@", patchRange(h.BeforeStart, h.BeforeCount), patchRange(h.AfterStart, h.AfterCount))
+		res = append(res, (&tuiRow{}).add(ansiCyan, hdr))
+		for _, l := range h.Lines {
+			row := &tuiRow{}
+			row.add(ansiDim, lineNo(l.BeforeLine)+" "+lineNo(l.AfterLine)+" ")
+			switch l.Op {
+			case OpDelete:
+				row.add(lineStyle(l), "-")
+			case OpInsert:
+				row.add(lineStyle(l), "+")
+			default:
+				row.add("", " ")
+			}
+			row.spans = append(row.spans, lineSpans(l, lineStyle(l))...)
+			res = append(res, row)
+		}
+	}
+	return res
+}
+
+func sideBySideTUIRows(hunks []*DiffHunk, width int) []*tuiRow {
+	// line number, space, code and a separator on each side
+	half := maxInt((width-2*(tuiLineNoWidth+1)-1)/2, 10)
+	var res []*tuiRow
+	for _, r := range sideBySideRows(hunks) {
+		row := &tuiRow{}
+		if r.Op == "skip" {
+			res = append(res, row.add(ansiDim, lineNo(0)+" ..."))
+			continue
+		}
+		var before, after []tuiSpan
+		beforeNo, afterNo := 0, 0
+		if l := r.Before; l != nil {
+			beforeNo = l.BeforeLine
+			if r.Op == OpEqual {
+				before = []tuiSpan{{"", tuiText(l.Text)}}
+			} else {
+				before = lineSpans(l, lineStyle(l))
+			}
+		}
+		if l := r.After; l != nil {
+			afterNo = l.AfterLine
+			if r.Op == OpEqual {
+				after = []tuiSpan{{"", tuiText(l.Text)}}
+			} else {
+				after = lineSpans(l, lineStyle(l))
+			}
+		}
+		row.add(ansiDim, lineNo(beforeNo)+" ")
+		row.spans = append(row.spans, fitSpans(before, half)...)
+		row.add(ansiDim, "|"+lineNo(afterNo)+" ")
+		row.spans = append(row.spans, after...)
+		res = append(res, row)
+	}
+	return res
+}
+
+func messageRow(msg string) *tuiRow {
+	return (&tuiRow{}).add(ansiDim, strings.Repeat(" ", tuiLineNoWidth+1)+msg)
+}
+
+// tuiFile is a change shown in the terminal ui
+type tuiFile struct {
+	change *Change
+	// shown in the header
+	typ, name, view string
+	// rows of the diff, nil if not computed yet
+	body []*tuiRow
+}
+
+// tui is the state of terminal ui
+type tui struct {
+	session    *Session
+	tty        *os.File
+	sttyState  string
+	files      []*tuiFile
+	generation int
+	// keyed by path and view, so that it survives refreshes
+	collapsed  map[string]bool
+	width      int
+	height     int
+	sideBySide bool
+	// first shown row and selected file
+	top int
+	cur int
+	// search
+	query     string
+	prompting bool
+	input     string
+	status    string
+}
+
+func (f *tuiFile) key() string {
+	return f.change.GetPath() + "\x00" + f.view
+}
+
+func stty(tty *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// loadChanges shows current changes of the session if they were refreshed
+func (t *tui) loadChanges() bool {
+	s := t.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.files != nil && t.generation == s.generation {
+		return false
+	}
+	isFirst := t.files == nil
+	t.generation = s.generation
+	t.files = nil
+	for _, gc := range s.changes {
+		f := &tuiFile{change: gc, typ: gc.ThickResponse.Type, view: gc.ThickResponse.View}
+		before, after := s.changeNames(&gc.GitChange)
+		f.name = after
+		if before != after {
+			f.name = before + " -> " + after
+		}
+		t.files = append(t.files, f)
+		if isFirst && len(s.changes) > tuiMaxExpandedChanges {
+			t.collapsed[f.key()] = true
+		}
+	}
+	t.cur = minInt(t.cur, maxInt(len(t.files)-1, 0))
+	return true
+}
+
+// updateSize returns true if size of the terminal changed
+func (t *tui) updateSize() bool {
+	width, height := 80, 24
+	if s, err := stty(t.tty, "size"); err == nil {
+		parts := strings.Fields(s)
+		if len(parts) == 2 {
+			h, err1 := strconv.Atoi(parts[0])
+			w, err2 := strconv.Atoi(parts[1])
+			if err1 == nil && err2 == nil && w > 0 && h > 1 {
+				width, height = w, h
+			}
+		}
+	}
+	if width == t.width && height == t.height {
+		return false
+	}
+	t.width, t.height = width, height
+	t.clearBodies()
+	return true
+}
+
+func (t *tui) clearBodies() {
+	for _, f := range t.files {
+		f.body = nil
+	}
+}
+
+func (t *tui) headerRow(i int) *tuiRow {
+	f := t.files[i]
+	arrow := "v"
+	if t.collapsed[f.key()] {
+		arrow = ">"
+	}
+	style := ansiBold
+	if i == t.cur {
+		style = ansiBold + ansiReverse
+	}
+	s := fmt.Sprintf("%s %d/%d %-8s %s", arrow, i+1, len(t.files), f.typ, tuiText(f.name))
+	if f.view != "" {
+		s += " (" + f.view + ")"
+	}
+	return (&tuiRow{}).add(style, s)
+}
+
+// fileBody returns diff rows of i-th file, computing them if needed
+func (t *tui) fileBody(i int) []*tuiRow {
+	f := t.files[i]
+	if f.body != nil {
+		return f.body
+	}
+	f.body = t.computeBody(f.change)
+	// an empty line between files
+	f.body = append(f.body, &tuiRow{})
+	return f.body
+}
+
+func (t *tui) computeBody(gc *Change) []*tuiRow {
+	tr, fc, err := t.session.loadContents(gc)
+	if err != nil {
+		return []*tuiRow{messageRow(fmt.Sprintf("Failed to read the file: %s", err))}
+	}
+	switch {
+	case tr.NoChanges:
+		return []*tuiRow{messageRow("File content is identical")}
+	case tr.IsImage:
+		msg := "Image, open differ without -tui to see it"
+		if tr.ImageBefore != nil && tr.ImageAfter != nil {
+			msg = fmt.Sprintf("Image %dx%d -> %dx%d, open differ without -tui to see it",
+				tr.ImageBefore.Width, tr.ImageBefore.Height, tr.ImageAfter.Width, tr.ImageAfter.Height)
+		}
+		return []*tuiRow{messageRow(msg)}
+	}
+	opts := diffOptions{Algorithm: diffAlgorithm, Context: diffContext, whitespaceOptions: defaultWhitespaceOptions}
+	res := computeDiff(fc.before, fc.after, opts)
+	if len(res.Hunks) == 0 {
+		return []*tuiRow{messageRow("No changed lines, only ignored whitespace or the newline at end of file differ")}
+	}
+	if detectMovedBlocks {
+		annotateMoves(res, tr.Index, t.session.getMoves(opts.whitespaceOptions))
+	}
+	if t.sideBySide {
+		return sideBySideTUIRows(res.Hunks, t.width)
+	}
+	return unifiedRows(res.Hunks)
+}
+
+// fileRows returns rows of i-th file as shown: only the header if the file
+// is collapsed
+func (t *tui) fileRows(i int) []*tuiRow {
+	rows := []*tuiRow{t.headerRow(i)}
+	if t.collapsed[t.files[i].key()] {
+		return rows
+	}
+	return append(rows, t.fileBody(i)...)
+}
+
+// rows returns rows of all files and the row where each file starts
+func (t *tui) rows() ([]*tuiRow, []int) {
+	var rows []*tuiRow
+	var starts []int
+	for i := range t.files {
+		starts = append(starts, len(rows))
+		rows = append(rows, t.fileRows(i)...)
+	}
+	return rows, starts
+}
+
+// fileAt returns index of the file shown in row
+func fileAt(starts []int, row int) int {
+	i := 0
+	for i+1 < len(starts) && starts[i+1] <= row {
+		i++
+	}
+	return i
+}
+
+func (t *tui) pageSize() int {
+	return maxInt(t.height-1, 1)
+}
+
+// scrollTo sets the first shown row, within bounds, and selects the file
+// shown at the top
+func (t *tui) scrollTo(top int) {
+	rows, starts := t.rows()
+	top = minInt(top, len(rows)-t.pageSize())
+	t.top = maxInt(top, 0)
+	if len(starts) > 0 {
+		t.cur = fileAt(starts, t.top)
+	}
+}
+
+// selectFile selects i-th file and scrolls to it
+func (t *tui) selectFile(i int) {
+	if i < 0 || i >= len(t.files) {
+		return
+	}
+	_, starts := t.rows()
+	t.scrollTo(starts[i])
+	t.cur = i
+}
+
+func (t *tui) toggleCollapsed(i int) {
+	if len(t.files) == 0 {
+		return
+	}
+	key := t.files[i].key()
+	t.collapsed[key] = !t.collapsed[key]
+	t.selectFile(i)
+}
+
+// toggleAllCollapsed collapses all files, or expands them if all are
+// collapsed already
+func (t *tui) toggleAllCollapsed() {
+	collapse := false
+	for _, f := range t.files {
+		if !t.collapsed[f.key()] {
+			collapse = true
+		}
+	}
+	for _, f := range t.files {
+		t.collapsed[f.key()] = collapse
+	}
+	t.selectFile(t.cur)
+}
+
+func (t *tui) setSideBySide(sideBySide bool) {
+	if t.sideBySide == sideBySide {
+		return
+	}
+	t.sideBySide = sideBySide
+	t.clearBodies()
+	t.selectFile(t.cur)
+}
+
+// matchesQuery returns true if s contains the search query. Like vim's
+// smartcase, search is case-insensitive if the query is all lowercase
+func (t *tui) matchesQuery(s string) bool {
+	if t.query == strings.ToLower(t.query) {
+		s = strings.ToLower(s)
+	}
+	return strings.Contains(s, t.query)
+}
+
+// search scrolls to the next (or previous) row matching the query. Bodies
+// of collapsed files are searched too and expanded if they match
+func (t *tui) search(forward bool) {
+	if t.query == "" || len(t.files) == 0 {
+		return
+	}
+	_, starts := t.rows()
+	cur := fileAt(starts, t.top)
+	pos := t.top - starts[cur]
+	step := 1
+	if !forward {
+		step = -1
+	}
+	for i := cur; i >= 0 && i < len(t.files); i += step {
+		rows := append([]*tuiRow{t.headerRow(i)}, t.fileBody(i)...)
+		j := len(rows) - 1
+		if forward {
+			j = 0
+		}
+		if i == cur {
+			j = pos + step
+		}
+		for ; j >= 0 && j < len(rows); j += step {
+			if !t.matchesQuery(rows[j].plain()) {
+				continue
+			}
+			t.collapsed[t.files[i].key()] = false
+			_, starts = t.rows()
+			t.scrollTo(starts[i] + j)
+			t.status = ""
+			return
+		}
+	}
+	t.status = fmt.Sprintf("Pattern not found: %s", t.query)
+}
+
+// renderRow writes row truncated to width, optionally with matches of the
+// search query highlighted
+func (t *tui) renderRow(buf *bytes.Buffer, r *tuiRow, showMatches bool) {
+	var highlight []bool
+	if showMatches && t.query != "" {
+		plain := []rune(r.plain())
+		q := []rune(t.query)
+		highlight = make([]bool, len(plain))
+		for i := 0; i+len(q) <= len(plain); i++ {
+			if t.matchesQuery(string(plain[i : i+len(q)])) {
+				for j := i; j < i+len(q); j++ {
+					highlight[j] = true
+				}
+			}
+		}
+	}
+	col := 0
+	curStyle := ""
+	for _, s := range r.spans {
+		for _, c := range s.text {
+			if col >= t.width {
+				break
+			}
+			style := s.style
+			if highlight != nil && highlight[col] {
+				style = ansiSearch
+			}
+			if style != curStyle {
+				buf.WriteString(ansiReset + style)
+				curStyle = style
+			}
+			buf.WriteRune(c)
+			col++
+		}
+	}
+	// reset and clear the rest of the line
+	buf.WriteString(ansiReset + "\x1b[K")
+}
+
+func (t *tui) statusLine() string {
+	if t.prompting {
+		return "/" + t.input
+	}
+	if t.status != "" {
+		return t.status
+	}
+	s := "no changes"
+	if len(t.files) > 0 {
+		s = fmt.Sprintf("[%d/%d] %s", t.cur+1, len(t.files), t.files[t.cur].name)
+	}
+	return s + "  j/k: next/prev file, c/C: collapse, s/u: side-by-side/unified, /: search, q: quit"
+}
+
+func (t *tui) draw() {
+	rows, _ := t.rows()
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for i := 0; i < t.pageSize(); i++ {
+		if n := t.top + i; n < len(rows) {
+			t.renderRow(&buf, rows[n], true)
+		} else {
+			buf.WriteString(ansiDim + "~" + ansiReset + "\x1b[K")
+		}
+		buf.WriteString("\r\n")
+	}
+	status := (&tuiRow{}).add(ansiReverse, tuiText(t.statusLine()))
+	status.spans = fitSpans(status.spans, t.width)
+	t.renderRow(&buf, status, false)
+	t.tty.Write(buf.Bytes())
+}
+
+// handleKey handles a key press, returns false to quit
+func (t *tui) handleKey(key string) bool {
+	if t.prompting {
+		switch key {
+		case "\r", "\n":
+			t.prompting = false
+			t.query = t.input
+			t.search(true)
+		case "\x1b":
+			t.prompting = false
+		case "\x7f", "\b":
+			if r := []rune(t.input); len(r) > 0 {
+				t.input = string(r[:len(r)-1])
+			}
+		default:
+			if !strings.HasPrefix(key, "\x1b") {
+				t.input += tuiText(key)
+			}
+		}
+		return true
+	}
+	t.status = ""
+	switch key {
+	case "q", "\x03":
+		return false
+	case "j":
+		t.selectFile(t.cur + 1)
+	case "k":
+		t.selectFile(t.cur - 1)
+	case "\x1b[B", "\r", "\n":
+		t.scrollTo(t.top + 1)
+	case "\x1b[A":
+		t.scrollTo(t.top - 1)
+	case " ", "\x1b[6~":
+		t.scrollTo(t.top + t.pageSize())
+	case "\x1b[5~":
+		t.scrollTo(t.top - t.pageSize())
+	case "g", "\x1b[H":
+		t.scrollTo(0)
+	case "G", "\x1b[F":
+		rows, _ := t.rows()
+		t.scrollTo(len(rows))
+	case "c":
+		t.toggleCollapsed(t.cur)
+	case "C":
+		t.toggleAllCollapsed()
+	case "s":
+		t.setSideBySide(true)
+	case "u":
+		t.setSideBySide(false)
+	case "/":
+		t.prompting, t.input = true, ""
+	case "n":
+		t.search(true)
+	case "N":
+		t.search(false)
+	}
+	return true
+}
+
+// splitKeys splits input read from the terminal into keys: characters and
+// escape sequences of special keys like arrows
+func splitKeys(s string) []string {
+	var res []string
+	for len(s) > 0 {
+		n := 1
+		if strings.HasPrefix(s, "\x1b[") {
+			n = 2
+			for n < len(s) && (s[n] < 0x40 || s[n] > 0x7e) {
+				n++
+			}
+			n = minInt(n+1, len(s))
+		} else {
+			_, n = utf8.DecodeRuneInString(s)
+		}
+		res = append(res, s[:n])
+		s = s[n:]
+	}
+	return res
+}
+
+func readKeys(tty *os.File, keys chan<- string) {
+	buf := make([]byte, 64)
+	for {
+		n, err := tty.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		for _, k := range splitKeys(string(buf[:n])) {
+			keys <- k
+		}
+	}
+}
+
+// restore puts the terminal back the way it was
+func (t *tui) restore() {
+	t.tty.WriteString("\x1b[?25h\x1b[?1049l")
+	if _, err := stty(t.tty, t.sttyState); err != nil {
+		LogErrorf("restoring terminal failed with '%s'\n", err)
+	}
+}
+
+// runTUI shows changes in the terminal instead of the browser
+func runTUI(s *Session) {
+	fatalif(isWindows(), "-tui is not supported on Windows\n")
+	// stdin might be a patch, so we talk to the terminal directly
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	fataliferr(err)
+	t := &tui{session: s, tty: tty, collapsed: make(map[string]bool)}
+	t.sttyState, err = stty(tty, "-g")
+	fataliferr(err)
+	_, err = stty(tty, "-icanon", "-echo", "min", "1")
+	fataliferr(err)
+	// logging would mess up the screen
+	verboseLogging = false
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	keys := make(chan string, 64)
+	go readKeys(tty, keys)
+	ticker := time.NewTicker(tuiPollInterval)
+	defer ticker.Stop()
+
+	// alternate screen, hidden cursor
+	tty.WriteString("\x1b[?1049h\x1b[?25l\x1b[2J")
+	t.loadChanges()
+	t.updateSize()
+	t.draw()
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok || !t.handleKey(key) {
+				t.restore()
+				return
+			}
+		case <-signals:
+			t.restore()
+			return
+		case <-ticker.C:
+			changed := t.loadChanges()
+			if t.updateSize() {
+				changed = true
+			}
+			if !changed {
+				continue
+			}
+			t.scrollTo(t.top)
+		}
+		t.draw()
+	}
+}
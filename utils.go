@@ -120,7 +120,13 @@ func isImageFile(path string) bool {
 }
 
 func runCmd(exePath string, args ...string) ([]byte, error) {
+	return runCmdInDir("", exePath, args...)
+}
+
+// runCmdInDir runs a command in dir, "" for the current directory
+func runCmdInDir(dir, exePath string, args ...string) ([]byte, error) {
 	cmd := exec.Command(exePath, args...)
+	cmd.Dir = dir
 	LogVerbosef("running: %s %v\n", filepath.Base(exePath), args)
 	return cmd.Output()
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// we wait for changes to settle down before rebuilding the list of changes
+	// because editors and git often touch several files in quick succession
+	watchDebounceDelay = 200 * time.Millisecond
+)
+
+// ChangesEvent is sent to the browser via /events when changes are rebuilt
+type ChangesEvent struct {
+	Generation int              `json:"generation"`
+	Pairs      []*ThickResponse `json:"pairs"`
+}
+
+// changeDetector re-discovers the list of changes, e.g. by running git status
+type changeDetector func() ([]*GitChange, error)
+
+// rebuildChanges re-runs change detection and updates changes, forgetting
+// contents only of changes that involve changedPaths or of all changes if
+// changedPaths is nil
+func (s *Session) rebuildChanges(changedPaths map[string]bool) error {
+	changes, err := s.detect()
+	if err != nil {
+		return err
+	}
+	old := s.getChanges()
+	if changedPaths == nil {
+		old = nil
+	}
+	s.contentsCache.removeIf(func(c GitChange) bool {
+		return changedPaths == nil || changedPaths[c.PathBefore] || changedPaths[c.PathAfter]
+	})
+	res := s.buildChanges(changes, old, changedPaths)
+
+	s.mu.Lock()
+	s.changes = res
+	s.generation++
+	ev := &ChangesEvent{
+		Generation: s.generation,
+		Pairs:      s.getPairsLocked(),
+	}
+	d, err := json.Marshal(ev)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	LogVerbosef("rebuilt changes, generation %d, %d changes\n", ev.Generation, len(res))
+	s.broadcastEvent("changes", d)
+	go s.loadImagesInfo()
+	return nil
+}
+
+// broadcastEvent sends Server-Sent Event name with JSON data d to all
+// subscribers of /events
+func (s *Session) broadcastEvent(name string, d []byte) {
+	msg := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, d))
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	for ch := range s.eventsSubscribers {
+		// don't block on slow clients, they'll get the next event
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// /events streams ChangesEvent as Server-Sent Events: "changes" when
+// changes are rebuilt and "images" with image changes once they're compared
+func handleEvents(w http.ResponseWriter, r *http.Request, s *Session) {
+	LogVerbosef("handleEvents\n")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		servePlainText(w, r, 500, "streaming not supported")
+		return
+	}
+	ch := make(chan []byte, 2)
+	s.eventsMu.Lock()
+	s.eventsSubscribers[ch] = true
+	s.eventsMu.Unlock()
+	defer func() {
+		s.eventsMu.Lock()
+		delete(s.eventsSubscribers, ch)
+		s.eventsMu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	for {
+		select {
+		case msg := <-ch:
+			w.Write(msg)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-serverDone:
+			return
+		}
+	}
+}
+
+const (
+	// change of a path that doesn't affect the diff
+	pathChangeIgnore = iota
+	// change of a path that only affects changes involving that path
+	pathChangeFile
+	// change of a path that might affect all changes (like git index)
+	pathChangeAll
+)
+
+// fileWatcher sends allPathsChanged to Events when it lost track of
+// changes, e.g. when inotify queue overflowed
+const allPathsChanged = ""
+
+// relPath returns path relative to root, or path if root is ""
+func relPath(root, path string) string {
+	if root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// watchAndRebuild rebuilds changes every time something changes in watched
+// directories. classify tells how a change to a path affects the diff.
+// Paths are relative to root, like paths of git changes
+func (s *Session) watchAndRebuild(w *fileWatcher, root string, classify func(path string) int) {
+	classifyEvent := func(path string) (string, int) {
+		if path == allPathsChanged {
+			return path, pathChangeAll
+		}
+		path = relPath(root, path)
+		return path, classify(path)
+	}
+	for p := range w.Events {
+		path, kind := classifyEvent(p)
+		if kind == pathChangeIgnore {
+			continue
+		}
+		changedPaths := map[string]bool{}
+		all := false
+		timer := time.After(watchDebounceDelay)
+	collect:
+		for {
+			switch kind {
+			case pathChangeAll:
+				all = true
+			case pathChangeFile:
+				changedPaths[path] = true
+			}
+			select {
+			case p, ok := <-w.Events:
+				if !ok {
+					// the watcher was closed
+					return
+				}
+				path, kind = classifyEvent(p)
+			case <-timer:
+				break collect
+			}
+		}
+		if all {
+			changedPaths = nil
+		}
+		err := s.rebuildChanges(changedPaths)
+		if err != nil {
+			LogErrorf("rebuildChanges() failed with '%s'\n", err)
+		}
+	}
+}
+
+func classifyGitPathChange(path string) int {
+	path = filepath.ToSlash(path)
+	switch {
+	case path == ".git/index" || path == ".git/HEAD":
+		// staging files or switching branches
+		return pathChangeAll
+	case path == ".git" || strings.HasPrefix(path, ".git/"):
+		// e.g. index.lock, which git creates even when only reading
+		return pathChangeIgnore
+	}
+	return pathChangeFile
+}
+
+func classifyDirPathChange(path string) int {
+	return pathChangeFile
+}
+
+// startWatchingGit watches the working tree (and .git for changes to the
+// index and HEAD) of the repository
+func (s *Session) startWatchingGit() {
+	root := s.spec.GitDir
+	ignored := gitIgnoredDirs(root)
+	skipDir := func(dir string) bool {
+		return ignored[filepath.ToSlash(relPath(root, dir))]
+	}
+	w, err := newFileWatcher([]string{filepath.Join(root, ".")}, skipDir)
+	if err == nil {
+		// changes to files inside .git don't matter, only to index or HEAD
+		err = w.Add(filepath.Join(root, ".git"))
+	}
+	if err != nil {
+		LogErrorf("Not watching for changes, failed with '%s'\n", err)
+		return
+	}
+	s.watcher = w
+	go s.watchAndRebuild(w, root, classifyGitPathChange)
+}
+
+// startWatchingDirs watches 2 directories being compared
+func (s *Session) startWatchingDirs() {
+	dirBefore, dirAfter := s.spec.DirBefore, s.spec.DirAfter
+	filter := newDirFilter(dirBefore, dirAfter)
+	w, err := newFileWatcher([]string{dirBefore, dirAfter}, filter.SkipWatchedDir)
+	if err != nil {
+		LogErrorf("Not watching for changes, failed with '%s'\n", err)
+		return
+	}
+	s.watcher = w
+	go s.watchAndRebuild(w, "", classifyDirPathChange)
+}
+
+// walkDirsToWatch calls fn for dir and all its sub-directories except .git
+// and those for which skipDir returns true
+func walkDirsToWatch(dir string, skipDir func(string) bool, fn func(string) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// directories can disappear while we walk them
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".git" || skipDir(path) {
+			return filepath.SkipDir
+		}
+		return fn(path)
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// fileWatcher sends paths of changed files and directories to Events. On
+// Linux it uses inotify, watching every directory because inotify is not
+// recursive
+type fileWatcher struct {
+	Events chan string
+	fd     int
+	// fd as a file, closing it wakes up readEvents blocked reading it
+	file    *os.File
+	roots   []string
+	skipDir func(string) bool
+
+	mu sync.Mutex
+	// maps inotify watch descriptor to a directory
+	dirs   map[int]string
+	closed bool
+}
+
+func newFileWatcher(dirs []string, skipDir func(string) bool) (*fileWatcher, error) {
+	// non-blocking so that reads go through the runtime poller and can be
+	// interrupted by Close
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &fileWatcher{
+		Events:  make(chan string, 256),
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		roots:   dirs,
+		skipDir: skipDir,
+		dirs:    make(map[int]string),
+	}
+	for _, dir := range dirs {
+		if err = w.addRecur(dir); err != nil {
+			w.file.Close()
+			return nil, err
+		}
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Add watches a single directory, without its sub-directories
+func (w *fileWatcher) Add(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.dirs[wd] = dir
+	return nil
+}
+
+// Close stops watching. Closing the inotify file removes all watches and
+// wakes up readEvents, which closes Events
+func (w *fileWatcher) Close() {
+	w.mu.Lock()
+	closed := w.closed
+	w.closed = true
+	w.mu.Unlock()
+	if !closed {
+		w.file.Close()
+	}
+}
+
+func (w *fileWatcher) addRecur(dir string) error {
+	return walkDirsToWatch(dir, w.skipDir, w.Add)
+}
+
+func (w *fileWatcher) readEvents() {
+	defer close(w.Events)
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		n, err := w.file.Read(buf[:])
+		if err != nil || n <= 0 {
+			w.mu.Lock()
+			closed := w.closed
+			w.mu.Unlock()
+			if !closed {
+				LogErrorf("reading inotify events failed with '%v'\n", err)
+				w.Close()
+			}
+			return
+		}
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(buf[nameStart : nameStart+int(ev.Len)])
+			name = strings.TrimRight(name, "\x00")
+			offset = nameStart + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// we lost events, including creation of directories we
+				// should watch
+				LogErrorf("inotify queue overflowed, rebuilding all changes\n")
+				for _, dir := range w.roots {
+					w.addRecur(dir)
+				}
+				w.Events <- allPathsChanged
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.dirs[int(ev.Wd)]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, int(ev.Wd))
+			}
+			w.mu.Unlock()
+			if !ok {
+				continue
+			}
+			path := dir
+			if name != "" {
+				path = filepath.Join(dir, name)
+			}
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				w.addRecur(path)
+			}
+			w.Events <- path
+		}
+	}
+}
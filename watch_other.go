@@ -0,0 +1,110 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const watchPollInterval = time.Second
+
+// fileWatcher sends paths of changed files and directories to Events. On
+// platforms other than Linux it periodically scans watched directories for
+// changes in size and modification time
+type fileWatcher struct {
+	Events  chan string
+	dirs    []string
+	skipDir func(string) bool
+	done    chan struct{}
+
+	mu sync.Mutex
+	// directories watched without their sub-directories
+	flatDirs []string
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func newFileWatcher(dirs []string, skipDir func(string) bool) (*fileWatcher, error) {
+	w := &fileWatcher{
+		Events:  make(chan string, 256),
+		dirs:    dirs,
+		skipDir: skipDir,
+		done:    make(chan struct{}),
+	}
+	go w.poll()
+	return w, nil
+}
+
+// Add watches a single directory, without its sub-directories
+func (w *fileWatcher) Add(dir string) error {
+	w.mu.Lock()
+	w.flatDirs = append(w.flatDirs, dir)
+	w.mu.Unlock()
+	return nil
+}
+
+// Close stops watching and closes Events
+func (w *fileWatcher) Close() {
+	close(w.done)
+}
+
+func scanDir(dir string, res map[string]fileStamp) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		// directories can disappear while we scan them
+		return nil
+	}
+	for _, f := range files {
+		if fi, err := f.Info(); err == nil && !fi.IsDir() {
+			res[filepath.Join(dir, f.Name())] = fileStamp{fi.Size(), fi.ModTime()}
+		}
+	}
+	return nil
+}
+
+func (w *fileWatcher) scan() map[string]fileStamp {
+	res := make(map[string]fileStamp)
+	for _, dir := range w.dirs {
+		walkDirsToWatch(dir, w.skipDir, func(path string) error {
+			return scanDir(path, res)
+		})
+	}
+	w.mu.Lock()
+	flatDirs := w.flatDirs
+	w.mu.Unlock()
+	for _, dir := range flatDirs {
+		scanDir(dir, res)
+	}
+	return res
+}
+
+func (w *fileWatcher) poll() {
+	prev := w.scan()
+	for {
+		select {
+		case <-w.done:
+			close(w.Events)
+			return
+		case <-time.After(watchPollInterval):
+		}
+		curr := w.scan()
+		for path, st := range curr {
+			if prevSt, ok := prev[path]; !ok || prevSt != st {
+				w.Events <- path
+			}
+		}
+		for path := range prev {
+			if _, ok := curr[path]; !ok {
+				w.Events <- path
+			}
+		}
+		prev = curr
+	}
+}
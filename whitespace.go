@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// whitespaceOptions tell which whitespace differences to ignore when
+// comparing lines. Names of query arguments match json names
+type whitespaceOptions struct {
+	// like git diff -w
+	IgnoreAllSpace bool `json:"ignore_all_space"`
+	// like git diff -b
+	IgnoreSpaceChange bool `json:"ignore_space_change"`
+	// like git diff --ignore-blank-lines
+	IgnoreBlankLines bool `json:"ignore_blank_lines"`
+	// CRLF vs. LF line endings
+	IgnoreEOL bool `json:"ignore_eol"`
+}
+
+var (
+	// set with command-line flags
+	defaultWhitespaceOptions whitespaceOptions
+)
+
+func (o whitespaceOptions) ignoresAnything() bool {
+	return o.IgnoreAllSpace || o.IgnoreSpaceChange || o.IgnoreBlankLines || o.IgnoreEOL
+}
+
+func removeAllSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// normalizeLine returns a line such that lines that only differ in ignored
+// whitespace are equal
+func (o whitespaceOptions) normalizeLine(s string) string {
+	if o.IgnoreEOL {
+		s = strings.TrimSuffix(s, "\r")
+	}
+	if o.IgnoreAllSpace {
+		return removeAllSpace(s)
+	}
+	if o.IgnoreSpaceChange {
+		return strings.Join(strings.Fields(s), " ")
+	}
+	return s
+}
+
+// lineKeys returns what lines of d are compared by: lines normalized with
+// normalizeLine and, unless line endings are ignored, the last line marked
+// if d doesn't end with a newline. That way a change of only the final
+// newline is a change. Lines never contain "\n" so it can be the mark
+func (o whitespaceOptions) lineKeys(d []byte, lines []string) []string {
+	res := make([]string, len(lines))
+	for i, l := range lines {
+		res[i] = o.normalizeLine(l)
+	}
+	if !o.IgnoreEOL && len(res) > 0 && d[len(d)-1] != '\n' {
+		res[len(res)-1] += "\n"
+	}
+	return res
+}
+
+func isBlankLine(s string) bool {
+	return strings.TrimSpace(s) == ""
+}
+
+// hasMeaningfulChanges returns false if before and after only differ in
+// whitespace ignored by o
+func hasMeaningfulChanges(before, after []byte, o whitespaceOptions) bool {
+	normalize := func(d []byte) []string {
+		lines := splitLines(d)
+		keys := o.lineKeys(d, lines)
+		var res []string
+		for i, l := range lines {
+			if o.IgnoreBlankLines && isBlankLine(l) {
+				continue
+			}
+			res = append(res, keys[i])
+		}
+		return res
+	}
+	linesBefore, linesAfter := normalize(before), normalize(after)
+	if len(linesBefore) != len(linesAfter) {
+		return true
+	}
+	for i, l := range linesBefore {
+		if l != linesAfter[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlankOnlyGroup returns true if all changes in a group of ops only add
+// or remove blank lines
+func isBlankOnlyGroup(ops []DiffOp, before, after []string) bool {
+	for _, op := range ops {
+		if op.Op == OpEqual {
+			continue
+		}
+		for _, l := range before[op.BeforeStart:op.BeforeEnd] {
+			if !isBlankLine(l) {
+				return false
+			}
+		}
+		for _, l := range after[op.AfterStart:op.AfterEnd] {
+			if !isBlankLine(l) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// whitespaceOptionsFromRequest returns defaultWhitespaceOptions overridden
+// by optional query arguments, e.g. ignore_eol=1
+func whitespaceOptionsFromRequest(r *http.Request) (whitespaceOptions, error) {
+	res := defaultWhitespaceOptions
+	args := []struct {
+		name string
+		v    *bool
+	}{
+		{"ignore_all_space", &res.IgnoreAllSpace},
+		{"ignore_space_change", &res.IgnoreSpaceChange},
+		{"ignore_blank_lines", &res.IgnoreBlankLines},
+		{"ignore_eol", &res.IgnoreEOL},
+	}
+	for _, arg := range args {
+		s := r.FormValue(arg.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return res, fmt.Errorf("invalid %s '%s'", arg.name, s)
+		}
+		*arg.v = v
+	}
+	return res, nil
+}
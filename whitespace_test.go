@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWhitespaceOptions(t *testing.T) {
+	none := whitespaceOptions{}
+	allSpace := whitespaceOptions{IgnoreAllSpace: true}
+	spaceChange := whitespaceOptions{IgnoreSpaceChange: true}
+	blankLines := whitespaceOptions{IgnoreBlankLines: true}
+	eol := whitespaceOptions{IgnoreEOL: true}
+	tests := []struct {
+		name          string
+		ws            whitespaceOptions
+		before, after string
+		// number of hunks of the diff, 0 if the change isn't meaningful
+		hunks int
+	}{
+		{"no options", none, "a b\n", "a  b\n", 1},
+		{"-w ignores added space", allSpace, "a b\n", "a  b\n", 0},
+		{"-w ignores space between words", allSpace, "ab\n", "a b\n", 0},
+		{"-w ignores tabs", allSpace, "\tif x {\n", "    if x {\n", 0},
+		{"-w ignores CRLF", allSpace, "a\r\nb\r\n", "a\nb\n", 0},
+		{"-w doesn't ignore blank lines", allSpace, "a\nb\n", "a\n\nb\n", 1},
+		{"-w doesn't ignore other changes", allSpace, "a b\n", "a c\n", 1},
+		{"-b ignores changed amount of space", spaceChange, "a b\n", "a \t b\n", 0},
+		{"-b ignores trailing space", spaceChange, "a\n", "a  \n", 0},
+		{"-b ignores CRLF", spaceChange, "a\r\n", "a\n", 0},
+		{"-b doesn't ignore space between words", spaceChange, "ab\n", "a b\n", 1},
+		{"ignore blank lines", blankLines, "a\nb\n", "a\n\n  \nb\n", 0},
+		{"ignore blank lines with other changes", blankLines, "a\nb\n", "a\n\nc\n", 1},
+		{"ignore blank lines doesn't ignore space", blankLines, "a b\n", "a  b\n", 1},
+		{"CRLF", none, "a\r\nb\r\n", "a\nb\n", 1},
+		{"ignore CRLF", eol, "a\r\nb\r\n", "a\nb\n", 0},
+		{"ignore CRLF doesn't ignore space", eol, "a\r\n", "a \n", 1},
+		{"final newline added", none, "a\nb", "a\nb\n", 1},
+		{"final newline removed", none, "a\nb\n", "a\nb", 1},
+		{"final newline removed with -w", allSpace, "a\nb\n", "a\nb", 1},
+		{"final newline removed with -b", spaceChange, "a\nb\n", "a\nb", 1},
+		{"ignore final newline", eol, "a\nb\n", "a\nb", 0},
+		{"ignore final CRLF", eol, "a\r\nb\r\n", "a\nb", 0},
+		{"no final newline on both sides", none, "a\nb", "a\nb", 0},
+	}
+	for _, test := range tests {
+		opts := diffOptions{Algorithm: DiffAlgorithmMyers, Context: diffContext, whitespaceOptions: test.ws}
+		res := computeDiff([]byte(test.before), []byte(test.after), opts)
+		if len(res.Hunks) != test.hunks {
+			t.Errorf("%s: got %d hunks, expected %d", test.name, len(res.Hunks), test.hunks)
+		}
+		meaningful := hasMeaningfulChanges([]byte(test.before), []byte(test.after), test.ws)
+		if meaningful != (test.hunks > 0) {
+			t.Errorf("%s: hasMeaningfulChanges() is %v", test.name, meaningful)
+		}
+	}
+}
+
+func TestNormalizeLine(t *testing.T) {
+	tests := []struct {
+		ws  whitespaceOptions
+		s   string
+		exp string
+	}{
+		{whitespaceOptions{}, " a \tb\r", " a \tb\r"},
+		{whitespaceOptions{IgnoreAllSpace: true}, " a \tb\r", "ab"},
+		{whitespaceOptions{IgnoreSpaceChange: true}, " a \tb\r", "a b"},
+		{whitespaceOptions{IgnoreEOL: true}, " a \tb\r", " a \tb"},
+		{whitespaceOptions{IgnoreEOL: true}, "a\r\r", "a\r"},
+		{whitespaceOptions{IgnoreBlankLines: true}, " \t", " \t"},
+	}
+	for _, test := range tests {
+		if got := test.ws.normalizeLine(test.s); got != test.exp {
+			t.Errorf("%+v.normalizeLine(%q): got %q, expected %q", test.ws, test.s, got, test.exp)
+		}
+	}
+}